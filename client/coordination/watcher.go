@@ -0,0 +1,132 @@
+package coordination
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yangchenxing/cangshan/logging"
+)
+
+const defaultWatchRetryInterval = 5 * time.Second
+
+// A NodeWatcher keeps the nodes of a directory up to date by LongWait. Nodes are discovered
+// again after the wait fails. OnChange, if set, is called with the nodes after every change.
+type NodeWatcher struct {
+	sync.RWMutex
+	Coordination  Coordination
+	Dir           string
+	RetryInterval time.Duration
+	OnChange      func(nodes []Node)
+	nodes         map[string]Node
+	stop          chan bool
+}
+
+// NewNodeWatcher discovers the nodes of dir and starts watching it
+func NewNodeWatcher(coordination Coordination, dir string, onChange func([]Node)) (*NodeWatcher, error) {
+	watcher := &NodeWatcher{
+		Coordination:  coordination,
+		Dir:           dir,
+		RetryInterval: defaultWatchRetryInterval,
+		OnChange:      onChange,
+		stop:          make(chan bool, 1),
+	}
+	if err := watcher.discover(); err != nil {
+		return nil, err
+	}
+	go watcher.watch()
+	return watcher, nil
+}
+
+// Nodes returns the current nodes ordered by key
+func (watcher *NodeWatcher) Nodes() []Node {
+	watcher.RLock()
+	defer watcher.RUnlock()
+	return watcher.sortedNodes()
+}
+
+// Stop stops watching
+func (watcher *NodeWatcher) Stop() {
+	select {
+	case watcher.stop <- true:
+	default:
+	}
+}
+
+func (watcher *NodeWatcher) sortedNodes() []Node {
+	nodes := make([]Node, 0, len(watcher.nodes))
+	for _, node := range watcher.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Key < nodes[j].Key })
+	return nodes
+}
+
+func (watcher *NodeWatcher) discover() error {
+	nodes, err := watcher.Coordination.Discover(watcher.Dir)
+	if err != nil {
+		return err
+	}
+	watcher.Lock()
+	watcher.nodes = make(map[string]Node, len(nodes))
+	for _, node := range nodes {
+		watcher.nodes[node.Key] = node
+	}
+	watcher.Unlock()
+	watcher.changed()
+	return nil
+}
+
+func (watcher *NodeWatcher) update(event *CoordinationEvent) {
+	watcher.Lock()
+	switch event.Type {
+	case CreateNodeEvent, ModifyNodeEvent:
+		watcher.nodes[event.Key] = Node{Key: event.Key, Value: event.Value}
+	case DeleteNodeEvent:
+		delete(watcher.nodes, event.Key)
+	}
+	watcher.Unlock()
+	watcher.changed()
+}
+
+func (watcher *NodeWatcher) changed() {
+	if watcher.OnChange != nil {
+		watcher.OnChange(watcher.Nodes())
+	}
+}
+
+func (watcher *NodeWatcher) watch() {
+	for {
+		receiveChan := make(chan *CoordinationEvent)
+		stopChan := make(chan bool, 1)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- watcher.Coordination.LongWait(watcher.Dir, receiveChan, stopChan)
+		}()
+	wait:
+		for {
+			select {
+			case event := <-receiveChan:
+				if event != nil {
+					watcher.update(event)
+				}
+			case err := <-errChan:
+				if err != nil {
+					logging.Error("Watch %s fail: %s", watcher.Dir, err.Error())
+				}
+				break wait
+			case <-watcher.stop:
+				stopChan <- true
+				return
+			}
+		}
+		select {
+		case <-time.After(watcher.RetryInterval):
+		case <-watcher.stop:
+			return
+		}
+		if err := watcher.discover(); err != nil {
+			logging.Error("Discover %s fail: %s", watcher.Dir, err.Error())
+		}
+	}
+}
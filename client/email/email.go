@@ -2,8 +2,13 @@ package email
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
 	"net/smtp"
+	"net/textproto"
 	"strings"
 
 	"github.com/yangchenxing/cangshan/application"
@@ -42,3 +47,110 @@ func (client EMail) SendText(subject, content string, receivers ...string) error
 	}
 	return nil
 }
+
+// An Attachment is a file attached to a Message
+type Attachment struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+// A Message is a mail with text and/or HTML content and attachments
+type Message struct {
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+// Send sends the message as a MIME mail to receivers and Receivers
+func (client EMail) Send(message *Message, receivers ...string) error {
+	receivers = append(receivers, client.Receivers...)
+	content, err := message.encode(client.Sender, receivers)
+	if err != nil {
+		return fmt.Errorf("Encode mail fail: %s", err.Error())
+	}
+	if err := smtp.SendMail(client.Server, client.auth, client.Sender, receivers, content); err != nil {
+		return fmt.Errorf("Send mail fail: %s", err.Error())
+	}
+	return nil
+}
+
+func (message *Message) encode(sender string, receivers []string) ([]byte, error) {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "From: %s\r\n", sender)
+	fmt.Fprintf(&buffer, "To: %s\r\n", strings.Join(receivers, ","))
+	fmt.Fprintf(&buffer, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&buffer, "MIME-Version: 1.0\r\n")
+	mixed := multipart.NewWriter(&buffer)
+	fmt.Fprintf(&buffer, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mixed.Boundary())
+	// the body part is omitted without text and html, e.g. for mails of attachments only
+	if message.Text != "" || message.HTML != "" {
+		if err := message.encodeBody(mixed); err != nil {
+			return nil, err
+		}
+	}
+	for _, attachment := range message.Attachments {
+		contentType := attachment.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		writer, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition": {mime.FormatMediaType("attachment",
+				map[string]string{"filename": attachment.Name})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+		for len(encoded) > 76 {
+			fmt.Fprintf(writer, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(writer, "%s\r\n", encoded)
+	}
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// encodeBody writes the text and html of the message as a multipart/alternative part
+func (message *Message) encodeBody(mixed *multipart.Writer) error {
+	var body bytes.Buffer
+	alternative := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", message.Text},
+		{"text/html; charset=UTF-8", message.HTML},
+	} {
+		if part.content == "" {
+			continue
+		}
+		writer, err := alternative.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		encoder := quotedprintable.NewWriter(writer)
+		if _, err := encoder.Write([]byte(part.content)); err != nil {
+			return err
+		} else if err := encoder.Close(); err != nil {
+			return err
+		}
+	}
+	if err := alternative.Close(); err != nil {
+		return err
+	}
+	writer, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(body.Bytes())
+	return err
+}
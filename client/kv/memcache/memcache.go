@@ -9,6 +9,7 @@ import (
 	"github.com/yangchenxing/cangshan/client/coordination"
 	"github.com/yangchenxing/cangshan/client/kv"
 	"github.com/yangchenxing/cangshan/logging"
+	"github.com/yangchenxing/cangshan/tracing"
 )
 
 const (
@@ -140,3 +141,8 @@ func (client *Memcache) Remove(key string) error {
 	}
 	return err
 }
+
+// WithSpan returns the client wrapped to record operations as child spans of parent
+func (client *Memcache) WithSpan(parent *tracing.Span) kv.KV {
+	return kv.WithSpan(client, "memcache."+client.ClusterName, parent)
+}
@@ -0,0 +1,85 @@
+package kv
+
+import (
+	"time"
+
+	"github.com/yangchenxing/cangshan/tracing"
+)
+
+// TracedKV records operations of a KV as child spans of a parent span
+type TracedKV struct {
+	KV
+	Name   string
+	parent *tracing.Span
+}
+
+// WithSpan wraps the KV with a TracedKV. A nil parent span disables tracing.
+func WithSpan(k KV, name string, parent *tracing.Span) *TracedKV {
+	return &TracedKV{
+		KV:     k,
+		Name:   name,
+		parent: parent,
+	}
+}
+
+func (k *TracedKV) startSpan(operation string) *tracing.Span {
+	span := k.parent.StartChild("kv."+operation, tracing.ClientSpan)
+	span.SetAttribute("kv.name", k.Name)
+	return span
+}
+
+func (k *TracedKV) Ping() error {
+	span := k.startSpan("ping")
+	defer span.Finish()
+	err := k.KV.Ping()
+	span.SetError(err)
+	return err
+}
+
+func (k *TracedKV) Get(key string) ([]byte, error) {
+	span := k.startSpan("get")
+	defer span.Finish()
+	span.SetAttribute("kv.key", key)
+	value, err := k.KV.Get(key)
+	if err != ErrNotFound {
+		span.SetError(err)
+	}
+	span.SetAttribute("kv.hit", err == nil)
+	return value, err
+}
+
+func (k *TracedKV) GetMulti(keys ...string) (map[string][]byte, error) {
+	span := k.startSpan("get_multi")
+	defer span.Finish()
+	span.SetAttribute("kv.keys", len(keys))
+	values, err := k.KV.GetMulti(keys...)
+	span.SetError(err)
+	return values, err
+}
+
+func (k *TracedKV) Set(key string, value []byte, maxage time.Duration) error {
+	span := k.startSpan("set")
+	defer span.Finish()
+	span.SetAttribute("kv.key", key)
+	err := k.KV.Set(key, value, maxage)
+	span.SetError(err)
+	return err
+}
+
+func (k *TracedKV) SetMulti(items []Item) error {
+	span := k.startSpan("set_multi")
+	defer span.Finish()
+	span.SetAttribute("kv.keys", len(items))
+	err := k.KV.SetMulti(items)
+	span.SetError(err)
+	return err
+}
+
+func (k *TracedKV) Remove(key string) error {
+	span := k.startSpan("remove")
+	defer span.Finish()
+	span.SetAttribute("kv.key", key)
+	err := k.KV.Remove(key)
+	span.SetError(err)
+	return err
+}
@@ -0,0 +1,49 @@
+package sql
+
+import (
+	"github.com/yangchenxing/cangshan/tracing"
+)
+
+// TracedDB is a DB whose queries are recorded as child spans of a parent span, usually the span
+// of a web server request.
+type TracedDB struct {
+	*DB
+	parent *tracing.Span
+}
+
+// WithSpan returns a TracedDB of the DB. A nil parent span disables tracing.
+func (db *DB) WithSpan(parent *tracing.Span) *TracedDB {
+	return &TracedDB{db, parent}
+}
+
+func (db *TracedDB) startSpan(operation, query string) *tracing.Span {
+	span := db.parent.StartChild("sql."+operation, tracing.ClientSpan)
+	span.SetAttribute("db.system", db.Driver)
+	span.SetAttribute("db.statement", normalizeSQLQuery(query))
+	return span
+}
+
+// Exec executes a non-select query
+func (db *TracedDB) Exec(query string, args ...interface{}) (Result, error) {
+	span := db.startSpan("exec", query)
+	defer span.Finish()
+	result, err := db.DB.Exec(query, args...)
+	span.SetError(err)
+	return result, err
+}
+
+// Query multiple rows
+func (db *TracedDB) Query(query string, args ...interface{}) (*Rows, error) {
+	span := db.startSpan("query", query)
+	defer span.Finish()
+	rows, err := db.DB.Query(query, args...)
+	span.SetError(err)
+	return rows, err
+}
+
+// QueryRow query single row. Errors are reported on Scan and not recorded in the span.
+func (db *TracedDB) QueryRow(query string, args ...interface{}) *Row {
+	span := db.startSpan("query_row", query)
+	defer span.Finish()
+	return db.DB.QueryRow(query, args...)
+}
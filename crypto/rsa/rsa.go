@@ -52,3 +52,12 @@ func (crypto *RSACrypto) Encrypt(keyID string, input []byte) ([]byte, error) {
 		return rsa.EncryptPKCS1v15(rand.Reader, &key.PublicKey, input)
 	}
 }
+
+// PublicKey returns the public key of the private key with keyID
+func (crypto *RSACrypto) PublicKey(keyID string) (*rsa.PublicKey, error) {
+	if key := crypto.keys[keyID]; key == nil {
+		return nil, fmt.Errorf("Unknown RSA private key: %s", keyID)
+	} else {
+		return &key.PublicKey, nil
+	}
+}
@@ -0,0 +1,18 @@
+package filestore
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrNotSupported = errors.New("operation not supported by file store")
+	ErrInvalidName  = errors.New("invalid file name")
+)
+
+// A FileStore persists named files. Names are relative slash separated paths chosen by callers.
+type FileStore interface {
+	Save(name string, content io.Reader) error
+	Open(name string) (io.ReadCloser, error)
+	Remove(name string) error
+}
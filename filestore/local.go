@@ -0,0 +1,96 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yangchenxing/cangshan/application"
+)
+
+func init() {
+	application.RegisterModulePrototype("LocalFileStore", new(LocalFileStore))
+}
+
+// A LocalFileStore saves files under a local directory
+type LocalFileStore struct {
+	Directory string
+	FileMode  os.FileMode
+	DirMode   os.FileMode
+}
+
+// Initialize the LocalFileStore module for application
+func (store *LocalFileStore) Initialize() error {
+	if store.Directory == "" {
+		return errors.New("Missing Directory")
+	}
+	if store.FileMode == 0 {
+		store.FileMode = 0644
+	}
+	if store.DirMode == 0 {
+		store.DirMode = 0755
+	}
+	if err := os.MkdirAll(store.Directory, store.DirMode); err != nil {
+		return fmt.Errorf("Create directory %s fail: %s", store.Directory, err.Error())
+	}
+	return nil
+}
+
+// Path returns the local path of a file name, or an error if the name escapes the directory
+func (store *LocalFileStore) Path(name string) (string, error) {
+	cleaned := filepath.Clean("/" + filepath.FromSlash(name))
+	if cleaned == string(filepath.Separator) || strings.HasPrefix(filepath.Base(cleaned), ".") {
+		return "", ErrInvalidName
+	}
+	return filepath.Join(store.Directory, cleaned), nil
+}
+
+// Save writes content to a temporary file then renames it, so readers never see partial files
+func (store *LocalFileStore) Save(name string, content io.Reader) error {
+	path, err := store.Path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), store.DirMode); err != nil {
+		return fmt.Errorf("create directory fail: %s", err.Error())
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return fmt.Errorf("create temporary file fail: %s", err.Error())
+	}
+	defer os.Remove(temp.Name())
+	if _, err := io.Copy(temp, content); err != nil {
+		temp.Close()
+		return fmt.Errorf("write file %s fail: %s", name, err.Error())
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("write file %s fail: %s", name, err.Error())
+	}
+	if err := os.Chmod(temp.Name(), store.FileMode); err != nil {
+		return fmt.Errorf("chmod file %s fail: %s", name, err.Error())
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return fmt.Errorf("rename file %s fail: %s", name, err.Error())
+	}
+	return nil
+}
+
+func (store *LocalFileStore) Open(name string) (io.ReadCloser, error) {
+	path, err := store.Path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (store *LocalFileStore) Remove(name string) error {
+	path, err := store.Path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
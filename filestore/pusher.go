@@ -0,0 +1,71 @@
+package filestore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/filepusher"
+)
+
+func init() {
+	application.RegisterModulePrototype("FilePusherFileStore", new(PusherFileStore))
+}
+
+// A PusherFileStore distributes saved files to a cluster with a FilePusher. Files are also
+// written to Local if set, which serves Open and Remove; otherwise those are not supported.
+// Saving buffers the whole file in memory, so MaxSize should be set to a sane limit.
+type PusherFileStore struct {
+	Pusher  filepusher.FilePusher
+	Local   *LocalFileStore
+	MaxSize int64
+}
+
+// Initialize the PusherFileStore module for application
+func (store *PusherFileStore) Initialize() error {
+	if store.Pusher == nil {
+		return errors.New("Missing Pusher")
+	}
+	return nil
+}
+
+func (store *PusherFileStore) Save(name string, content io.Reader) error {
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		return ErrInvalidName
+	}
+	if store.MaxSize > 0 {
+		content = io.LimitReader(content, store.MaxSize+1)
+	}
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return fmt.Errorf("read file %s fail: %s", name, err.Error())
+	} else if store.MaxSize > 0 && int64(len(data)) > store.MaxSize {
+		return fmt.Errorf("file %s exceeds %d bytes", name, store.MaxSize)
+	}
+	if err := store.Pusher.Push(data, "", name); err != nil {
+		return fmt.Errorf("push file %s fail: %s", name, err.Error())
+	}
+	if store.Local != nil {
+		return store.Local.Save(name, bytes.NewReader(data))
+	}
+	return nil
+}
+
+func (store *PusherFileStore) Open(name string) (io.ReadCloser, error) {
+	if store.Local == nil {
+		return nil, ErrNotSupported
+	}
+	return store.Local.Open(name)
+}
+
+func (store *PusherFileStore) Remove(name string) error {
+	if store.Local == nil {
+		return ErrNotSupported
+	}
+	return store.Local.Remove(name)
+}
@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	"sync"
+
+	"github.com/yangchenxing/cangshan/application"
+)
+
+func init() {
+	application.RegisterModulePrototype("MemoryTraceExporter", new(MemoryExporter))
+}
+
+// A MemoryExporter keeps finished spans in memory, mainly for tests. If Capacity is positive,
+// only the latest Capacity spans are kept.
+type MemoryExporter struct {
+	sync.Mutex
+	Capacity int
+	spans    []*Span
+}
+
+func (exporter *MemoryExporter) Export(span *Span) error {
+	exporter.Lock()
+	defer exporter.Unlock()
+	exporter.spans = append(exporter.spans, span)
+	if exporter.Capacity > 0 && len(exporter.spans) > exporter.Capacity {
+		exporter.spans = exporter.spans[len(exporter.spans)-exporter.Capacity:]
+	}
+	return nil
+}
+
+// Spans returns a copy of exported spans in finish order
+func (exporter *MemoryExporter) Spans() []*Span {
+	exporter.Lock()
+	defer exporter.Unlock()
+	spans := make([]*Span, len(exporter.spans))
+	copy(spans, exporter.spans)
+	return spans
+}
+
+// Reset drops all exported spans
+func (exporter *MemoryExporter) Reset() {
+	exporter.Lock()
+	defer exporter.Unlock()
+	exporter.spans = nil
+}
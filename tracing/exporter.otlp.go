@@ -0,0 +1,203 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/logging"
+)
+
+const (
+	defaultOTLPQueueSize     = 1024
+	defaultOTLPBatchSize     = 128
+	defaultOTLPFlushInterval = time.Second * 5
+	defaultOTLPTimeout       = time.Second * 10
+	otlpStatusOK             = 1
+	otlpStatusError          = 2
+)
+
+var (
+	errOTLPQueueFull = errors.New("otlp export queue is full")
+)
+
+func init() {
+	application.RegisterModulePrototype("OTLPHTTPTraceExporter", new(OTLPHTTPExporter))
+}
+
+// An OTLPHTTPExporter batches spans and posts them to an OTLP/HTTP collector with JSON
+// encoding, e.g. http://collector:4318/v1/traces
+type OTLPHTTPExporter struct {
+	URL           string
+	Headers       map[string]string
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+	client        *http.Client
+	spanChan      chan *Span
+}
+
+// Initialize the OTLPHTTPExporter module for application
+func (exporter *OTLPHTTPExporter) Initialize() error {
+	if exporter.URL == "" {
+		return errors.New("Missing URL")
+	}
+	if exporter.QueueSize == 0 {
+		exporter.QueueSize = defaultOTLPQueueSize
+	}
+	if exporter.BatchSize == 0 {
+		exporter.BatchSize = defaultOTLPBatchSize
+	}
+	if exporter.FlushInterval == 0 {
+		exporter.FlushInterval = defaultOTLPFlushInterval
+	}
+	if exporter.Timeout == 0 {
+		exporter.Timeout = defaultOTLPTimeout
+	}
+	exporter.client = &http.Client{Timeout: exporter.Timeout}
+	exporter.spanChan = make(chan *Span, exporter.QueueSize)
+	go exporter.sendSpans()
+	return nil
+}
+
+// Export queues the span, spans are dropped if the queue is full
+func (exporter *OTLPHTTPExporter) Export(span *Span) error {
+	select {
+	case exporter.spanChan <- span:
+		return nil
+	default:
+		return errOTLPQueueFull
+	}
+}
+
+func (exporter *OTLPHTTPExporter) sendSpans() {
+	ticker := time.NewTicker(exporter.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, exporter.BatchSize)
+	for {
+		select {
+		case span := <-exporter.spanChan:
+			batch = append(batch, span)
+			if len(batch) < exporter.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := exporter.post(batch); err != nil {
+			logging.Error("Export %d spans to %s fail: %s", len(batch), exporter.URL, err.Error())
+		}
+		batch = make([]*Span, 0, exporter.BatchSize)
+	}
+}
+
+func (exporter *OTLPHTTPExporter) post(spans []*Span) error {
+	content, err := json.Marshal(encodeOTLPSpans(spans))
+	if err != nil {
+		return fmt.Errorf("encode spans fail: %s", err.Error())
+	}
+	request, err := http.NewRequest("POST", exporter.URL, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range exporter.Headers {
+		request.Header.Set(key, value)
+	}
+	response, err := exporter.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	return nil
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func encodeOTLPAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]otlpKeyValue, len(keys))
+	for i, key := range keys {
+		result[i].Key = key
+		switch v := attributes[key].(type) {
+		case bool:
+			result[i].Value = map[string]interface{}{"boolValue": v}
+		case int:
+			result[i].Value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			result[i].Value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			result[i].Value = map[string]interface{}{"doubleValue": v}
+		case string:
+			result[i].Value = map[string]interface{}{"stringValue": v}
+		default:
+			result[i].Value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+	}
+	return result
+}
+
+// encodeOTLPSpans groups spans by service name into the OTLP JSON ExportTraceServiceRequest
+func encodeOTLPSpans(spans []*Span) map[string]interface{} {
+	services := make(map[string][]interface{})
+	for _, span := range spans {
+		span.Lock()
+		entity := map[string]interface{}{
+			"traceId":           span.Context.TraceIDString(),
+			"spanId":            span.Context.SpanIDString(),
+			"name":              span.Name,
+			"kind":              int(span.Kind),
+			"startTimeUnixNano": strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			"attributes":        encodeOTLPAttributes(span.Attributes),
+		}
+		if parentID := span.ParentIDString(); parentID != "" {
+			entity["parentSpanId"] = parentID
+		}
+		if span.Failed {
+			entity["status"] = map[string]interface{}{"code": otlpStatusError, "message": span.Message}
+		} else {
+			entity["status"] = map[string]interface{}{"code": otlpStatusOK}
+		}
+		span.Unlock()
+		name := span.ServiceName()
+		services[name] = append(services[name], entity)
+	}
+	resourceSpans := make([]interface{}, 0, len(services))
+	for name, entities := range services {
+		resourceSpans = append(resourceSpans, map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": encodeOTLPAttributes(map[string]interface{}{"service.name": name}),
+			},
+			"scopeSpans": []interface{}{
+				map[string]interface{}{
+					"scope": map[string]interface{}{"name": "github.com/yangchenxing/cangshan/tracing"},
+					"spans": entities,
+				},
+			},
+		})
+	}
+	return map[string]interface{}{"resourceSpans": resourceSpans}
+}
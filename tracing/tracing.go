@@ -0,0 +1,268 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/logging"
+)
+
+const (
+	// TraceParentHeader is the W3C trace context propagation header
+	TraceParentHeader = "traceparent"
+	// TraceIDAttrKey is the request attribute key of the trace id
+	TraceIDAttrKey = "trace.id"
+	// SpanIDAttrKey is the request attribute key of the current span id
+	SpanIDAttrKey = "trace.span_id"
+	// ParentSpanIDAttrKey is the request attribute key of the remote parent span id
+	ParentSpanIDAttrKey = "trace.parent_id"
+
+	defaultServiceName = "cangshan"
+	sampledFlag        = 0x01
+)
+
+var (
+	errInvalidTraceParent = errors.New("invalid traceparent")
+)
+
+func init() {
+	application.RegisterModulePrototype("Tracer", new(Tracer))
+}
+
+type SpanKind int
+
+const (
+	InternalSpan SpanKind = iota + 1
+	ServerSpan
+	ClientSpan
+)
+
+// An Exporter sends finished spans to a tracing backend
+type Exporter interface {
+	Export(span *Span) error
+}
+
+// SpanContext is the propagated part of a span
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// ParseTraceParent decodes a W3C traceparent header value
+func ParseTraceParent(value string) (SpanContext, error) {
+	var ctx SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return ctx, errInvalidTraceParent
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return ctx, errInvalidTraceParent
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx, errInvalidTraceParent
+	}
+	if _, err := hex.Decode(ctx.TraceID[:], []byte(parts[1])); err != nil {
+		return ctx, errInvalidTraceParent
+	}
+	if _, err := hex.Decode(ctx.SpanID[:], []byte(parts[2])); err != nil {
+		return ctx, errInvalidTraceParent
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return ctx, errInvalidTraceParent
+	}
+	ctx.Flags = flags[0]
+	if !ctx.IsValid() {
+		return ctx, errInvalidTraceParent
+	}
+	return ctx, nil
+}
+
+// IsValid reports whether both trace id and span id are non-zero
+func (ctx SpanContext) IsValid() bool {
+	return ctx.TraceID != [16]byte{} && ctx.SpanID != [8]byte{}
+}
+
+// IsSampled reports whether the sampled flag is set
+func (ctx SpanContext) IsSampled() bool {
+	return ctx.Flags&sampledFlag != 0
+}
+
+func (ctx SpanContext) TraceIDString() string {
+	return hex.EncodeToString(ctx.TraceID[:])
+}
+
+func (ctx SpanContext) SpanIDString() string {
+	return hex.EncodeToString(ctx.SpanID[:])
+}
+
+// TraceParent encodes the context as a W3C traceparent header value
+func (ctx SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", ctx.TraceIDString(), ctx.SpanIDString(), ctx.Flags)
+}
+
+// A Tracer creates spans and hands finished ones to its Exporter
+type Tracer struct {
+	ServiceName string
+	Exporter    Exporter
+}
+
+// Initialize the Tracer module for application
+func (tracer *Tracer) Initialize() error {
+	if tracer.ServiceName == "" {
+		tracer.ServiceName = defaultServiceName
+	}
+	return nil
+}
+
+// StartSpan starts a root span, or a child of a remote parent if parent is valid
+func (tracer *Tracer) StartSpan(name string, kind SpanKind, parent *SpanContext) *Span {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		Attributes: make(map[string]interface{}),
+		tracer:     tracer,
+	}
+	if parent != nil && parent.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Flags = parent.Flags
+		span.ParentID = parent.SpanID
+	} else {
+		randomBytes(span.Context.TraceID[:])
+		span.Context.Flags = sampledFlag
+	}
+	randomBytes(span.Context.SpanID[:])
+	return span
+}
+
+// StartRequestSpan starts a server span for an incoming http request, continuing the trace in
+// its traceparent header if present
+func (tracer *Tracer) StartRequestSpan(request *http.Request) *Span {
+	var parent *SpanContext
+	if value := request.Header.Get(TraceParentHeader); value != "" {
+		if ctx, err := ParseTraceParent(value); err != nil {
+			logging.Debug("Ignore bad traceparent %q: %s", value, err.Error())
+		} else {
+			parent = &ctx
+		}
+	}
+	span := tracer.StartSpan(request.Method+" "+request.URL.Path, ServerSpan, parent)
+	span.SetAttribute("http.method", request.Method)
+	span.SetAttribute("http.target", request.URL.RequestURI())
+	span.SetAttribute("http.host", request.Host)
+	return span
+}
+
+// A Span is a timed operation of a trace. All methods are safe to call on a nil Span, so code
+// paths without tracing need no special handling.
+type Span struct {
+	sync.Mutex
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	ParentID   [8]byte
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes map[string]interface{}
+	Failed     bool
+	Message    string
+	tracer     *Tracer
+	finished   bool
+}
+
+// StartChild starts a span in the same trace with this span as parent
+func (span *Span) StartChild(name string, kind SpanKind) *Span {
+	if span == nil {
+		return nil
+	}
+	child := span.tracer.StartSpan(name, kind, &span.Context)
+	return child
+}
+
+// ServiceName returns the service name of the tracer that created the span
+func (span *Span) ServiceName() string {
+	if span == nil || span.tracer == nil {
+		return ""
+	}
+	return span.tracer.ServiceName
+}
+
+// ParentIDString returns hex encoded parent span id, or empty string for root spans
+func (span *Span) ParentIDString() string {
+	if span == nil || span.ParentID == [8]byte{} {
+		return ""
+	}
+	return hex.EncodeToString(span.ParentID[:])
+}
+
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.Lock()
+	defer span.Unlock()
+	span.Attributes[key] = value
+}
+
+// SetError marks the span as failed with the error message. A nil error is ignored.
+func (span *Span) SetError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+	span.Lock()
+	defer span.Unlock()
+	span.Failed = true
+	span.Message = err.Error()
+}
+
+// Inject writes the traceparent header of the span for outgoing requests
+func (span *Span) Inject(header http.Header) {
+	if span == nil {
+		return
+	}
+	header.Set(TraceParentHeader, span.Context.TraceParent())
+}
+
+// Finish ends the span and exports it if sampled. Only the first call has effect.
+func (span *Span) Finish() {
+	if span == nil {
+		return
+	}
+	span.Lock()
+	if span.finished {
+		span.Unlock()
+		return
+	}
+	span.finished = true
+	span.EndTime = time.Now()
+	span.Unlock()
+	if !span.Context.IsSampled() || span.tracer == nil || span.tracer.Exporter == nil {
+		return
+	}
+	if err := span.tracer.Exporter.Export(span); err != nil {
+		logging.Warn("Export span %s of trace %s fail: %s",
+			span.Context.SpanIDString(), span.Context.TraceIDString(), err.Error())
+	}
+}
+
+func randomBytes(b []byte) {
+	for {
+		if _, err := rand.Read(b); err != nil {
+			logging.Error("Generate random trace id fail: %s", err.Error())
+		}
+		for _, c := range b {
+			if c != 0 {
+				return
+			}
+		}
+	}
+}
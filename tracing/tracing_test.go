@@ -0,0 +1,123 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{" 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 ", true, true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1", false, false},
+		{"", false, false},
+	}
+	for _, test := range tests {
+		ctx, err := ParseTraceParent(test.value)
+		if test.ok && err != nil {
+			t.Errorf("ParseTraceParent(%q) fail: %s", test.value, err.Error())
+		} else if !test.ok && err == nil {
+			t.Errorf("ParseTraceParent(%q) accepted", test.value)
+		} else if test.ok && ctx.IsSampled() != test.sampled {
+			t.Errorf("ParseTraceParent(%q) sampled: %v", test.value, ctx.IsSampled())
+		}
+	}
+}
+
+func TestInjectRoundTrip(t *testing.T) {
+	exporter := new(MemoryExporter)
+	tracer := &Tracer{Exporter: exporter}
+	tracer.Initialize()
+	request := httptest.NewRequest("GET", "/users?id=1", nil)
+	request.Header.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	server := tracer.StartRequestSpan(request)
+	if server.Context.TraceIDString() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		server.ParentIDString() != "00f067aa0ba902b7" || server.Kind != ServerSpan {
+		t.Fatalf("remote parent not continued: %s", server.Context.TraceParent())
+	}
+	if server.Attributes["http.method"] != "GET" || server.Attributes["http.target"] != "/users?id=1" {
+		t.Errorf("unexpected attributes: %v", server.Attributes)
+	}
+	client := server.StartChild("GET backend", ClientSpan)
+	header := make(http.Header)
+	client.Inject(header)
+	ctx, err := ParseTraceParent(header.Get(TraceParentHeader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx != client.Context {
+		t.Errorf("injected context %s differs from %s", ctx.TraceParent(), client.Context.TraceParent())
+	}
+	if ctx.TraceID != server.Context.TraceID || client.ParentID != server.Context.SpanID {
+		t.Errorf("child not in the trace of its parent: %s", ctx.TraceParent())
+	}
+	client.Finish()
+	server.Finish()
+	server.Finish()
+	if spans := exporter.Spans(); len(spans) != 2 || spans[0] != client || spans[1] != server {
+		t.Errorf("unexpected exported spans: %v", spans)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	exporter := new(MemoryExporter)
+	tracer := &Tracer{Exporter: exporter}
+	tracer.Initialize()
+	tests := []struct {
+		name     string
+		parent   string
+		exported bool
+	}{
+		{"root", "", true},
+		{"sampled parent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"unsampled parent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false},
+		{"bad parent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", true},
+	}
+	for _, test := range tests {
+		exporter.Reset()
+		request := httptest.NewRequest("GET", "/", nil)
+		if test.parent != "" {
+			request.Header.Set(TraceParentHeader, test.parent)
+		}
+		span := tracer.StartRequestSpan(request)
+		span.StartChild("child", InternalSpan).Finish()
+		span.Finish()
+		if count := len(exporter.Spans()); test.exported && count != 2 || !test.exported && count != 0 {
+			t.Errorf("%s: %d spans exported", test.name, count)
+		}
+	}
+	var span *Span
+	span.SetAttribute("key", "value")
+	span.Inject(make(http.Header))
+	span.Finish()
+	if span.StartChild("child", InternalSpan) != nil {
+		t.Error("nil span started a child")
+	}
+}
+
+func TestMemoryExporterCapacity(t *testing.T) {
+	exporter := &MemoryExporter{Capacity: 2}
+	tracer := &Tracer{Exporter: exporter}
+	var spans []*Span
+	for i := 0; i < 3; i++ {
+		span := tracer.StartSpan("span", InternalSpan, nil)
+		span.Finish()
+		spans = append(spans, span)
+	}
+	if exported := exporter.Spans(); len(exported) != 2 || exported[0] != spans[1] || exported[1] != spans[2] {
+		t.Errorf("unexpected exported spans: %v", exported)
+	}
+}
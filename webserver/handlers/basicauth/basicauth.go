@@ -25,21 +25,28 @@ type BasicAuth struct {
 }
 
 // Handle basic auth of the request, the request should stop with 401 status if the authentication
-// fail.
+// fail. The authenticated username is set to the "request.user" attribute for access log.
 func (auth *BasicAuth) Handle(request *webserver.Request) {
 	username, password, ok := request.BasicAuth()
 	if ok && auth.Authenticator.Authenticate(username, password) {
+		request.Attr["request.user"] = username
 		return
 	}
+	if ok {
+		request.Info("Basic auth of user %s fail", username)
+	}
 	request.ResponseHeader().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, auth.Realm))
-	request.Write(http.StatusUnauthorized, nil, "")
+	request.WriteAndStop(http.StatusUnauthorized, nil, "")
 }
 
+// A User is a configured user, Password is a hash supported by VerifyPassword, or plaintext not
+// starting with "$" or "{".
 type User struct {
 	Username string
 	Password string
 }
 
+// A SimpleBasicAuthenticator authenticates users configured in Users.
 type SimpleBasicAuthenticator struct {
 	Users []User
 	users map[string]string
@@ -54,5 +61,10 @@ func (auth *SimpleBasicAuthenticator) Initialize() error {
 }
 
 func (auth *SimpleBasicAuthenticator) Authenticate(username, password string) bool {
-	return auth.users[username] == password
+	hash, found := auth.users[username]
+	if !found {
+		verifyUnknown(password)
+		return false
+	}
+	return verifyConfigPassword(hash, password)
 }
@@ -0,0 +1,94 @@
+package basicauth
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/logging"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerHtpasswdAuthenticator", new(HtpasswdAuthenticator))
+}
+
+// A HtpasswdAuthenticator authenticates users in a htpasswd file, which is reloaded if modified.
+// Lines are "username:hash" in formats supported by VerifyPassword, empty lines and lines
+// starting with # are ignored.
+type HtpasswdAuthenticator struct {
+	sync.RWMutex
+	Path          string
+	CheckInterval time.Duration
+	FailSleep     time.Duration
+	users         map[string]string
+	timestamp     time.Time
+}
+
+func (auth *HtpasswdAuthenticator) Initialize() error {
+	if auth.CheckInterval == 0 {
+		auth.CheckInterval = time.Minute
+	}
+	if err := auth.update(); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			time.Sleep(auth.CheckInterval)
+			if err := auth.update(); err != nil {
+				logging.Error("Update htpasswd file \"%s\" fail: %s", auth.Path, err.Error())
+				time.Sleep(auth.FailSleep)
+			}
+		}
+	}()
+	return nil
+}
+
+func (auth *HtpasswdAuthenticator) Authenticate(username, password string) bool {
+	auth.RLock()
+	hash, found := auth.users[username]
+	auth.RUnlock()
+	if !found {
+		verifyUnknown(password)
+		return false
+	}
+	return VerifyPassword(hash, password)
+}
+
+func (auth *HtpasswdAuthenticator) update() error {
+	info, err := os.Stat(auth.Path)
+	if err != nil {
+		return err
+	} else if !info.ModTime().After(auth.timestamp) {
+		return nil
+	}
+	f, err := os.Open(auth.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if pos := strings.Index(line, ":"); pos > 0 {
+			users[line[:pos]] = line[pos+1:]
+		} else {
+			logging.Warn("Ignore bad htpasswd line in \"%s\": %s", auth.Path, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	auth.Lock()
+	auth.users = users
+	auth.timestamp = info.ModTime()
+	auth.Unlock()
+	logging.Info("Htpasswd file \"%s\" updated", auth.Path)
+	return nil
+}
@@ -0,0 +1,176 @@
+package basicauth
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	apr1Prefix   = "$apr1$"
+	shaPrefix    = "{SHA}"
+	plainPrefix  = "{PLAIN}"
+	apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// dummyHash is verified for unknown users so that they take as long as known users
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// HashPassword returns the bcrypt hash of the password with default cost
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// VerifyPassword checks the password against a hash in one of the formats:
+//
+//	bcrypt:  $2a$, $2b$ or $2y$ prefixed, as generated by HashPassword or htpasswd -B
+//	argon2:  $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash> or $argon2i$..., base64 without padding
+//	apr1:    $apr1$ prefixed md5, as generated by htpasswd -m
+//	sha1:    {SHA} prefixed base64, as generated by htpasswd -s
+//	plain:   {PLAIN} prefixed
+//
+// Values in other formats, including crypt, $5$ and $6$ hashes, never match. All comparisons are
+// constant time.
+func VerifyPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$argon2"):
+		ok, err := verifyArgon2(hash, password)
+		return ok && err == nil
+	case strings.HasPrefix(hash, apr1Prefix):
+		return constantTimeEqual(hash, apr1Crypt(password, hash[len(apr1Prefix):]))
+	case strings.HasPrefix(hash, shaPrefix):
+		sum := sha1.Sum([]byte(password))
+		return constantTimeEqual(hash[len(shaPrefix):], base64.StdEncoding.EncodeToString(sum[:]))
+	case strings.HasPrefix(hash, plainPrefix):
+		return constantTimeEqual(hash[len(plainPrefix):], password)
+	}
+	return false
+}
+
+// verifyConfigPassword is VerifyPassword accepting also bare plaintext not starting with "$" or
+// "{", for passwords written in configurations
+func verifyConfigPassword(hash, password string) bool {
+	if hash != "" && hash[0] != '$' && hash[0] != '{' {
+		return constantTimeEqual(hash, password)
+	}
+	return VerifyPassword(hash, password)
+}
+
+// verifyUnknown spends the time of a password verification for an unknown user
+func verifyUnknown(password string) {
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func verifyArgon2(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("bad argon2 hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version: %s", parts[2])
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, fmt.Errorf("bad argon2 parameters: %s", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+	var key []byte
+	switch parts[1] {
+	case "argon2id":
+		key = argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(expected)))
+	case "argon2i":
+		key = argon2.Key([]byte(password), salt, iterations, memory, threads, uint32(len(expected)))
+	default:
+		return false, fmt.Errorf("unsupported argon2 variant: %s", parts[1])
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
+
+// apr1Crypt implements the Apache variant of md5 crypt, salt may be followed by "$hash"
+func apr1Crypt(password, salt string) string {
+	if pos := strings.Index(salt, "$"); pos >= 0 {
+		salt = salt[:pos]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	alternate := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + apr1Prefix + salt))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alternate[:])
+		} else {
+			ctx.Write(alternate[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte{password[0]})
+		}
+	}
+	final := ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write([]byte(password))
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write([]byte(password))
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write([]byte(password))
+		}
+		final = round.Sum(nil)
+	}
+	var result strings.Builder
+	result.WriteString(apr1Prefix + salt + "$")
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			result.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(final[0], final[6], final[12], 4)
+	encode(final[1], final[7], final[13], 4)
+	encode(final[2], final[8], final[14], 4)
+	encode(final[3], final[9], final[15], 4)
+	encode(final[4], final[10], final[5], 4)
+	encode(0, 0, final[11], 2)
+	return result.String()
+}
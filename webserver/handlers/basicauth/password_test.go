@@ -0,0 +1,89 @@
+package basicauth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func argon2Hash(variant string, password string) string {
+	salt := []byte("0123456789abcdef")
+	var key []byte
+	if variant == "argon2id" {
+		key = argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+	} else {
+		key = argon2.Key([]byte(password), salt, 1, 1024, 1, 32)
+	}
+	return fmt.Sprintf("$%s$v=%d$m=1024,t=1,p=1$%s$%s", variant, argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha512Crypt := "$6$saltsalt$TVLlQcbpFVof5W3Yz4DTP6gRstiNuHwwTt6GLc1E5n0U0aDehy0S5knV8wiOQSpT0Y77vwPZN.Pq.H91p5hVO1"
+	sha256Crypt := "$5$saltsalt$0IyaXrmV7.sGNS6tirgqHLqX/G.FBvgkYA.lpPdS5sA"
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		ok       bool
+	}{
+		{"bcrypt", bcryptHash, "secret", true},
+		{"bcrypt wrong", bcryptHash, "Secret", false},
+		{"bcrypt 2y", "$2y" + bcryptHash[3:], "secret", true},
+		{"argon2id", argon2Hash("argon2id", "secret"), "secret", true},
+		{"argon2id wrong", argon2Hash("argon2id", "secret"), "secret2", false},
+		{"argon2i", argon2Hash("argon2i", "secret"), "secret", true},
+		{"argon2 unknown variant", argon2Hash("argon2d", "secret"), "secret", false},
+		{"argon2 malformed", "$argon2id$v=19$m=1024", "secret", false},
+		{"apr1", "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "secret", true},
+		{"apr1 wrong", "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "secret1", false},
+		{"sha1", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+		{"sha1 wrong", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secreT", false},
+		{"plain prefix", "{PLAIN}secret", "secret", true},
+		{"plain prefix wrong", "{PLAIN}secret", "{PLAIN}secret", false},
+		{"bare plaintext", "secret", "secret", false},
+		{"sha512-crypt", sha512Crypt, "secret", false},
+		{"sha512-crypt as password", sha512Crypt, sha512Crypt, false},
+		{"sha256-crypt as password", sha256Crypt, sha256Crypt, false},
+		{"des crypt as password", "saHW9GdxihkGQ", "saHW9GdxihkGQ", false},
+		{"unknown prefix as password", "{SSHA}abc", "{SSHA}abc", false},
+		{"empty", "", "", false},
+	}
+	for _, test := range tests {
+		if ok := VerifyPassword(test.hash, test.password); ok != test.ok {
+			t.Errorf("%s: VerifyPassword(%q, %q) = %v", test.name, test.hash, test.password, ok)
+		}
+	}
+}
+
+func TestVerifyConfigPassword(t *testing.T) {
+	tests := []struct {
+		hash     string
+		password string
+		ok       bool
+	}{
+		{"secret", "secret", true},
+		{"secret", "other", false},
+		{"{PLAIN}secret", "secret", true},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+		{"$6$saltsalt$TVLlQcbpFVof5W3Yz4DTP6gRstiNuHwwTt6GLc1E5n0U0aDehy0S5knV8wiOQSpT0Y77vwPZN.Pq.H91p5hVO1",
+			"$6$saltsalt$TVLlQcbpFVof5W3Yz4DTP6gRstiNuHwwTt6GLc1E5n0U0aDehy0S5knV8wiOQSpT0Y77vwPZN.Pq.H91p5hVO1", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		if ok := verifyConfigPassword(test.hash, test.password); ok != test.ok {
+			t.Errorf("verifyConfigPassword(%q, %q) = %v", test.hash, test.password, ok)
+		}
+	}
+	auth := &SimpleBasicAuthenticator{Users: []User{{Username: "alice", Password: "secret"}}}
+	auth.Initialize()
+	if !auth.Authenticate("alice", "secret") || auth.Authenticate("alice", "x") || auth.Authenticate("bob", "secret") {
+		t.Error("unexpected authentication of configured users")
+	}
+}
@@ -0,0 +1,44 @@
+package basicauth
+
+import (
+	gosql "database/sql"
+	"errors"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/client/sql"
+	"github.com/yangchenxing/cangshan/logging"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerSQLAuthenticator", new(SQLAuthenticator))
+}
+
+// A SQLAuthenticator authenticates users with password hashes queried from database. Query takes
+// the username as the only argument and returns the hash, like
+// "SELECT password FROM users WHERE username=? AND enabled=1".
+type SQLAuthenticator struct {
+	DB    *sql.DB
+	Query string
+}
+
+func (auth *SQLAuthenticator) Initialize() error {
+	if auth.DB == nil {
+		return errors.New("Missing DB")
+	}
+	if auth.Query == "" {
+		return errors.New("Missing Query")
+	}
+	return nil
+}
+
+func (auth *SQLAuthenticator) Authenticate(username, password string) bool {
+	var hash string
+	if err := auth.DB.QueryRow(auth.Query, username).Scan(&hash); err != nil {
+		if err != gosql.ErrNoRows {
+			logging.Error("Query password of user %s fail: %s", username, err.Error())
+		}
+		verifyUnknown(password)
+		return false
+	}
+	return VerifyPassword(hash, password)
+}
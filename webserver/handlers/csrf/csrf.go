@@ -0,0 +1,250 @@
+package csrf
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/webserver"
+	"github.com/yangchenxing/cangshan/webserver/handlers/session"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerCSRF", new(CSRF))
+}
+
+const (
+	SessionMode      = "session"
+	DoubleSubmitMode = "double-submit"
+	// TokenAttrKey is the request attribute key of the token to embed in forms or pages
+	TokenAttrKey = "csrf.token"
+
+	defaultTokenKey   = "csrf_token"
+	defaultHeaderName = "X-CSRF-Token"
+	defaultFormField  = "csrf_token"
+	defaultCookieName = "CSRF_TOKEN"
+	hostCookiePrefix  = "__Host-"
+	formMediaType     = "application/x-www-form-urlencoded"
+	tokenBytes        = 32
+)
+
+var safeMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+}
+
+// A CSRF handler protects unsafe methods against cross-site request forgery. Requests must
+// submit the token in the HeaderName header or FormField form field.
+//
+// In session mode the token is kept in the session map under TokenKey, so SessionLoader must
+// run before and SessionSaver after this handler. In double-submit mode the token is kept in a
+// cookie readable by scripts and signed with Secret together with the value of the HttpOnly
+// BindingCookieName cookie (CookieName with suffix "_BINDING" by default), so that tokens issued
+// to others are rejected. The binding cookie does not change with the session, so tokens stay
+// valid across logins. The token is set to request.Attr["csrf.token"] in both modes. Requests
+// matching ExemptLocations are not checked. Form fields are read from request.Param or
+// urlencoded bodies only.
+//
+// Other sub domains can still inject both cookies of clients without session, unless the cookie
+// names have the prefix "__Host-", which requires CookieSecure and no CookieDomain.
+type CSRF struct {
+	Mode              string
+	SessionKey        string
+	TokenKey          string
+	HeaderName        string
+	FormField         string
+	CookieName        string
+	CookiePath        string
+	CookieDomain      string
+	CookieSecure      bool
+	Secret            string
+	BindingCookieName string
+	ExemptLocations   []*webserver.Location
+}
+
+func (csrf *CSRF) Initialize() error {
+	if csrf.Mode == "" {
+		csrf.Mode = SessionMode
+	}
+	if csrf.SessionKey == "" {
+		csrf.SessionKey = session.DefaultSessionAttrKey
+	}
+	if csrf.TokenKey == "" {
+		csrf.TokenKey = defaultTokenKey
+	}
+	if csrf.HeaderName == "" {
+		csrf.HeaderName = defaultHeaderName
+	}
+	if csrf.FormField == "" {
+		csrf.FormField = defaultFormField
+	}
+	if csrf.CookieName == "" {
+		csrf.CookieName = defaultCookieName
+	}
+	if csrf.CookiePath == "" {
+		csrf.CookiePath = "/"
+	}
+	if csrf.BindingCookieName == "" {
+		csrf.BindingCookieName = csrf.CookieName + "_BINDING"
+	}
+	switch csrf.Mode {
+	case SessionMode:
+	case DoubleSubmitMode:
+		if csrf.Secret == "" {
+			return errors.New("Missing Secret")
+		}
+		if strings.HasPrefix(csrf.CookieName, hostCookiePrefix) ||
+			strings.HasPrefix(csrf.BindingCookieName, hostCookiePrefix) {
+			if !csrf.CookieSecure || csrf.CookieDomain != "" || csrf.CookiePath != "/" {
+				return errors.New("Cookies with prefix __Host- must be secure with path / and no domain")
+			}
+		}
+	default:
+		return fmt.Errorf("Unknown CSRF mode: %s", csrf.Mode)
+	}
+	return nil
+}
+
+func (csrf *CSRF) Handle(request *webserver.Request) {
+	for _, loc := range csrf.ExemptLocations {
+		if loc.Matches(request) {
+			return
+		}
+	}
+	var token string
+	var err error
+	if csrf.Mode == SessionMode {
+		token, err = csrf.sessionToken(request)
+	} else {
+		token, err = csrf.cookieToken(request)
+	}
+	if err != nil {
+		request.Error("Prepare CSRF token fail: %s", err.Error())
+		request.WriteAndStop(http.StatusInternalServerError, nil, "")
+		return
+	}
+	request.Attr[TokenAttrKey] = token
+	if safeMethods[request.Method] {
+		return
+	}
+	if submitted := csrf.submittedToken(request); submitted == "" {
+		csrf.reject(request, "missing CSRF token")
+	} else if subtle.ConstantTimeCompare([]byte(submitted), []byte(token)) != 1 {
+		csrf.reject(request, "invalid CSRF token")
+	}
+}
+
+// sessionToken returns the token of the session, generating one if needed
+func (csrf *CSRF) sessionToken(request *webserver.Request) (string, error) {
+	sess, ok := request.Attr[csrf.SessionKey].(map[string]interface{})
+	if !ok || sess == nil {
+		return "", errors.New("missing session")
+	}
+	if token, ok := sess[csrf.TokenKey].(string); ok && token != "" {
+		return token, nil
+	}
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	sess[csrf.TokenKey] = token
+	return token, nil
+}
+
+// cookieToken returns the signed token of the cookie, or sets a new one. A new token never
+// matches the submitted token of unsafe requests, as the client could not have read it.
+func (csrf *CSRF) cookieToken(request *webserver.Request) (string, error) {
+	binding, err := csrf.binding(request)
+	if err != nil {
+		return "", err
+	}
+	if cookie, err := request.Cookie(csrf.CookieName); err == nil && csrf.verify(cookie.Value, binding) {
+		return cookie.Value, nil
+	}
+	random, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	token := csrf.sign(random, binding)
+	request.SetCookie(csrf.newCookie(csrf.CookieName, token, false))
+	return token, nil
+}
+
+// binding returns the value of the binding cookie, which is set if missing
+func (csrf *CSRF) binding(request *webserver.Request) (string, error) {
+	if cookie, err := request.Cookie(csrf.BindingCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	value, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	request.SetCookie(csrf.newCookie(csrf.BindingCookieName, value, true))
+	return value, nil
+}
+
+func (csrf *CSRF) newCookie(name, value string, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     csrf.CookiePath,
+		Domain:   csrf.CookieDomain,
+		Secure:   csrf.CookieSecure,
+		HttpOnly: httpOnly,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (csrf *CSRF) sign(random, binding string) string {
+	mac := hmac.New(sha256.New, []byte(csrf.Secret))
+	mac.Write([]byte(random))
+	mac.Write([]byte{0})
+	mac.Write([]byte(binding))
+	return random + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (csrf *CSRF) verify(token, binding string) bool {
+	pos := strings.LastIndex(token, ".")
+	if pos <= 0 {
+		return false
+	}
+	return hmac.Equal([]byte(csrf.sign(token[:pos], binding)), []byte(token))
+}
+
+func (csrf *CSRF) submittedToken(request *webserver.Request) string {
+	if token := request.Header.Get(csrf.HeaderName); token != "" {
+		return token
+	}
+	if token, ok := request.Param[csrf.FormField].(string); ok && token != "" {
+		return token
+	}
+	// other bodies, like multipart forms, are not parsed here
+	if mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type")); mediaType == formMediaType {
+		return request.PostFormValue(csrf.FormField)
+	}
+	return ""
+}
+
+func (csrf *CSRF) reject(request *webserver.Request, message string) {
+	request.Info("Reject %s %s: %s", request.Method, request.URL.Path, message)
+	webserver.WriteStandardJSONResultWithStatus(request, http.StatusForbidden, false, "message", message)
+	request.Stop()
+}
+
+func generateToken() (string, error) {
+	var buf [tokenBytes]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
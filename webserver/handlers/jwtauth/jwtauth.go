@@ -0,0 +1,218 @@
+package jwtauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/crypto/rsa"
+	"github.com/yangchenxing/cangshan/webserver"
+	"github.com/yangchenxing/cangshan/webserver/handlers/roleauth"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerJWTAuth", new(JWTAuth))
+}
+
+const (
+	DefaultClaimsAttrKey = "jwt.claims"
+	DefaultRolesClaim    = "roles"
+	DefaultUserClaim     = "sub"
+	defaultClockSkew     = 30 * time.Second
+)
+
+// A JWTAuth authenticates requests by bearer token in the Authorization header. HS256 tokens are
+// verified with Secret, RS256 tokens with keys of JWKSFile or RSACrypto by the kid header, and
+// ES256 tokens with keys of JWKSFile. exp is required unless AllowNoExpiration, nbf is checked
+// if present, and iss and aud are checked if Issuer and Audiences are set, tolerating ClockSkew.
+//
+// The claims are stored in request.Attr[ClaimsKey], claims in ClaimAttrs are also stored with the
+// mapped attribute keys, and the RolesClaim list is set to the request attribute
+// roleauth.RolesAttrKey read by RoleAuth and Policy. The session is not changed, so that roles
+// of tokens are not saved into sessions.
+// Requests without token pass if Optional, otherwise they stop with 401.
+type JWTAuth struct {
+	Realm             string
+	Algorithms        []string
+	Secret            string
+	RSACrypto         *rsacrypto.RSACrypto
+	JWKSFile          string
+	Issuer            string
+	Audiences         []string
+	ClockSkew         time.Duration
+	AllowNoExpiration bool
+	Optional          bool
+	ClaimsKey         string
+	ClaimAttrs        map[string]string
+	UserClaim         string
+	RolesClaim        string
+	algorithms        map[string]bool
+	jwks              map[string]interface{}
+}
+
+func (auth *JWTAuth) Initialize() error {
+	if auth.ClockSkew == 0 {
+		auth.ClockSkew = defaultClockSkew
+	}
+	if auth.ClaimsKey == "" {
+		auth.ClaimsKey = DefaultClaimsAttrKey
+	}
+	if auth.UserClaim == "" {
+		auth.UserClaim = DefaultUserClaim
+	}
+	if auth.RolesClaim == "" {
+		auth.RolesClaim = DefaultRolesClaim
+	}
+	if auth.JWKSFile != "" {
+		var err error
+		if auth.jwks, err = loadJWKS(auth.JWKSFile); err != nil {
+			return fmt.Errorf("Load JWKS file \"%s\" fail: %s", auth.JWKSFile, err.Error())
+		}
+	}
+	if len(auth.Algorithms) == 0 {
+		if auth.Secret != "" {
+			auth.Algorithms = append(auth.Algorithms, HS256)
+		}
+		if auth.RSACrypto != nil || auth.jwks != nil {
+			auth.Algorithms = append(auth.Algorithms, RS256)
+		}
+		if auth.jwks != nil {
+			auth.Algorithms = append(auth.Algorithms, ES256)
+		}
+	}
+	if len(auth.Algorithms) == 0 {
+		return errors.New("Missing Secret, RSACrypto or JWKSFile")
+	}
+	auth.algorithms = make(map[string]bool)
+	for _, alg := range auth.Algorithms {
+		if alg != HS256 && alg != RS256 && alg != ES256 {
+			return fmt.Errorf("Unsupported algorithm: %s", alg)
+		}
+		auth.algorithms[alg] = true
+	}
+	return nil
+}
+
+func (auth *JWTAuth) Handle(request *webserver.Request) {
+	raw := bearerToken(request)
+	if raw == "" {
+		if !auth.Optional {
+			auth.reject(request, nil)
+		}
+		return
+	}
+	token, err := auth.Verify(raw, time.Now())
+	if err != nil {
+		request.Info("Reject bearer token: %s", err.Error())
+		auth.reject(request, err)
+		return
+	}
+	request.Attr[auth.ClaimsKey] = token.Claims
+	for claim, key := range auth.ClaimAttrs {
+		if value, found := token.Claims[claim]; found {
+			request.Attr[key] = value
+		}
+	}
+	if user, ok := token.Claims[auth.UserClaim].(string); ok {
+		request.Attr["request.user"] = user
+	}
+	if roles := token.StringsClaim(auth.RolesClaim); roles != nil {
+		request.Attr[roleauth.RolesAttrKey] = roles
+	}
+}
+
+// Verify parses the token and checks its signature and claims at time now
+func (auth *JWTAuth) Verify(raw string, now time.Time) (*Token, error) {
+	token, err := ParseToken(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !auth.algorithms[token.Algorithm()] {
+		return nil, errUnknownAlgorithm
+	}
+	key, err := auth.key(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := token.verify(key); err != nil {
+		return nil, err
+	}
+	if exp, found, err := token.timeClaim("exp"); err != nil {
+		return nil, err
+	} else if !found && !auth.AllowNoExpiration {
+		return nil, errors.New("missing exp claim")
+	} else if found && !now.Before(exp.Add(auth.ClockSkew)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, found, err := token.timeClaim("nbf"); err != nil {
+		return nil, err
+	} else if found && now.Add(auth.ClockSkew).Before(nbf) {
+		return nil, errors.New("token not valid yet")
+	}
+	if auth.Issuer != "" {
+		if iss, _ := token.Claims["iss"].(string); iss != auth.Issuer {
+			return nil, fmt.Errorf("unexpected issuer: %s", iss)
+		}
+	}
+	if len(auth.Audiences) > 0 && !auth.matchAudience(token.StringsClaim("aud")) {
+		return nil, errors.New("unexpected audience")
+	}
+	return token, nil
+}
+
+func (auth *JWTAuth) key(token *Token) (interface{}, error) {
+	kid := token.KeyID()
+	switch token.Algorithm() {
+	case HS256:
+		if auth.Secret == "" {
+			return nil, errUnknownAlgorithm
+		}
+		return []byte(auth.Secret), nil
+	case RS256, ES256:
+		if key, found := auth.jwks[kid]; found {
+			return key, nil
+		} else if auth.RSACrypto != nil && token.Algorithm() == RS256 {
+			return auth.RSACrypto.PublicKey(kid)
+		}
+	}
+	return nil, fmt.Errorf("unknown key: %s", kid)
+}
+
+func (auth *JWTAuth) matchAudience(audiences []string) bool {
+	for _, aud := range audiences {
+		for _, expected := range auth.Audiences {
+			if aud == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reject answers 401 with the WWW-Authenticate challenge of RFC 6750
+func (auth *JWTAuth) reject(request *webserver.Request, err error) {
+	challenge := "Bearer"
+	if auth.Realm != "" {
+		challenge += fmt.Sprintf(` realm="%s"`, auth.Realm)
+		if err != nil {
+			challenge += ","
+		}
+	}
+	if err != nil {
+		challenge += fmt.Sprintf(` error="invalid_token", error_description="%s"`,
+			strings.Replace(err.Error(), `"`, `'`, -1))
+	}
+	request.ResponseHeader().Set("WWW-Authenticate", challenge)
+	request.WriteAndStop(http.StatusUnauthorized, nil, "")
+}
+
+func bearerToken(request *webserver.Request) string {
+	header := request.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
@@ -0,0 +1,208 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+var (
+	testNow      = time.Unix(1700000000, 0)
+	testRSAKey   *rsa.PrivateKey
+	testRSAKey2  *rsa.PrivateKey
+	testECDSAKey *ecdsa.PrivateKey
+)
+
+func init() {
+	testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testRSAKey2, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testECDSAKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func encodeSegment(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signToken signs claims with alg and key: []byte for HS256, *rsa.PrivateKey for RS256,
+// *ecdsa.PrivateKey for ES256 and nil for an empty signature
+func signToken(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]interface{}{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := encodeSegment(header) + "." + encodeSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "alice",
+		"iss": "issuer",
+		"aud": []string{"api"},
+		"exp": testNow.Add(time.Hour).Unix(),
+	}
+}
+
+func withClaims(changes map[string]interface{}) map[string]interface{} {
+	claims := validClaims()
+	for key, value := range changes {
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+	}
+	return claims
+}
+
+func writeJWKS(t *testing.T) string {
+	bigInt := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+	set := map[string]interface{}{"keys": []map[string]interface{}{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": bigInt(testRSAKey.N),
+			"e": bigInt(big.NewInt(int64(testRSAKey.E)))},
+		{"kty": "RSA", "kid": "rsa2", "n": bigInt(testRSAKey2.N),
+			"e": bigInt(big.NewInt(int64(testRSAKey2.E)))},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": bigInt(testRSAKey2.N),
+			"e": bigInt(big.NewInt(int64(testRSAKey2.E)))},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": bigInt(testECDSAKey.X),
+			"y": bigInt(testECDSAKey.Y)},
+	}}
+	file, err := ioutil.TempFile("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := json.NewEncoder(file).Encode(set); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestVerify(t *testing.T) {
+	jwks := writeJWKS(t)
+	defer os.Remove(jwks)
+	auth := &JWTAuth{
+		Secret:    "secret",
+		JWKSFile:  jwks,
+		Issuer:    "issuer",
+		Audiences: []string{"api"},
+	}
+	if err := auth.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret")
+	publicKeyBytes := testRSAKey.PublicKey.N.Bytes()
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"HS256", signToken(t, HS256, "", secret, validClaims()), true},
+		{"HS256 wrong secret", signToken(t, HS256, "", []byte("other"), validClaims()), false},
+		{"RS256", signToken(t, RS256, "rsa1", testRSAKey, validClaims()), true},
+		{"RS256 key without use", signToken(t, RS256, "rsa2", testRSAKey2, validClaims()), true},
+		{"RS256 wrong kid", signToken(t, RS256, "rsa2", testRSAKey, validClaims()), false},
+		{"RS256 unknown kid", signToken(t, RS256, "missing", testRSAKey, validClaims()), false},
+		{"RS256 encryption key", signToken(t, RS256, "enc", testRSAKey2, validClaims()), false},
+		{"ES256", signToken(t, ES256, "ec1", testECDSAKey, validClaims()), true},
+		{"ES256 with RSA kid", signToken(t, ES256, "rsa1", testECDSAKey, validClaims()), false},
+		{"RS256 with EC kid", signToken(t, RS256, "ec1", testRSAKey, validClaims()), false},
+		{"HS256 signed by RSA public key", signToken(t, HS256, "rsa1", publicKeyBytes, validClaims()), false},
+		{"none", signToken(t, "none", "", nil, validClaims()), false},
+		{"HS512", signToken(t, "HS512", "", secret, validClaims()), false},
+		{"expired", signToken(t, HS256, "", secret, withClaims(map[string]interface{}{
+			"exp": testNow.Add(-time.Minute).Unix()})), false},
+		{"expired within clock skew", signToken(t, HS256, "", secret, withClaims(map[string]interface{}{
+			"exp": testNow.Add(-10 * time.Second).Unix()})), true},
+		{"missing exp", signToken(t, HS256, "", secret, withClaims(map[string]interface{}{"exp": nil})), false},
+		{"bad exp", signToken(t, HS256, "", secret, withClaims(map[string]interface{}{"exp": "tomorrow"})), false},
+		{"not valid yet", signToken(t, HS256, "", secret, withClaims(map[string]interface{}{
+			"nbf": testNow.Add(time.Minute).Unix()})), false},
+		{"valid since", signToken(t, HS256, "", secret, withClaims(map[string]interface{}{
+			"nbf": testNow.Add(-time.Minute).Unix()})), true},
+		{"wrong issuer", signToken(t, HS256, "", secret, withClaims(map[string]interface{}{"iss": "other"})), false},
+		{"missing issuer", signToken(t, HS256, "", secret, withClaims(map[string]interface{}{"iss": nil})), false},
+		{"string audience", signToken(t, HS256, "", secret, withClaims(map[string]interface{}{"aud": "api"})), true},
+		{"wrong audience", signToken(t, HS256, "", secret, withClaims(map[string]interface{}{
+			"aud": []string{"web"}})), false},
+		{"malformed", "a.b", false},
+	}
+	for _, test := range tests {
+		token, err := auth.Verify(test.token, testNow)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		} else if test.ok && token.Claims["sub"] != "alice" {
+			t.Errorf("%s: unexpected claims: %v", test.name, token.Claims)
+		}
+	}
+}
+
+func TestVerifyAlgorithms(t *testing.T) {
+	auth := &JWTAuth{Secret: "secret", Algorithms: []string{RS256}, AllowNoExpiration: true}
+	if err := auth.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	// HS256 is not allowed even though Secret is set
+	if _, err := auth.Verify(signToken(t, HS256, "", []byte("secret"), validClaims()), testNow); err == nil {
+		t.Error("HS256 token accepted while only RS256 is allowed")
+	}
+	if err := (&JWTAuth{Algorithms: []string{"none"}}).Initialize(); err == nil {
+		t.Error("algorithm none accepted")
+	}
+	if err := (&JWTAuth{}).Initialize(); err == nil {
+		t.Error("missing keys accepted")
+	}
+}
+
+func TestStringsClaim(t *testing.T) {
+	token := &Token{Claims: map[string]interface{}{
+		"scope": "read write",
+		"roles": []interface{}{"admin", 1, "user"},
+	}}
+	if roles := token.StringsClaim("roles"); len(roles) != 2 || roles[0] != "admin" || roles[1] != "user" {
+		t.Errorf("unexpected roles: %v", roles)
+	}
+	if scope := token.StringsClaim("scope"); len(scope) != 2 || scope[1] != "write" {
+		t.Errorf("unexpected scope: %v", scope)
+	}
+	if missing := token.StringsClaim("missing"); missing != nil {
+		t.Errorf("unexpected missing claim: %v", missing)
+	}
+}
@@ -0,0 +1,151 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+var (
+	errMalformed        = errors.New("malformed token")
+	errBadSignature     = errors.New("bad signature")
+	errUnknownAlgorithm = errors.New("unsupported algorithm")
+)
+
+// A Token is a parsed JSON web token
+type Token struct {
+	Header    map[string]interface{}
+	Claims    map[string]interface{}
+	signed    []byte
+	signature []byte
+}
+
+// ParseToken parses a compact serialized JWS token without verifying it
+func ParseToken(raw string) (*Token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errMalformed
+	}
+	token := &Token{signed: []byte(parts[0] + "." + parts[1])}
+	if err := decodeSegment(parts[0], &token.Header); err != nil {
+		return nil, err
+	}
+	if err := decodeSegment(parts[1], &token.Claims); err != nil {
+		return nil, err
+	}
+	var err error
+	if token.signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, errMalformed
+	}
+	return token, nil
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errMalformed
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	if err := decoder.Decode(value); err != nil {
+		return errMalformed
+	}
+	return nil
+}
+
+// Algorithm returns the alg header
+func (token *Token) Algorithm() string {
+	alg, _ := token.Header["alg"].(string)
+	return alg
+}
+
+// KeyID returns the kid header
+func (token *Token) KeyID() string {
+	kid, _ := token.Header["kid"].(string)
+	return kid
+}
+
+// verify checks the signature with key, which must be []byte for HS256, *rsa.PublicKey for
+// RS256 and *ecdsa.PublicKey for ES256
+func (token *Token) verify(key interface{}) error {
+	digest := sha256.Sum256(token.signed)
+	switch token.Algorithm() {
+	case HS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return errBadSignature
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(token.signed)
+		if !hmac.Equal(token.signature, mac.Sum(nil)) {
+			return errBadSignature
+		}
+	case RS256:
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], token.signature) != nil {
+			return errBadSignature
+		}
+	case ES256:
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(token.signature) != 64 {
+			return errBadSignature
+		}
+		r := new(big.Int).SetBytes(token.signature[:32])
+		s := new(big.Int).SetBytes(token.signature[32:])
+		if !ecdsa.Verify(publicKey, digest[:], r, s) {
+			return errBadSignature
+		}
+	default:
+		return errUnknownAlgorithm
+	}
+	return nil
+}
+
+// timeClaim returns the NumericDate claim, found is false if the claim is missing
+func (token *Token) timeClaim(name string) (t time.Time, found bool, err error) {
+	value, found := token.Claims[name]
+	if !found {
+		return t, false, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return t, true, fmt.Errorf("bad %s claim", name)
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return t, true, fmt.Errorf("bad %s claim", name)
+	}
+	return time.Unix(int64(seconds), 0), true, nil
+}
+
+// StringsClaim returns a claim of string list, or a space separated string like OAuth2 scope
+func (token *Token) StringsClaim(name string) []string {
+	switch value := token.Claims[name].(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		result := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
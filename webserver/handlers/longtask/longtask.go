@@ -1,124 +1,237 @@
 package longtask
 
 import (
-	"bytes"
-	"container/list"
-	"io"
+	"net/http"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/yangchenxing/cangshan/application"
 	"github.com/yangchenxing/cangshan/webserver"
+	"github.com/yangchenxing/cangshan/webserver/handlers/roleauth"
+	"github.com/yangchenxing/cangshan/webserver/handlers/session"
 )
 
 func init() {
 	application.RegisterModulePrototype("WebServerLongTaskExecutive", new(LongTaskExecutive))
+	application.RegisterModulePrototype("WebServerLongTaskStatus", new(LongTaskStatus))
 	application.RegisterBuiltinModule("WebServerLongTaskStatus", new(LongTaskStatus))
 }
 
-var (
-	CleanInterval = time.Hour
-	MaxAge        = time.Hour * 24
-	tasks         = make(map[int]*Task)
-	once          sync.Once
-	nextTaskID    = 1
-)
-
-type TaskStatus int
-
-const (
-	Ready TaskStatus = iota
-	Running
-	Done
-)
+// A LongTaskExecutive submits Command to Manager, or the default manager if not set, and
+// responds the task id. Requests stop with 503 if the task queue is full.
+type LongTaskExecutive struct {
+	Manager *TaskManager
+	Command Command
+	Name    string
+}
 
-type Command interface {
-	Run(request *webserver.Request, taskID int, output io.Writer) error
+func (ex *LongTaskExecutive) Handle(request *webserver.Request) {
+	manager := ex.Manager
+	if manager == nil {
+		manager = DefaultManager()
+	}
+	params := make(map[string]interface{}, len(request.Param))
+	for key, value := range request.Param {
+		params[key] = value
+	}
+	task, err := manager.Submit(ex.Name, requestUser(request), ex.Command, params)
+	if err != nil {
+		request.Warn("Submit long task fail: %s", err.Error())
+		webserver.WriteStandardJSONResultWithStatus(request, http.StatusServiceUnavailable,
+			false, "message", err.Error())
+		request.Stop()
+		return
+	}
+	request.Info("Submit long task %s", task.ID())
+	webserver.WriteStandardJSONResult(request, true, "entities", map[string]interface{}{"id": task.ID()})
 }
 
-type Task struct {
-	ID        int
-	Request   *webserver.Request
-	Command   Command
-	Status    TaskStatus
-	Output    bytes.Buffer
-	Error     error
-	BeginTime time.Time
-	EndTime   time.Time
+// A LongTaskStatus responds the status and output from the "offset" param of the task with the
+// "id" param, or cancels the task on DELETE. The builtin module uses the default manager.
+//
+// Without "id", tasks are listed without output, filtered by the "status" (comma separated),
+// "name", "user" and "age" (max age like "1h") params and limited to the latest "limit" tasks.
+// With "stream" param or an Accept header of text/event-stream, the output is streamed as
+// server-sent events until the task finishes, see streamTask.
+//
+// Tasks are only visible to the user who submitted them, the "request.user" attribute, unless
+// the request has one of AdminRoles in the roleauth.RolesAttrKey attribute or the session. Tasks
+// of other users are reported as unknown.
+type LongTaskStatus struct {
+	Manager    *TaskManager
+	SessionKey string
+	RoleKey    string
+	AdminRoles []string
 }
 
-func (task *Task) Run() {
-	if task.Status != Ready {
-		return
+func (handler *LongTaskStatus) Initialize() error {
+	if handler.SessionKey == "" {
+		handler.SessionKey = session.DefaultSessionAttrKey
 	}
-	task.BeginTime = time.Now()
-	task.Error = task.Command.Run(task.Request, task.ID, &task.Output)
-	task.EndTime = time.Now()
+	if handler.RoleKey == "" {
+		handler.RoleKey = roleauth.DefaultRoleKey
+	}
+	return nil
 }
 
-type LongTaskExecutive struct {
-	sync.Mutex
-	Command Command
+// visible reports whether the request may access the task
+func (handler *LongTaskStatus) visible(request *webserver.Request, info TaskInfo) bool {
+	return info.User == requestUser(request) || handler.isAdmin(request)
 }
 
-func (ex *LongTaskExecutive) Handle(request *webserver.Request) {
-	once.Do(func() {
-		go clean()
-	})
-	ex.Lock()
-	defer ex.Unlock()
-	task := &Task{
-		ID:      nextTaskID,
-		Request: request,
-		Command: ex.Command,
-		Status:  Ready,
-	}
-	nextTaskID++
-	go task.Run()
-	webserver.WriteStandardJSONResult(request, true, "entities", map[string]interface{}{"id": task.ID})
+func (handler *LongTaskStatus) isAdmin(request *webserver.Request) bool {
+	if len(handler.AdminRoles) == 0 {
+		return false
+	}
+	roles, ok := request.Attr[roleauth.RolesAttrKey].([]string)
+	if !ok || roles == nil {
+		sess, _ := request.Attr[handler.SessionKey].(map[string]interface{})
+		roles, _ = sess[handler.RoleKey].([]string)
+	}
+	for _, role := range roles {
+		for _, admin := range handler.AdminRoles {
+			if role == admin {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-type LongTaskStatus struct{}
+// requestUser returns the authenticated user of the request, or empty
+func requestUser(request *webserver.Request) string {
+	user, _ := request.Attr["request.user"].(string)
+	if user == "-" {
+		return ""
+	}
+	return user
+}
 
-func (handler LongTaskStatus) Handle(request *webserver.Request) {
-	outputOffset, _ := strconv.Atoi(request.Param["offset"].(string))
-	if id, ok := request.Param["id"].(string); !ok {
-		webserver.WriteStandardJSONResult(request, false, "message", "missing task id")
-	} else if id, err := strconv.Atoi(id); err != nil {
-		webserver.WriteStandardJSONResult(request, false, "message", "invalid task id")
-	} else if task := tasks[id]; task == nil {
-		webserver.WriteStandardJSONResult(request, false, "message", "unknown task id")
-	} else {
-		entity := map[string]interface{}{
-			"id":        task.ID,
-			"done":      task.Status == Done,
-			"beginTime": task.BeginTime.Format("2006-01-02:15:04:05"),
-			"output":    task.Output.Bytes()[outputOffset:],
+func (handler *LongTaskStatus) Handle(request *webserver.Request) {
+	manager := handler.Manager
+	if manager == nil {
+		manager = DefaultManager()
+	}
+	id, _ := request.Param["id"].(string)
+	if id == "" {
+		if request.Method == "DELETE" {
+			writeError(request, http.StatusBadRequest, "missing task id")
+		} else {
+			handler.list(manager, request)
 		}
-		if task.Status == Done {
-			entity["entTime"] = task.EndTime.Format("2006-01-02:15:04:05")
-			entity["success"] = task.Error == nil
-			if task.Error != nil {
-				entity["error"] = task.Error.Error()
-			}
+		return
+	}
+	task := manager.Get(id)
+	if task == nil || !handler.visible(request, task.Info()) {
+		writeError(request, http.StatusNotFound, "unknown task id")
+		return
+	}
+	if request.Method == "DELETE" {
+		switch err := manager.Cancel(id); err {
+		case nil:
+			request.Info("Cancel long task %s", id)
+			webserver.WriteStandardJSONResult(request, true)
+		case ErrTaskNotFound:
+			writeError(request, http.StatusNotFound, "unknown task id")
+		default:
+			writeError(request, http.StatusConflict, err.Error())
 		}
-		webserver.WriteStandardJSONResult(request, true, "entities", entity)
+		return
+	}
+	offset, err := parseOffset(request)
+	if err != nil {
+		writeError(request, http.StatusBadRequest, "invalid offset")
+		return
 	}
+	if _, stream := request.Param["stream"]; stream ||
+		strings.Contains(request.Header.Get("Accept"), eventStreamType) {
+		streamTask(request, task, offset)
+		return
+	}
+	webserver.WriteStandardJSONResult(request, true, "entities", taskEntity(task, offset))
 }
 
-func clean() {
-	for {
-		time.Sleep(CleanInterval)
-		expiredIds := list.New()
-		now := time.Now()
-		for id, task := range tasks {
-			if task.BeginTime.Add(MaxAge).Before(now) {
-				expiredIds.PushBack(id)
-			}
+func (handler *LongTaskStatus) list(manager *TaskManager, request *webserver.Request) {
+	var statuses map[TaskStatus]bool
+	if value, _ := request.Param["status"].(string); value != "" {
+		statuses = make(map[TaskStatus]bool)
+		for _, status := range strings.Split(value, ",") {
+			statuses[TaskStatus(strings.TrimSpace(status))] = true
+		}
+	}
+	name, _ := request.Param["name"].(string)
+	user, _ := request.Param["user"].(string)
+	var since time.Time
+	if value, _ := request.Param["age"].(string); value != "" {
+		age, err := time.ParseDuration(value)
+		if err != nil || age < 0 {
+			writeError(request, http.StatusBadRequest, "invalid age")
+			return
+		}
+		since = time.Now().Add(-age)
+	}
+	limit := 0
+	if value, _ := request.Param["limit"].(string); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeError(request, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	tasks := manager.Tasks()
+	entities := make([]TaskInfo, 0, len(tasks))
+	for i := len(tasks) - 1; i >= 0 && (limit == 0 || len(entities) < limit); i-- {
+		info := tasks[i].Info()
+		if !handler.visible(request, info) {
+			continue
 		}
-		for id := expiredIds.Front(); id != nil; id = id.Next() {
-			delete(tasks, id.Value.(int))
+		if (statuses == nil || statuses[info.Status]) && (name == "" || info.Name == name) &&
+			(user == "" || info.User == user) && !info.CreateTime.Before(since) {
+			entities = append(entities, info)
 		}
 	}
+	webserver.WriteStandardJSONResult(request, true, "entities", entities)
+}
+
+func taskEntity(task *Task, offset int64) map[string]interface{} {
+	info := task.Info()
+	output, outputOffset := task.Output(offset)
+	return map[string]interface{}{
+		"id":           info.ID,
+		"name":         info.Name,
+		"user":         info.User,
+		"status":       info.Status,
+		"done":         info.Status.Finished(),
+		"progress":     info.Progress,
+		"message":      info.Message,
+		"error":        info.Error,
+		"createTime":   info.CreateTime,
+		"beginTime":    info.BeginTime,
+		"endTime":      info.EndTime,
+		"output":       string(output),
+		"outputOffset": outputOffset,
+		"nextOffset":   outputOffset + int64(len(output)),
+	}
+}
+
+// parseOffset returns the "offset" param, or the Last-Event-ID header of reconnected event streams
+func parseOffset(request *webserver.Request) (int64, error) {
+	value, _ := request.Param["offset"].(string)
+	if lastEventID := request.Header.Get("Last-Event-ID"); lastEventID != "" {
+		value = lastEventID
+	}
+	if value == "" {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err == nil && offset < 0 {
+		err = strconv.ErrRange
+	}
+	return offset, err
+}
+
+func writeError(request *webserver.Request, status int, message string) {
+	webserver.WriteStandardJSONResultWithStatus(request, status, false, "message", message)
+	request.Stop()
 }
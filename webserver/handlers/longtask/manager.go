@@ -0,0 +1,325 @@
+package longtask
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/client/kv"
+	"github.com/yangchenxing/cangshan/logging"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerLongTaskManager", new(TaskManager))
+}
+
+const (
+	defaultWorkers       = 4
+	defaultQueueSize     = 100
+	defaultMaxOutputSize = 1 << 20
+	defaultSaveInterval  = 5 * time.Second
+	defaultKeyPrefix     = "longtask."
+	indexKey             = "index"
+)
+
+var (
+	CleanInterval = time.Hour
+	MaxAge        = time.Hour * 24
+
+	ErrQueueFull    = errors.New("task queue full")
+	ErrTaskNotFound = errors.New("task not found")
+	ErrTaskFinished = errors.New("task finished")
+
+	defaultManager     *TaskManager
+	defaultManagerOnce sync.Once
+)
+
+// A TaskManager runs tasks with Workers goroutines, queueing up to QueueSize tasks. Finished
+// tasks are kept for MaxAge. If KV is set, task metadata and output are saved under KeyPrefix
+// on state changes and every SaveInterval while running, and loaded on initialization; tasks
+// unfinished at restart are marked failed.
+type TaskManager struct {
+	sync.RWMutex
+	Workers       int
+	QueueSize     int
+	MaxOutputSize int
+	MaxAge        time.Duration
+	CleanInterval time.Duration
+	KV            kv.KV
+	KeyPrefix     string
+	SaveInterval  time.Duration
+	tasks         map[string]*Task
+	queue         chan *Task
+	lastID        int64
+}
+
+// A taskRecord is a task saved in KV
+type taskRecord struct {
+	TaskInfo
+	Output     []byte `json:"output"`
+	OutputBase int64  `json:"outputBase"`
+}
+
+// DefaultManager returns the manager used by handlers without Manager
+func DefaultManager() *TaskManager {
+	defaultManagerOnce.Do(func() {
+		defaultManager = new(TaskManager)
+		if err := defaultManager.Initialize(); err != nil {
+			logging.Error("Initialize default long task manager fail: %s", err.Error())
+		}
+	})
+	return defaultManager
+}
+
+func (manager *TaskManager) Initialize() error {
+	if manager.Workers == 0 {
+		manager.Workers = defaultWorkers
+	}
+	if manager.QueueSize == 0 {
+		manager.QueueSize = defaultQueueSize
+	}
+	if manager.MaxOutputSize == 0 {
+		manager.MaxOutputSize = defaultMaxOutputSize
+	}
+	if manager.MaxAge == 0 {
+		manager.MaxAge = MaxAge
+	}
+	if manager.CleanInterval == 0 {
+		manager.CleanInterval = CleanInterval
+	}
+	if manager.KeyPrefix == "" {
+		manager.KeyPrefix = defaultKeyPrefix
+	}
+	if manager.SaveInterval == 0 {
+		manager.SaveInterval = defaultSaveInterval
+	}
+	manager.tasks = make(map[string]*Task)
+	manager.queue = make(chan *Task, manager.QueueSize)
+	if manager.KV != nil {
+		if err := manager.load(); err != nil {
+			return fmt.Errorf("load tasks fail: %s", err.Error())
+		}
+		go manager.saveLoop()
+	}
+	for i := 0; i < manager.Workers; i++ {
+		go manager.work()
+	}
+	go manager.cleanLoop()
+	return nil
+}
+
+// Submit queues the command, and returns ErrQueueFull if the queue is full
+func (manager *TaskManager) Submit(name, user string, command Command, params map[string]interface{}) (*Task, error) {
+	manager.Lock()
+	task := newTask(manager.nextID(), name, user, command, params, manager.MaxOutputSize)
+	select {
+	case manager.queue <- task:
+	default:
+		manager.Unlock()
+		return nil, ErrQueueFull
+	}
+	manager.tasks[task.ID()] = task
+	manager.Unlock()
+	manager.save(task)
+	manager.saveIndex()
+	return task, nil
+}
+
+// nextID returns a unique and increasing task ID, the lock must be held
+func (manager *TaskManager) nextID() string {
+	id := time.Now().UnixNano()
+	if id <= manager.lastID {
+		id = manager.lastID + 1
+	}
+	manager.lastID = id
+	return strconv.FormatInt(id, 36)
+}
+
+// Get returns the task with id, or nil if not found
+func (manager *TaskManager) Get(id string) *Task {
+	manager.RLock()
+	defer manager.RUnlock()
+	return manager.tasks[id]
+}
+
+// Tasks returns all tasks ordered by creation
+func (manager *TaskManager) Tasks() []*Task {
+	manager.RLock()
+	tasks := make([]*Task, 0, len(manager.tasks))
+	for _, task := range manager.tasks {
+		tasks = append(tasks, task)
+	}
+	manager.RUnlock()
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].info.CreateTime.Before(tasks[j].info.CreateTime)
+	})
+	return tasks
+}
+
+// Cancel cancels a queued or running task
+func (manager *TaskManager) Cancel(id string) error {
+	task := manager.Get(id)
+	if task == nil {
+		return ErrTaskNotFound
+	} else if !task.stop() {
+		return ErrTaskFinished
+	}
+	manager.save(task)
+	return nil
+}
+
+func (manager *TaskManager) work() {
+	for task := range manager.queue {
+		ctx := task.start(context.Background())
+		if ctx == nil {
+			continue
+		}
+		manager.save(task)
+		task.finish(manager.run(ctx, task))
+		manager.save(task)
+		info := task.Info()
+		logging.Info("Long task %s %s %s", info.ID, info.Name, info.Status)
+	}
+}
+
+func (manager *TaskManager) run(ctx context.Context, task *Task) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return task.command.Run(ctx, task, task)
+}
+
+func (manager *TaskManager) cleanLoop() {
+	for {
+		time.Sleep(manager.CleanInterval)
+		expired := make([]string, 0)
+		now := time.Now()
+		manager.Lock()
+		for id, task := range manager.tasks {
+			info := task.Info()
+			if info.Status.Finished() && info.EndTime.Add(manager.MaxAge).Before(now) {
+				delete(manager.tasks, id)
+				expired = append(expired, id)
+			}
+		}
+		manager.Unlock()
+		if len(expired) > 0 && manager.KV != nil {
+			for _, id := range expired {
+				if err := manager.KV.Remove(manager.KeyPrefix + id); err != nil && err != kv.ErrNotFound {
+					logging.Warn("Remove long task %s fail: %s", id, err.Error())
+				}
+			}
+			manager.saveIndex()
+		}
+	}
+}
+
+// saveLoop saves running tasks with new output or progress
+func (manager *TaskManager) saveLoop() {
+	for {
+		time.Sleep(manager.SaveInterval)
+		for _, task := range manager.Tasks() {
+			task.Lock()
+			dirty := task.dirty && task.info.Status == Running
+			task.Unlock()
+			if dirty {
+				manager.save(task)
+			}
+		}
+	}
+}
+
+func (manager *TaskManager) save(task *Task) {
+	if manager.KV == nil {
+		return
+	}
+	task.saving.Lock()
+	defer task.saving.Unlock()
+	task.Lock()
+	record := taskRecord{
+		TaskInfo:   task.info,
+		Output:     task.outputFrom(0),
+		OutputBase: task.outputBase,
+	}
+	task.dirty = false
+	task.Unlock()
+	data, err := json.Marshal(&record)
+	if err == nil {
+		err = manager.KV.Set(manager.KeyPrefix+record.ID, data, manager.MaxAge)
+	}
+	if err != nil {
+		logging.Warn("Save long task %s fail: %s", record.ID, err.Error())
+	}
+}
+
+func (manager *TaskManager) saveIndex() {
+	if manager.KV == nil {
+		return
+	}
+	manager.RLock()
+	ids := make([]string, 0, len(manager.tasks))
+	for id := range manager.tasks {
+		ids = append(ids, id)
+	}
+	manager.RUnlock()
+	data, _ := json.Marshal(ids)
+	if err := manager.KV.Set(manager.KeyPrefix+indexKey, data, 0); err != nil {
+		logging.Warn("Save long task index fail: %s", err.Error())
+	}
+}
+
+func (manager *TaskManager) load() error {
+	data, err := manager.KV.Get(manager.KeyPrefix + indexKey)
+	if err == kv.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = manager.KeyPrefix + id
+	}
+	values, err := manager.KV.GetMulti(keys...)
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		var record taskRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			logging.Warn("Decode long task fail: %s", err.Error())
+			continue
+		}
+		task := newTask(record.ID, record.Name, record.User, nil, nil, manager.MaxOutputSize)
+		task.info = record.TaskInfo
+		task.outputBase = record.OutputBase
+		task.appendOutput(record.Output)
+		if !task.info.Status.Finished() {
+			now := time.Now()
+			task.info.Status = Failed
+			task.info.Error = "interrupted by restart"
+			task.info.EndTime = &now
+			manager.save(task)
+		}
+		manager.tasks[record.ID] = task
+		if id, err := strconv.ParseInt(record.ID, 36, 64); err == nil && id > manager.lastID {
+			manager.lastID = id
+		}
+	}
+	logging.Info("Load %d long tasks", len(manager.tasks))
+	return nil
+}
@@ -0,0 +1,94 @@
+package longtask
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+const (
+	eventStreamType   = "text/event-stream"
+	keepaliveInterval = 15 * time.Second
+)
+
+// streamTask sends server-sent events of the task until it finishes or the client leaves:
+//
+//	event: output  data: {"offset": <offset>, "output": <text>}  id: <next offset>
+//	event: status  data: <task info>, on progress or status changes
+//	event: done    data: <task info>, when the task finished
+//
+// The event id is the offset to continue from, so reconnecting clients resume by Last-Event-ID.
+func streamTask(request *webserver.Request, task *Task, offset int64) {
+	request.ResponseHeader().Set("Cache-Control", "no-cache")
+	request.ResponseHeader().Set("X-Accel-Buffering", "no")
+	writer, err := request.Stream(http.StatusOK, eventStreamType)
+	if err != nil {
+		request.Error("Stream long task %s fail: %s", task.ID(), err.Error())
+		writeError(request, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	events := &eventWriter{writer: writer}
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	var last TaskInfo
+	for events.err == nil {
+		changed := task.waitChange()
+		info := task.Info()
+		if output, outputOffset := task.Output(offset); len(output) > 0 {
+			offset = outputOffset + int64(len(output))
+			events.event("output", strconv.FormatInt(offset, 10), map[string]interface{}{
+				"offset": outputOffset,
+				"output": string(output),
+			})
+		}
+		if info.Status.Finished() {
+			events.event("done", "", info)
+			break
+		} else if info.Status != last.Status || info.Progress != last.Progress || info.Message != last.Message {
+			events.event("status", "", info)
+			last = info
+		}
+		select {
+		case <-changed:
+		case <-keepalive.C:
+			events.comment("keepalive")
+		case <-request.Context().Done():
+			return
+		}
+	}
+	if events.err != nil {
+		request.Debug("Stream long task %s stop: %s", task.ID(), events.err.Error())
+	}
+}
+
+type eventWriter struct {
+	writer io.Writer
+	err    error
+}
+
+func (writer *eventWriter) event(name, id string, data interface{}) {
+	if writer.err != nil {
+		return
+	}
+	content, err := json.Marshal(data)
+	if err != nil {
+		writer.err = err
+		return
+	}
+	if id != "" {
+		_, writer.err = fmt.Fprintf(writer.writer, "event: %s\nid: %s\ndata: %s\n\n", name, id, content)
+	} else {
+		_, writer.err = fmt.Fprintf(writer.writer, "event: %s\ndata: %s\n\n", name, content)
+	}
+}
+
+func (writer *eventWriter) comment(text string) {
+	if writer.err == nil {
+		_, writer.err = fmt.Fprintf(writer.writer, ": %s\n\n", text)
+	}
+}
@@ -0,0 +1,243 @@
+package longtask
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+type TaskStatus string
+
+const (
+	Queued    TaskStatus = "queued"
+	Running   TaskStatus = "running"
+	Succeeded TaskStatus = "succeeded"
+	Failed    TaskStatus = "failed"
+	Canceled  TaskStatus = "canceled"
+)
+
+// Finished reports whether the status is final
+func (status TaskStatus) Finished() bool {
+	return status == Succeeded || status == Failed || status == Canceled
+}
+
+// A Command runs a long task. It should return soon after ctx is done, and may report progress
+// with task.SetProgress. The request is not available, the params of the request are copied to
+// task.Params() instead.
+type Command interface {
+	Run(ctx context.Context, task *Task, output io.Writer) error
+}
+
+// A TaskInfo is the metadata of a task
+type TaskInfo struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	User       string     `json:"user,omitempty"`
+	Status     TaskStatus `json:"status"`
+	Progress   float64    `json:"progress"`
+	Message    string     `json:"message,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreateTime time.Time  `json:"createTime"`
+	BeginTime  *time.Time `json:"beginTime,omitempty"`
+	EndTime    *time.Time `json:"endTime,omitempty"`
+	OutputSize int64      `json:"outputSize"`
+}
+
+// A Task is a command submitted to a TaskManager. Output is kept up to MaxOutputSize of the
+// manager, dropping the beginning, while offsets keep counting from the first byte written.
+type Task struct {
+	sync.Mutex
+	info     TaskInfo
+	params   map[string]interface{}
+	command  Command
+	cancel   context.CancelFunc
+	canceled bool
+	// output is a ring buffer of maxOutput bytes starting at outputHead once full, and the
+	// offset of its first byte is outputBase
+	output     []byte
+	outputHead int
+	outputBase int64
+	maxOutput  int
+	dirty      bool
+	changed    chan struct{}
+	// saving serializes saves, so that older snapshots never overwrite newer ones
+	saving sync.Mutex
+}
+
+func newTask(id, name, user string, command Command, params map[string]interface{}, maxOutput int) *Task {
+	return &Task{
+		info: TaskInfo{
+			ID:         id,
+			Name:       name,
+			User:       user,
+			Status:     Queued,
+			CreateTime: time.Now(),
+		},
+		params:    params,
+		command:   command,
+		maxOutput: maxOutput,
+		changed:   make(chan struct{}),
+	}
+}
+
+// ID returns the task ID
+func (task *Task) ID() string {
+	return task.info.ID
+}
+
+// Params returns the params of the request submitting the task
+func (task *Task) Params() map[string]interface{} {
+	return task.params
+}
+
+// Info returns a copy of the task metadata
+func (task *Task) Info() TaskInfo {
+	task.Lock()
+	defer task.Unlock()
+	return task.info
+}
+
+// SetProgress reports progress between 0 and 1 of the running task, with an optional message
+func (task *Task) SetProgress(progress float64, message string) {
+	task.Lock()
+	defer task.Unlock()
+	task.info.Progress = progress
+	task.info.Message = message
+	task.notify()
+}
+
+// Output returns the output from offset, and the offset of the returned data which is greater
+// than offset if the output before was dropped. The data is empty if offset is beyond the end.
+func (task *Task) Output(offset int64) ([]byte, int64) {
+	task.Lock()
+	defer task.Unlock()
+	if offset < task.outputBase {
+		offset = task.outputBase
+	}
+	end := task.outputBase + int64(len(task.output))
+	if offset >= end {
+		return nil, end
+	}
+	return task.outputFrom(int(offset - task.outputBase)), offset
+}
+
+// outputFrom returns a copy of the kept output from index i, the lock must be held
+func (task *Task) outputFrom(i int) []byte {
+	data := make([]byte, len(task.output)-i)
+	if len(data) == 0 {
+		return data
+	}
+	n := copy(data, task.output[(task.outputHead+i)%len(task.output):])
+	copy(data[n:], task.output)
+	return data
+}
+
+// Write appends to the task output
+func (task *Task) Write(p []byte) (int, error) {
+	task.Lock()
+	defer task.Unlock()
+	task.appendOutput(p)
+	task.info.OutputSize += int64(len(p))
+	task.notify()
+	return len(p), nil
+}
+
+// appendOutput appends p to the output, overwriting the oldest bytes beyond maxOutput, the lock
+// must be held
+func (task *Task) appendOutput(p []byte) {
+	if task.maxOutput <= 0 {
+		task.output = append(task.output, p...)
+		return
+	}
+	if over := len(p) - task.maxOutput; over >= 0 {
+		task.outputBase += int64(len(task.output) + over)
+		task.output = append(task.output[:0], p[over:]...)
+		task.outputHead = 0
+		return
+	}
+	if free := task.maxOutput - len(task.output); free > 0 {
+		if free > len(p) {
+			free = len(p)
+		}
+		task.output = append(task.output, p[:free]...)
+		p = p[free:]
+	}
+	for len(p) > 0 {
+		n := copy(task.output[task.outputHead:], p)
+		task.outputHead = (task.outputHead + n) % len(task.output)
+		task.outputBase += int64(n)
+		p = p[n:]
+	}
+}
+
+// notify wakes up waiters of changes, the lock must be held
+func (task *Task) notify() {
+	task.dirty = true
+	close(task.changed)
+	task.changed = make(chan struct{})
+}
+
+// start marks the task running and returns its context, or nil if the task was canceled
+func (task *Task) start(parent context.Context) context.Context {
+	task.Lock()
+	defer task.Unlock()
+	if task.info.Status != Queued {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(parent)
+	now := time.Now()
+	task.cancel = cancel
+	task.info.Status = Running
+	task.info.BeginTime = &now
+	task.notify()
+	return ctx
+}
+
+func (task *Task) finish(err error) {
+	task.Lock()
+	defer task.Unlock()
+	now := time.Now()
+	task.info.EndTime = &now
+	switch {
+	case task.canceled:
+		task.info.Status = Canceled
+	case err != nil:
+		task.info.Status = Failed
+		task.info.Error = err.Error()
+	default:
+		task.info.Status = Succeeded
+		task.info.Progress = 1
+	}
+	if task.cancel != nil {
+		task.cancel()
+	}
+	task.notify()
+}
+
+// stop cancels the task, and returns false if the task has finished
+func (task *Task) stop() bool {
+	task.Lock()
+	defer task.Unlock()
+	switch task.info.Status {
+	case Queued:
+		now := time.Now()
+		task.canceled = true
+		task.info.Status = Canceled
+		task.info.EndTime = &now
+		task.notify()
+	case Running:
+		task.canceled = true
+		task.cancel()
+	default:
+		return false
+	}
+	return true
+}
+
+// waitChange returns a channel closed on the next change of the task
+func (task *Task) waitChange() <-chan struct{} {
+	task.Lock()
+	defer task.Unlock()
+	return task.changed
+}
@@ -0,0 +1,252 @@
+package mirror
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/client/coordination"
+	"github.com/yangchenxing/cangshan/logging"
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerMirror", new(Mirror))
+}
+
+const (
+	defaultTimeout     = 5 * time.Second
+	defaultMaxBodySize = 1 << 20
+	defaultQueueSize   = 1024
+	defaultWorkers     = 4
+	defaultScheme      = "http"
+)
+
+var (
+	stats     = expvar.NewMap("webserver.mirror")
+	hopHeader = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+		"Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+)
+
+// A Mirror sends Percent (0 to 100) of requests, matching any of Locations if set, to every
+// shadow upstream in ClusterName of Coordination after the response is sent. Responses of
+// upstreams are discarded, their status and latency are compared with the response of the
+// request in logs and in the expvar map "webserver.mirror" under Name.
+//
+// An upstream address is the node value, or the base name of the node key, with Port appended
+// if set. Requests with body longer than MaxBodySize are not mirrored, and requests are dropped
+// when the queue is full.
+type Mirror struct {
+	Name         string
+	Coordination coordination.Coordination
+	ClusterName  string
+	Port         uint
+	Scheme       string
+	Percent      float64
+	Locations    []*webserver.Location
+	Timeout      time.Duration
+	MaxBodySize  int64
+	QueueSize    int
+	Workers      int
+	client       *http.Client
+	watcher      *coordination.NodeWatcher
+	queue        chan *mirrorRequest
+	stats        *expvar.Map
+	upstreams    []string
+	lock         sync.RWMutex
+}
+
+type mirrorRequest struct {
+	method  string
+	uri     string
+	host    string
+	header  http.Header
+	body    []byte
+	status  int
+	latency time.Duration
+}
+
+func (mirror *Mirror) Initialize() error {
+	if mirror.Coordination == nil {
+		return errors.New("Missing Coordination")
+	} else if mirror.ClusterName == "" {
+		return errors.New("Missing ClusterName")
+	}
+	if mirror.Name == "" {
+		mirror.Name = mirror.ClusterName
+	}
+	if mirror.Scheme == "" {
+		mirror.Scheme = defaultScheme
+	}
+	if mirror.Timeout == 0 {
+		mirror.Timeout = defaultTimeout
+	}
+	if mirror.MaxBodySize == 0 {
+		mirror.MaxBodySize = defaultMaxBodySize
+	}
+	if mirror.QueueSize == 0 {
+		mirror.QueueSize = defaultQueueSize
+	}
+	if mirror.Workers == 0 {
+		mirror.Workers = defaultWorkers
+	}
+	mirror.client = &http.Client{
+		Timeout: mirror.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	mirror.stats = new(expvar.Map).Init()
+	stats.Set(mirror.Name, mirror.stats)
+	watcher, err := coordination.NewNodeWatcher(mirror.Coordination, mirror.ClusterName, mirror.setUpstreams)
+	if err != nil {
+		return fmt.Errorf("discover shadow upstreams fail: %s", err.Error())
+	}
+	mirror.watcher = watcher
+	mirror.queue = make(chan *mirrorRequest, mirror.QueueSize)
+	for i := 0; i < mirror.Workers; i++ {
+		go mirror.work()
+	}
+	return nil
+}
+
+func (mirror *Mirror) setUpstreams(nodes []coordination.Node) {
+	upstreams := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		addr := node.Value
+		if addr == "" {
+			addr = path.Base(node.Key)
+		}
+		if mirror.Port != 0 {
+			addr = fmt.Sprintf("%s:%d", addr, mirror.Port)
+		}
+		upstreams = append(upstreams, addr)
+	}
+	logging.Info("Mirror %s upstreams: %v", mirror.Name, upstreams)
+	mirror.lock.Lock()
+	mirror.upstreams = upstreams
+	mirror.lock.Unlock()
+}
+
+func (mirror *Mirror) Handle(request *webserver.Request) {
+	if rand.Float64()*100 >= mirror.Percent || !mirror.matches(request) {
+		return
+	}
+	if request.ContentLength > mirror.MaxBodySize {
+		mirror.stats.Add("skipped", 1)
+		return
+	}
+	req := &mirrorRequest{
+		method: request.Method,
+		uri:    request.URL.RequestURI(),
+		host:   request.Host,
+		header: cloneHeader(request.Header),
+	}
+	if request.Body != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(request.Body, mirror.MaxBodySize+1))
+		if err != nil {
+			request.Error("read request body fail: %s", err.Error())
+			return
+		}
+		request.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), request.Body))
+		if int64(len(body)) > mirror.MaxBodySize {
+			mirror.stats.Add("skipped", 1)
+			return
+		}
+		req.body = body
+	}
+	start := time.Now()
+	request.OnFinish(func() {
+		req.status = request.Status()
+		req.latency = time.Since(start)
+		select {
+		case mirror.queue <- req:
+		default:
+			mirror.stats.Add("dropped", 1)
+			request.Debug("Mirror %s queue is full", mirror.Name)
+		}
+	})
+}
+
+func (mirror *Mirror) matches(request *webserver.Request) bool {
+	if len(mirror.Locations) == 0 {
+		return true
+	}
+	for _, location := range mirror.Locations {
+		if location.Matches(request) {
+			return true
+		}
+	}
+	return false
+}
+
+func (mirror *Mirror) work() {
+	for req := range mirror.queue {
+		mirror.lock.RLock()
+		upstreams := mirror.upstreams
+		mirror.lock.RUnlock()
+		for _, upstream := range upstreams {
+			mirror.send(upstream, req)
+		}
+	}
+}
+
+func (mirror *Mirror) send(upstream string, req *mirrorRequest) {
+	httpRequest, err := http.NewRequest(req.method, mirror.Scheme+"://"+upstream+req.uri,
+		bytes.NewReader(req.body))
+	if err != nil {
+		logging.Warn("Mirror %s create request fail: %s", mirror.Name, err.Error())
+		return
+	}
+	httpRequest.Header = req.header
+	httpRequest.Host = req.host
+	mirror.stats.Add("requests", 1)
+	start := time.Now()
+	response, err := mirror.client.Do(httpRequest)
+	if err != nil {
+		mirror.stats.Add("errors", 1)
+		logging.Warn("Mirror %s %s %s to %s fail: %s", mirror.Name, req.method, req.uri, upstream,
+			err.Error())
+		return
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	latency := time.Since(start)
+	mirror.stats.Add("primaryLatencyMicros", int64(req.latency/time.Microsecond))
+	mirror.stats.Add("shadowLatencyMicros", int64(latency/time.Microsecond))
+	if response.StatusCode == req.status {
+		mirror.stats.Add("statusMatch", 1)
+		logging.Debug("Mirror %s %s %s to %s: status %d, latency %s/%s", mirror.Name, req.method,
+			req.uri, upstream, req.status, req.latency, latency)
+	} else {
+		mirror.stats.Add("statusMismatch", 1)
+		logging.Info("Mirror %s %s %s to %s: status %d/%d, latency %s/%s", mirror.Name, req.method,
+			req.uri, upstream, req.status, response.StatusCode, req.latency, latency)
+	}
+}
+
+func cloneHeader(header http.Header) http.Header {
+	result := make(http.Header, len(header))
+	for key, values := range header {
+		result[key] = append([]string(nil), values...)
+	}
+	for _, value := range result["Connection"] {
+		for _, key := range strings.Split(value, ",") {
+			result.Del(strings.TrimSpace(key))
+		}
+	}
+	for _, key := range hopHeader {
+		result.Del(key)
+	}
+	return result
+}
@@ -0,0 +1,453 @@
+package paramschema
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerParamSchema", new(ParamSchema))
+}
+
+// Parameter sources
+const (
+	ParamSource  = "param"
+	QuerySource  = "query"
+	HeaderSource = "header"
+	CookieSource = "cookie"
+)
+
+// Parameter types
+const (
+	StringType   = "string"
+	IntType      = "int"
+	FloatType    = "float"
+	BoolType     = "bool"
+	TimeType     = "time"
+	DurationType = "duration"
+)
+
+var (
+	defaultTimeFormats = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02:15:04:05", "20060102150405", "2006-01-02", "20060102"}
+)
+
+// A Param declares a request parameter. Values are read from Source, which is request.Param by
+// default (filled by location captures and WebServerQueryParser), decoded to Type, checked and
+// then stored back to request.Param by Name. Min and Max limit numeric values, or the length of
+// strings. If Multiple is set, the value is a slice and every item is checked.
+type Param struct {
+	Name        string
+	Source      string
+	Type        string
+	Description string
+	Required    bool
+	Multiple    bool
+	Default     interface{}
+	Min         *float64
+	Max         *float64
+	Regex       string
+	Enum        []string
+	Format      string
+	regex       *regexp.Regexp
+	enum        map[string]bool
+}
+
+// A Violation describes why a parameter is rejected
+type Violation struct {
+	Name    string `json:"name"`
+	Source  string `json:"source"`
+	Message string `json:"message"`
+}
+
+// A ParamSchema is a PreProcess handler that validates request parameters of a Location. The
+// request is stopped with status 400 and a standard json result listing every violation if any
+// parameter is invalid. Undeclared parameters are removed from request.Param if Strict is set.
+type ParamSchema struct {
+	Params []*Param
+	Strict bool
+}
+
+// Initialize the ParamSchema module for application
+func (schema *ParamSchema) Initialize() error {
+	for _, param := range schema.Params {
+		if param.Name == "" {
+			return errors.New("Missing param name")
+		}
+		switch param.Source {
+		case "":
+			param.Source = ParamSource
+		case ParamSource, QuerySource, HeaderSource, CookieSource:
+		default:
+			return fmt.Errorf("Unknown source of param %s: %s", param.Name, param.Source)
+		}
+		switch param.Type {
+		case "":
+			param.Type = StringType
+		case StringType, IntType, FloatType, BoolType, TimeType, DurationType:
+		default:
+			return fmt.Errorf("Unknown type of param %s: %s", param.Name, param.Type)
+		}
+		if param.Regex != "" {
+			var err error
+			if param.regex, err = regexp.Compile(param.Regex); err != nil {
+				return fmt.Errorf("Invalid regex of param %s: %s", param.Name, err.Error())
+			}
+		}
+		if len(param.Enum) > 0 {
+			param.enum = make(map[string]bool)
+			for _, value := range param.Enum {
+				param.enum[value] = true
+			}
+		}
+		if param.Default != nil {
+			if _, err := param.decode(param.Default); err != nil {
+				return fmt.Errorf("Invalid default value of param %s: %s", param.Name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func (schema *ParamSchema) Handle(request *webserver.Request) {
+	violations := make([]Violation, 0)
+	values := make(map[string]interface{})
+	for _, param := range schema.Params {
+		raw, found := param.lookup(request)
+		if !found {
+			if param.Required {
+				violations = append(violations, Violation{param.Name, param.Source, "required"})
+				continue
+			} else if param.Default == nil {
+				continue
+			}
+			raw = param.Default
+		}
+		if value, err := param.decode(raw); err != nil {
+			violations = append(violations, Violation{param.Name, param.Source, err.Error()})
+		} else {
+			values[param.Name] = value
+		}
+	}
+	if len(violations) > 0 {
+		request.Info("Reject request with %d invalid parameters", len(violations))
+		webserver.WriteStandardJSONResultWithStatus(request, http.StatusBadRequest, false,
+			"message", "invalid parameters", "errors", violations)
+		request.Stop()
+		return
+	}
+	if schema.Strict {
+		for key := range request.Param {
+			delete(request.Param, key)
+		}
+	}
+	for name, value := range values {
+		request.Param[name] = value
+	}
+}
+
+func (param *Param) lookup(request *webserver.Request) (interface{}, bool) {
+	switch param.Source {
+	case QuerySource:
+		values, found := request.URL.Query()[param.Name]
+		if !found || len(values) == 0 {
+			return nil, false
+		} else if param.Multiple {
+			return values, true
+		}
+		return values[0], true
+	case HeaderSource:
+		values := request.Header[http.CanonicalHeaderKey(param.Name)]
+		if len(values) == 0 {
+			return nil, false
+		} else if param.Multiple {
+			return values, true
+		}
+		return values[0], true
+	case CookieSource:
+		cookie, err := request.Cookie(param.Name)
+		if err != nil {
+			return nil, false
+		}
+		return cookie.Value, true
+	}
+	value, found := request.Param[param.Name]
+	return value, found && value != nil
+}
+
+func (param *Param) decode(raw interface{}) (interface{}, error) {
+	if !param.Multiple {
+		return param.decodeItem(raw)
+	}
+	var items []interface{}
+	switch v := raw.(type) {
+	case string:
+		if v != "" {
+			for _, item := range strings.Split(v, ",") {
+				items = append(items, item)
+			}
+		}
+	case []string:
+		for _, item := range v {
+			items = append(items, item)
+		}
+	case []interface{}:
+		items = v
+	default:
+		return nil, fmt.Errorf("expect list but got %T", raw)
+	}
+	values := reflect.MakeSlice(reflect.SliceOf(param.itemType()), len(items), len(items))
+	for i, item := range items {
+		value, err := param.decodeItem(item)
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %s", i, err.Error())
+		}
+		values.Index(i).Set(reflect.ValueOf(value))
+	}
+	return values.Interface(), nil
+}
+
+func (param *Param) itemType() reflect.Type {
+	switch param.Type {
+	case IntType:
+		return reflect.TypeOf(int64(0))
+	case FloatType:
+		return reflect.TypeOf(float64(0))
+	case BoolType:
+		return reflect.TypeOf(false)
+	case TimeType:
+		return reflect.TypeOf(time.Time{})
+	case DurationType:
+		return reflect.TypeOf(time.Duration(0))
+	}
+	return reflect.TypeOf("")
+}
+
+func (param *Param) decodeItem(raw interface{}) (interface{}, error) {
+	if s, ok := raw.(string); ok {
+		if param.regex != nil && !param.regex.MatchString(s) {
+			return nil, fmt.Errorf("not match pattern %s", param.Regex)
+		}
+		if param.enum != nil && !param.enum[s] {
+			return nil, fmt.Errorf("must be one of %s", strings.Join(param.Enum, ", "))
+		}
+	}
+	switch param.Type {
+	case IntType:
+		value, err := decodeInt(raw)
+		if err != nil {
+			return nil, err
+		}
+		return value, param.checkRange(float64(value), "value")
+	case FloatType:
+		value, err := decodeFloat(raw)
+		if err != nil {
+			return nil, err
+		}
+		return value, param.checkRange(value, "value")
+	case BoolType:
+		switch v := raw.(type) {
+		case bool:
+			return v, nil
+		case string:
+			value, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.New("expect bool")
+			}
+			return value, nil
+		}
+		return nil, fmt.Errorf("expect bool but got %T", raw)
+	case TimeType:
+		return param.decodeTime(raw)
+	case DurationType:
+		s, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("expect duration but got %T", raw)
+		}
+		value, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, errors.New("expect duration")
+		}
+		return value, param.checkRange(value.Seconds(), "seconds")
+	}
+	s, ok := raw.(string)
+	if !ok {
+		return nil, fmt.Errorf("expect string but got %T", raw)
+	}
+	return s, param.checkRange(float64(len([]rune(s))), "length")
+}
+
+func (param *Param) decodeTime(raw interface{}) (interface{}, error) {
+	switch v := raw.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		if param.Format != "" {
+			value, err := time.ParseInLocation(param.Format, v, time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("expect time in format %s", param.Format)
+			}
+			return value, nil
+		}
+		for _, format := range defaultTimeFormats {
+			if value, err := time.ParseInLocation(format, v, time.Local); err == nil {
+				return value, nil
+			}
+		}
+		return nil, errors.New("expect time")
+	}
+	return nil, fmt.Errorf("expect time but got %T", raw)
+}
+
+func (param *Param) checkRange(value float64, what string) error {
+	if param.Min != nil && value < *param.Min {
+		return fmt.Errorf("%s must not be less than %v", what, *param.Min)
+	}
+	if param.Max != nil && value > *param.Max {
+		return fmt.Errorf("%s must not be greater than %v", what, *param.Max)
+	}
+	return nil
+}
+
+func decodeInt(raw interface{}) (int64, error) {
+	switch v := raw.(type) {
+	case int, int8, int16, int32, int64:
+		return reflect.ValueOf(raw).Int(), nil
+	case uint, uint8, uint16, uint32, uint64:
+		return int64(reflect.ValueOf(raw).Uint()), nil
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, errors.New("expect integer")
+		}
+		return int64(v), nil
+	case string:
+		value, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, errors.New("expect integer")
+		}
+		return value, nil
+	}
+	return 0, fmt.Errorf("expect integer but got %T", raw)
+}
+
+func decodeFloat(raw interface{}) (float64, error) {
+	switch v := raw.(type) {
+	case int, int8, int16, int32, int64:
+		return float64(reflect.ValueOf(raw).Int()), nil
+	case uint, uint8, uint16, uint32, uint64:
+		return float64(reflect.ValueOf(raw).Uint()), nil
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		value, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, errors.New("expect number")
+		}
+		return value, nil
+	}
+	return 0, fmt.Errorf("expect number but got %T", raw)
+}
+
+// DescribeAPI adds declared parameters to the OpenAPI operation. Parameters from request.Param
+// are documented as path parameters if captured by the location, as query parameters of GET,
+// HEAD and DELETE requests, or as request body properties otherwise.
+func (schema *ParamSchema) DescribeAPI(op *webserver.APIOperation) {
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+	for _, param := range schema.Params {
+		in := param.Source
+		if in == ParamSource {
+			switch {
+			case op.HasPathParameter(param.Name):
+				in = "path"
+			case op.Method == "GET" || op.Method == "HEAD" || op.Method == "DELETE":
+				in = QuerySource
+			}
+		}
+		if in != ParamSource {
+			op.AddParameter(param.Name, in, param.Required, param.apiSchema(), param.Description)
+			continue
+		}
+		property := param.apiSchema()
+		if param.Description != "" {
+			property["description"] = param.Description
+		}
+		properties[param.Name] = property
+		if param.Required {
+			required = append(required, param.Name)
+		}
+	}
+	if len(properties) == 0 {
+		return
+	}
+	body := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		body["required"] = required
+	}
+	op.RequestBody = map[string]interface{}{
+		"required": len(required) > 0,
+		"content": map[string]interface{}{
+			"application/json":                  map[string]interface{}{"schema": body},
+			"application/x-www-form-urlencoded": map[string]interface{}{"schema": body},
+		},
+	}
+}
+
+func (param *Param) apiSchema() map[string]interface{} {
+	item := make(map[string]interface{})
+	switch param.Type {
+	case IntType:
+		item["type"] = "integer"
+		item["format"] = "int64"
+	case FloatType:
+		item["type"] = "number"
+	case BoolType:
+		item["type"] = "boolean"
+	case TimeType:
+		item["type"] = "string"
+		if param.Format == "" {
+			item["format"] = "date-time"
+		}
+	default:
+		item["type"] = "string"
+	}
+	if param.Type == IntType || param.Type == FloatType {
+		if param.Min != nil {
+			item["minimum"] = *param.Min
+		}
+		if param.Max != nil {
+			item["maximum"] = *param.Max
+		}
+	} else if param.Type == StringType {
+		if param.Min != nil {
+			item["minLength"] = int(*param.Min)
+		}
+		if param.Max != nil {
+			item["maxLength"] = int(*param.Max)
+		}
+	}
+	if param.Regex != "" {
+		item["pattern"] = param.Regex
+	}
+	if len(param.Enum) > 0 {
+		item["enum"] = param.Enum
+	}
+	if param.Default != nil {
+		item["default"] = param.Default
+	}
+	if param.Multiple {
+		return map[string]interface{}{"type": "array", "items": item}
+	}
+	return item
+}
@@ -0,0 +1,118 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerPolicyAuth", new(PolicyAuth))
+	application.RegisterModulePrototype("WebServerSimpleRESTPolicyTrigger", new(PolicyTrigger))
+}
+
+// A PolicyAuth checks a permission of the request in a Location. The permission is looked up
+// by request method in MethodPermissions, falling back to Permission. Requests without session
+// stop with 401 and denied requests with 403.
+type PolicyAuth struct {
+	Policy            *Policy
+	Permission        string
+	MethodPermissions map[string]string
+}
+
+func (auth *PolicyAuth) Initialize() error {
+	if auth.Policy == nil {
+		return errors.New("Missing Policy")
+	}
+	if auth.Permission == "" && len(auth.MethodPermissions) == 0 {
+		return errors.New("Missing Permission")
+	}
+	return nil
+}
+
+func (auth *PolicyAuth) Handle(request *webserver.Request) {
+	permission, found := auth.MethodPermissions[request.Method]
+	if !found {
+		permission = auth.Permission
+	}
+	if permission == "" {
+		request.Info("Deny %s %s: method not permitted", request.Method, request.URL.Path)
+		request.WriteAndStop(http.StatusForbidden, nil, "")
+		return
+	}
+	decision := auth.Policy.Check(permission, request, nil)
+	if decision.Allowed {
+		request.Debug("Allow %s: %s", permission, decision.Reason)
+		return
+	}
+	request.Info("Deny %s: %s", permission, decision.Reason)
+	if auth.Policy.RequestRoles(request) == nil {
+		request.WriteAndStop(http.StatusUnauthorized, nil, "")
+	} else {
+		request.WriteAndStop(http.StatusForbidden, nil, "")
+	}
+}
+
+// A DeniedError is returned by PolicyTrigger if the entity is not permitted
+type DeniedError struct {
+	Permission string
+	Reason     string
+}
+
+func (err *DeniedError) Error() string {
+	return fmt.Sprintf("permission %s denied: %s", err.Permission, err.Reason)
+}
+
+// Status makes simplerest respond 403 for denied triggers
+func (err *DeniedError) Status() int {
+	return http.StatusForbidden
+}
+
+// A PolicyTrigger is a simplerest trigger checking row level permissions. Conditions with
+// source "entity" are evaluated against the created entity on create, and against the stored
+// entity on update and delete. Updates must also pass with the changes applied, so that entities
+// cannot be taken over by changing the checked fields.
+type PolicyTrigger struct {
+	Policy     *Policy
+	Permission string
+}
+
+func (trigger *PolicyTrigger) Initialize() error {
+	if trigger.Policy == nil {
+		return errors.New("Missing Policy")
+	}
+	if trigger.Permission == "" {
+		return errors.New("Missing Permission")
+	}
+	return nil
+}
+
+func (trigger *PolicyTrigger) Handle(table string, oldEntity, newEntity map[string]interface{}, request *webserver.Request) error {
+	var entities []map[string]interface{}
+	switch {
+	case oldEntity == nil:
+		entities = append(entities, newEntity)
+	case newEntity == nil:
+		entities = append(entities, oldEntity)
+	default:
+		updated := make(map[string]interface{}, len(oldEntity)+len(newEntity))
+		for key, value := range oldEntity {
+			updated[key] = value
+		}
+		for key, value := range newEntity {
+			updated[key] = value
+		}
+		entities = append(entities, oldEntity, updated)
+	}
+	for _, entity := range entities {
+		decision := trigger.Policy.Check(trigger.Permission, request, entity)
+		if !decision.Allowed {
+			request.Info("Deny %s on %s: %s", trigger.Permission, table, decision.Reason)
+			return &DeniedError{Permission: trigger.Permission, Reason: decision.Reason}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/webserver"
+	"github.com/yangchenxing/cangshan/webserver/handlers/roleauth"
+	"github.com/yangchenxing/cangshan/webserver/handlers/session"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerPolicy", new(Policy))
+}
+
+const (
+	AllowEffect = "allow"
+	DenyEffect  = "deny"
+)
+
+// A Role grants permissions to its members and the members of roles inheriting it
+type Role struct {
+	Name        string
+	Inherits    []string
+	Permissions []string
+}
+
+// A Rule allows or denies permissions to roles if all conditions are met. Rules without roles
+// apply to everyone, including requests without session.
+type Rule struct {
+	Effect      string
+	Roles       []string
+	Permissions []string
+	Conditions  []Condition
+	Reason      string
+}
+
+// A Condition compares a value of Source (param, attr, session or entity) to Value, or to the
+// value of ValueSource if set. Operator is one of eq, ne, in, notin, exists and missing.
+type Condition struct {
+	Source      string
+	Key         string
+	Operator    string
+	Value       interface{}
+	ValueSource string
+	ValueKey    string
+}
+
+// A Decision is the result of a policy check
+type Decision struct {
+	Allowed bool
+	Reason  string
+}
+
+// A Policy implements role based access control. Permissions are strings like "article:read",
+// granted by roles or rules, where "*" and "article:*" match any and any article permission.
+// A permission is allowed if a role of the request grants it or an allow rule matches, and no
+// deny rule matches. Roles are read from the request or the session like RoleAuth does.
+type Policy struct {
+	Roles      []Role
+	Rules      []Rule
+	SessionKey string
+	RoleKey    string
+	roles      map[string]*Role
+}
+
+func (policy *Policy) Initialize() error {
+	if policy.SessionKey == "" {
+		policy.SessionKey = session.DefaultSessionAttrKey
+	}
+	if policy.RoleKey == "" {
+		policy.RoleKey = roleauth.DefaultRoleKey
+	}
+	policy.roles = make(map[string]*Role)
+	for i := range policy.Roles {
+		role := &policy.Roles[i]
+		if role.Name == "" {
+			return errors.New("Missing role name")
+		}
+		policy.roles[role.Name] = role
+	}
+	for _, role := range policy.Roles {
+		for _, parent := range role.Inherits {
+			if policy.roles[parent] == nil {
+				return fmt.Errorf("Unknown role %s inherited by %s", parent, role.Name)
+			}
+		}
+	}
+	for i, rule := range policy.Rules {
+		if rule.Effect != AllowEffect && rule.Effect != DenyEffect {
+			return fmt.Errorf("Unknown effect of rule %d: %s", i, rule.Effect)
+		}
+		for _, cond := range rule.Conditions {
+			if err := cond.validate(); err != nil {
+				return fmt.Errorf("Bad condition of rule %d: %s", i, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// RequestRoles returns the roles of the request attribute roleauth.RolesAttrKey if set, or in
+// the session of the request, nil if there are neither
+func (policy *Policy) RequestRoles(request *webserver.Request) []string {
+	if roles, ok := request.Attr[roleauth.RolesAttrKey].([]string); ok && roles != nil {
+		return roles
+	}
+	sess, ok := request.Attr[policy.SessionKey].(map[string]interface{})
+	if !ok || sess == nil {
+		return nil
+	}
+	switch roles := sess[policy.RoleKey].(type) {
+	case []string:
+		return roles
+	case []interface{}:
+		result := make([]string, 0, len(roles))
+		for _, role := range roles {
+			if s, ok := role.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	case string:
+		return []string{roles}
+	}
+	return []string{}
+}
+
+// expandRoles returns the roles and all roles inherited by them
+func (policy *Policy) expandRoles(roles []string) map[string]bool {
+	expanded := make(map[string]bool)
+	var expand func(name string)
+	expand = func(name string) {
+		if expanded[name] {
+			return
+		}
+		expanded[name] = true
+		if role := policy.roles[name]; role != nil {
+			for _, parent := range role.Inherits {
+				expand(parent)
+			}
+		}
+	}
+	for _, role := range roles {
+		expand(role)
+	}
+	return expanded
+}
+
+// Check decides whether the request has the permission. entity is the row being accessed for
+// conditions on entity, and may be nil.
+func (policy *Policy) Check(permission string, request *webserver.Request, entity map[string]interface{}) Decision {
+	roles := policy.expandRoles(policy.RequestRoles(request))
+	decision := Decision{Reason: fmt.Sprintf("no role or rule grants %s", permission)}
+	for name := range roles {
+		if role := policy.roles[name]; role != nil && matchPermissions(role.Permissions, permission) {
+			decision = Decision{Allowed: true, Reason: "granted by role " + name}
+			break
+		}
+	}
+	for i, rule := range policy.Rules {
+		if !matchPermissions(rule.Permissions, permission) || !rule.matchRoles(roles) {
+			continue
+		}
+		if rule.Effect == AllowEffect && decision.Allowed {
+			continue
+		}
+		if !policy.matchConditions(&rule, request, entity) {
+			continue
+		}
+		if rule.Effect == DenyEffect {
+			reason := rule.Reason
+			if reason == "" {
+				reason = fmt.Sprintf("denied by rule %d", i)
+			}
+			return Decision{Reason: reason}
+		}
+		decision = Decision{Allowed: true, Reason: fmt.Sprintf("allowed by rule %d", i)}
+	}
+	return decision
+}
+
+func (rule *Rule) matchRoles(roles map[string]bool) bool {
+	if len(rule.Roles) == 0 {
+		return true
+	}
+	for _, role := range rule.Roles {
+		if roles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *Policy) matchConditions(rule *Rule, request *webserver.Request, entity map[string]interface{}) bool {
+	for _, cond := range rule.Conditions {
+		if !policy.matchCondition(&cond, request, entity) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchPermissions(patterns []string, permission string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == permission {
+			return true
+		} else if strings.HasSuffix(pattern, ":*") && strings.HasPrefix(permission, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cond *Condition) validate() error {
+	switch cond.Operator {
+	case "eq", "ne", "in", "notin", "exists", "missing":
+	default:
+		return fmt.Errorf("unknown operator: %s", cond.Operator)
+	}
+	if cond.Source == "" {
+		return errors.New("missing source")
+	}
+	for _, source := range []string{cond.Source, cond.ValueSource} {
+		switch source {
+		case "", "param", "attr", "session", "entity":
+		default:
+			return fmt.Errorf("unknown source: %s", source)
+		}
+	}
+	return nil
+}
+
+func (policy *Policy) matchCondition(cond *Condition, request *webserver.Request, entity map[string]interface{}) bool {
+	value, found := policy.lookup(cond.Source, cond.Key, request, entity)
+	switch cond.Operator {
+	case "exists":
+		return found
+	case "missing":
+		return !found
+	}
+	if !found {
+		return false
+	}
+	expected := cond.Value
+	if cond.ValueSource != "" {
+		if expected, found = policy.lookup(cond.ValueSource, cond.ValueKey, request, entity); !found {
+			return false
+		}
+	}
+	switch cond.Operator {
+	case "eq":
+		return equal(value, expected)
+	case "ne":
+		return !equal(value, expected)
+	case "in":
+		return contains(expected, value)
+	case "notin":
+		return !contains(expected, value)
+	}
+	return false
+}
+
+func (policy *Policy) lookup(source, key string, request *webserver.Request, entity map[string]interface{}) (interface{}, bool) {
+	var values map[string]interface{}
+	switch source {
+	case "param":
+		values = request.Param
+	case "attr":
+		values = request.Attr
+	case "session":
+		values, _ = request.Attr[policy.SessionKey].(map[string]interface{})
+	case "entity":
+		values = entity
+	}
+	value, found := values[key]
+	return value, found && value != nil
+}
+
+// equal compares values by their text, as params are strings while entities are typed
+func equal(a, b interface{}) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func contains(list, value interface{}) bool {
+	switch items := list.(type) {
+	case []interface{}:
+		for _, item := range items {
+			if equal(item, value) {
+				return true
+			}
+		}
+	case []string:
+		for _, item := range items {
+			if equal(item, value) {
+				return true
+			}
+		}
+	default:
+		return equal(list, value)
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package policy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yangchenxing/cangshan/webserver"
+	"github.com/yangchenxing/cangshan/webserver/handlers/roleauth"
+	"github.com/yangchenxing/cangshan/webserver/handlers/session"
+)
+
+func newTestPolicy(t *testing.T) *Policy {
+	policy := &Policy{
+		Roles: []Role{
+			{Name: "reader", Permissions: []string{"article:read"}},
+			{Name: "editor", Inherits: []string{"reader"}, Permissions: []string{"article:update"}},
+			{Name: "admin", Permissions: []string{"*"}},
+		},
+		Rules: []Rule{
+			{Effect: AllowEffect, Permissions: []string{"article:read"},
+				Conditions: []Condition{{Source: "entity", Key: "public", Operator: "eq", Value: true}}},
+			{Effect: AllowEffect, Roles: []string{"author"}, Permissions: []string{"article:*"},
+				Conditions: []Condition{{Source: "entity", Key: "author", Operator: "eq",
+					ValueSource: "session", ValueKey: "user"}}},
+			{Effect: DenyEffect, Permissions: []string{"article:update", "article:delete"},
+				Conditions: []Condition{{Source: "entity", Key: "status", Operator: "in",
+					Value: []interface{}{"locked", "archived"}}}, Reason: "article locked"},
+			{Effect: DenyEffect, Roles: []string{"reader"}, Permissions: []string{"*"},
+				Conditions: []Condition{{Source: "param", Key: "debug", Operator: "exists"}}},
+		},
+	}
+	if err := policy.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func newTestRequest(sess map[string]interface{}, param map[string]interface{}) *webserver.Request {
+	request := &webserver.Request{
+		Request: httptest.NewRequest("GET", "/", nil),
+		Attr:    make(map[string]interface{}),
+		Param:   make(map[string]interface{}),
+	}
+	if sess != nil {
+		request.Attr[session.DefaultSessionAttrKey] = sess
+	}
+	for key, value := range param {
+		request.Param[key] = value
+	}
+	return request
+}
+
+func TestCheck(t *testing.T) {
+	policy := newTestPolicy(t)
+	tests := []struct {
+		name       string
+		session    map[string]interface{}
+		param      map[string]interface{}
+		permission string
+		entity     map[string]interface{}
+		allowed    bool
+	}{
+		{"no session", nil, nil, "article:read", nil, false},
+		{"public entity without session", nil, nil, "article:read",
+			map[string]interface{}{"public": true}, true},
+		{"private entity without session", nil, nil, "article:read",
+			map[string]interface{}{"public": false}, false},
+		{"role permission", map[string]interface{}{"role": []string{"reader"}}, nil, "article:read", nil, true},
+		{"role without permission", map[string]interface{}{"role": []string{"reader"}}, nil, "article:update", nil, false},
+		{"inherited permission", map[string]interface{}{"role": []interface{}{"editor"}}, nil, "article:read", nil, true},
+		{"string role", map[string]interface{}{"role": "editor"}, nil, "article:update", nil, true},
+		{"wildcard", map[string]interface{}{"role": []string{"admin"}}, nil, "user:delete", nil, true},
+		{"deny rule", map[string]interface{}{"role": []string{"admin"}}, nil, "article:update",
+			map[string]interface{}{"status": "locked"}, false},
+		{"deny rule not matched", map[string]interface{}{"role": []string{"admin"}}, nil, "article:update",
+			map[string]interface{}{"status": "draft"}, true},
+		{"deny rule of inherited role", map[string]interface{}{"role": []string{"editor"}},
+			map[string]interface{}{"debug": "1"}, "article:read", nil, false},
+		{"owner", map[string]interface{}{"role": []string{"author"}, "user": 7}, nil, "article:delete",
+			map[string]interface{}{"author": int64(7)}, true},
+		{"not owner", map[string]interface{}{"role": []string{"author"}, "user": 7}, nil, "article:delete",
+			map[string]interface{}{"author": int64(8)}, false},
+		{"owner without user", map[string]interface{}{"role": []string{"author"}}, nil, "article:delete",
+			map[string]interface{}{"author": nil}, false},
+		{"prefix is not wildcard", map[string]interface{}{"role": []string{"author"}, "user": 7}, nil, "articles:read",
+			map[string]interface{}{"author": 7}, false},
+	}
+	for _, test := range tests {
+		decision := policy.Check(test.permission, newTestRequest(test.session, test.param), test.entity)
+		if decision.Allowed != test.allowed {
+			t.Errorf("%s: unexpected decision: %+v", test.name, decision)
+		}
+	}
+}
+
+func TestRequestRoles(t *testing.T) {
+	policy := newTestPolicy(t)
+	request := newTestRequest(map[string]interface{}{"role": []string{"admin"}}, nil)
+	request.Attr[roleauth.RolesAttrKey] = []string{"reader"}
+	if decision := policy.Check("article:update", request, nil); decision.Allowed {
+		t.Errorf("session roles used instead of request roles: %+v", decision)
+	}
+}
+
+func TestPolicyTrigger(t *testing.T) {
+	trigger := &PolicyTrigger{Policy: newTestPolicy(t), Permission: "article:update"}
+	if err := trigger.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	sess := map[string]interface{}{"role": []string{"author"}, "user": 7}
+	tests := []struct {
+		name      string
+		oldEntity map[string]interface{}
+		newEntity map[string]interface{}
+		allowed   bool
+	}{
+		{"create own", nil, map[string]interface{}{"author": 7}, true},
+		{"create for other", nil, map[string]interface{}{"author": 8}, false},
+		{"update own", map[string]interface{}{"author": 7}, map[string]interface{}{"title": "x"}, true},
+		{"update other", map[string]interface{}{"author": 8}, map[string]interface{}{"title": "x"}, false},
+		{"give away", map[string]interface{}{"author": 7}, map[string]interface{}{"author": 8}, false},
+		{"take over", map[string]interface{}{"author": 8}, map[string]interface{}{"author": 7}, false},
+		{"lock", map[string]interface{}{"author": 7}, map[string]interface{}{"status": "locked"}, false},
+	}
+	for _, test := range tests {
+		err := trigger.Handle("articles", test.oldEntity, test.newEntity, newTestRequest(sess, nil))
+		if test.allowed && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+		} else if !test.allowed {
+			if _, ok := err.(*DeniedError); !ok {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+		}
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *Policy
+	}{
+		{"unknown inherited role", &Policy{Roles: []Role{{Name: "a", Inherits: []string{"b"}}}}},
+		{"unknown effect", &Policy{Rules: []Rule{{Effect: "maybe"}}}},
+		{"unknown operator", &Policy{Rules: []Rule{{Effect: AllowEffect,
+			Conditions: []Condition{{Source: "param", Key: "a", Operator: "like"}}}}}},
+		{"unknown source", &Policy{Rules: []Rule{{Effect: AllowEffect,
+			Conditions: []Condition{{Source: "header", Key: "a", Operator: "eq"}}}}}},
+	}
+	for _, test := range tests {
+		if err := test.policy.Initialize(); err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
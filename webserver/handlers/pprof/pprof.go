@@ -1,6 +1,7 @@
 package pprof
 
 import (
+	"expvar"
 	"net/http"
 	gopprof "net/http/pprof"
 
@@ -13,6 +14,7 @@ func init() {
 	application.RegisterBuiltinModule("WebServerPProfCmdline", pprofWrapper(gopprof.Cmdline))
 	application.RegisterBuiltinModule("WebServerPProfProfile", pprofWrapper(gopprof.Profile))
 	application.RegisterBuiltinModule("WebServerPProfSymbol", pprofWrapper(gopprof.Symbol))
+	application.RegisterBuiltinModule("WebServerExpvar", pprofWrapper(expvar.Handler().ServeHTTP))
 }
 
 type pprofWrapper func(http.ResponseWriter, *http.Request)
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/crc32"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yangchenxing/cangshan/client/coordination"
+	"github.com/yangchenxing/cangshan/logging"
+)
+
+// Balances of ReverseProxy
+const (
+	RoundRobinBalance       = "roundrobin"
+	LeastConnectionsBalance = "leastconn"
+	ConsistentHashBalance   = "hash"
+)
+
+const hashReplicas = 100
+
+type upstream struct {
+	addr    string
+	active  int64
+	lock    sync.Mutex
+	fails   int
+	ejected time.Time
+}
+
+func (u *upstream) healthy(now time.Time) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return !now.Before(u.ejected)
+}
+
+// report records the result of a proxied request, and ejects the upstream for ejectDuration
+// after maxFails consecutive failures
+func (u *upstream) report(success bool, maxFails int, ejectDuration time.Duration) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if success {
+		u.fails = 0
+		return
+	}
+	u.fails++
+	if u.fails >= maxFails {
+		u.fails = 0
+		u.ejected = time.Now().Add(ejectDuration)
+		logging.Warn("Eject upstream %s for %s", u.addr, ejectDuration)
+	}
+}
+
+type ringPoint struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// A pool keeps the upstreams of a proxy and chooses one for each attempt
+type pool struct {
+	sync.RWMutex
+	balance   string
+	port      uint
+	upstreams []*upstream
+	ring      []ringPoint
+	next      uint64
+}
+
+func (p *pool) setNodes(nodes []coordination.Node) {
+	p.Lock()
+	defer p.Unlock()
+	existing := make(map[string]*upstream, len(p.upstreams))
+	for _, u := range p.upstreams {
+		existing[u.addr] = u
+	}
+	upstreams := make([]*upstream, 0, len(nodes))
+	addrs := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		addr := node.Value
+		if addr == "" {
+			addr = path.Base(node.Key)
+		}
+		if p.port != 0 {
+			addr = fmt.Sprintf("%s:%d", addr, p.port)
+		}
+		u := existing[addr]
+		if u == nil {
+			u = &upstream{addr: addr}
+		}
+		upstreams = append(upstreams, u)
+		addrs = append(addrs, addr)
+	}
+	p.upstreams = upstreams
+	if p.balance == ConsistentHashBalance {
+		p.ring = make([]ringPoint, 0, len(upstreams)*hashReplicas)
+		for _, u := range upstreams {
+			for i := 0; i < hashReplicas; i++ {
+				p.ring = append(p.ring, ringPoint{crc32.ChecksumIEEE([]byte(u.addr + "#" + strconv.Itoa(i))), u})
+			}
+		}
+		sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	}
+	logging.Info("Reverse proxy upstreams: %v", addrs)
+}
+
+// choose returns an upstream not tried yet, preferring healthy ones. Ejected upstreams are only
+// chosen when all upstreams are ejected. The key is used by consistent hash balance.
+func (p *pool) choose(key string, tried map[*upstream]bool) *upstream {
+	p.RLock()
+	defer p.RUnlock()
+	now := time.Now()
+	candidates := make(map[*upstream]bool, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if !tried[u] && u.healthy(now) {
+			candidates[u] = true
+		}
+	}
+	if len(candidates) == 0 {
+		for _, u := range p.upstreams {
+			if !tried[u] {
+				candidates[u] = true
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	switch p.balance {
+	case ConsistentHashBalance:
+		hash := crc32.ChecksumIEEE([]byte(key))
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+		for i := 0; i < len(p.ring); i++ {
+			if point := p.ring[(start+i)%len(p.ring)]; candidates[point.upstream] {
+				return point.upstream
+			}
+		}
+		return nil
+	case LeastConnectionsBalance:
+		offset := int(atomic.AddUint64(&p.next, 1) % uint64(len(p.upstreams)))
+		var chosen *upstream
+		for i := range p.upstreams {
+			u := p.upstreams[(offset+i)%len(p.upstreams)]
+			if candidates[u] && (chosen == nil || atomic.LoadInt64(&u.active) < atomic.LoadInt64(&chosen.active)) {
+				chosen = u
+			}
+		}
+		return chosen
+	default:
+		for {
+			u := p.upstreams[atomic.AddUint64(&p.next, 1)%uint64(len(p.upstreams))]
+			if candidates[u] {
+				return u
+			}
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/client/coordination"
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerReverseProxy", new(ReverseProxy))
+}
+
+const (
+	defaultScheme           = "http"
+	defaultConnectTimeout   = 5 * time.Second
+	defaultTimeout          = time.Minute
+	defaultRetries          = 2
+	defaultMaxFails         = 3
+	defaultEjectDuration    = 30 * time.Second
+	defaultMaxRetryBodySize = 1 << 20
+)
+
+var (
+	hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+		"Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+	idempotentMethods = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true, "TRACE": true,
+		"PUT": true, "DELETE": true}
+	// DefaultFailStatus are upstream statuses counted as failures and retried
+	DefaultFailStatus = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+)
+
+// A ReverseProxy proxies requests to the upstreams in ClusterName of Coordination, kept current
+// by watching the cluster. An upstream address is the node value, or the base name of the node
+// key, with Port appended if set.
+//
+// Balance is "roundrobin" (default), "leastconn" or "hash". The hash balance uses a consistent
+// hash of the HashHeader, or the client IP if not set or absent in the request. An upstream is ejected for EjectDuration
+// after MaxFails consecutive failures, which are connection errors and FailStatus responses.
+// Idempotent requests are retried on other upstreams up to Retries times, if their body is not
+// longer than MaxRetryBodySize.
+//
+// StripPrefix is removed from the request path. Values of RequestHeaders and ResponseHeaders
+// are set to the proxied requests and responses, and empty values remove the header. The Host
+// header is kept with PreserveHost.
+type ReverseProxy struct {
+	Coordination     coordination.Coordination
+	ClusterName      string
+	Port             uint
+	Scheme           string
+	Balance          string
+	HashHeader       string
+	ConnectTimeout   time.Duration
+	Timeout          time.Duration
+	Retries          int
+	MaxRetryBodySize int64
+	MaxFails         int
+	EjectDuration    time.Duration
+	FailStatus       []int
+	StripPrefix      string
+	PreserveHost     bool
+	RequestHeaders   map[string]string
+	ResponseHeaders  map[string]string
+	transport        *http.Transport
+	watcher          *coordination.NodeWatcher
+	pool             *pool
+	failStatus       map[int]bool
+}
+
+func (proxy *ReverseProxy) Initialize() error {
+	if proxy.Coordination == nil {
+		return errors.New("Missing Coordination")
+	} else if proxy.ClusterName == "" {
+		return errors.New("Missing ClusterName")
+	}
+	switch proxy.Balance {
+	case "":
+		proxy.Balance = RoundRobinBalance
+	case RoundRobinBalance, LeastConnectionsBalance, ConsistentHashBalance:
+	default:
+		return fmt.Errorf("Unknown Balance: %s", proxy.Balance)
+	}
+	if proxy.Scheme == "" {
+		proxy.Scheme = defaultScheme
+	}
+	if proxy.ConnectTimeout == 0 {
+		proxy.ConnectTimeout = defaultConnectTimeout
+	}
+	if proxy.Timeout == 0 {
+		proxy.Timeout = defaultTimeout
+	}
+	if proxy.Retries == 0 {
+		proxy.Retries = defaultRetries
+	}
+	if proxy.MaxRetryBodySize == 0 {
+		proxy.MaxRetryBodySize = defaultMaxRetryBodySize
+	}
+	if proxy.MaxFails == 0 {
+		proxy.MaxFails = defaultMaxFails
+	}
+	if proxy.EjectDuration == 0 {
+		proxy.EjectDuration = defaultEjectDuration
+	}
+	if proxy.FailStatus == nil {
+		proxy.FailStatus = DefaultFailStatus
+	}
+	proxy.failStatus = make(map[int]bool, len(proxy.FailStatus))
+	for _, status := range proxy.FailStatus {
+		proxy.failStatus[status] = true
+	}
+	proxy.transport = &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: proxy.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		ResponseHeaderTimeout: proxy.Timeout,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	proxy.pool = &pool{balance: proxy.Balance, port: proxy.Port}
+	watcher, err := coordination.NewNodeWatcher(proxy.Coordination, proxy.ClusterName, proxy.pool.setNodes)
+	if err != nil {
+		return fmt.Errorf("discover upstreams fail: %s", err.Error())
+	}
+	proxy.watcher = watcher
+	return nil
+}
+
+func (proxy *ReverseProxy) Handle(request *webserver.Request) {
+	attempts := 1
+	var body []byte
+	if idempotentMethods[request.Method] {
+		attempts += proxy.Retries
+		if request.Body != nil && request.ContentLength != 0 {
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(request.Body, proxy.MaxRetryBodySize+1))
+			if err != nil {
+				request.Error("read request body fail: %s", err.Error())
+				proxy.writeError(request, http.StatusBadRequest, "read request body fail")
+				return
+			}
+			if int64(len(body)) > proxy.MaxRetryBodySize {
+				attempts = 1
+				request.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), request.Body))
+				body = nil
+			}
+		}
+	}
+	key := proxy.hashKey(request)
+	tried := make(map[*upstream]bool, attempts)
+	for attempt := 1; attempt <= attempts; attempt++ {
+		u := proxy.pool.choose(key, tried)
+		if u == nil {
+			break
+		}
+		tried[u] = true
+		var reader io.Reader = request.Body
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		if proxy.proxy(request, u, reader, attempt, attempts) || request.Context().Err() != nil {
+			return
+		}
+	}
+	if len(tried) == 0 {
+		proxy.writeError(request, http.StatusServiceUnavailable, "no upstream available")
+	} else {
+		proxy.writeError(request, http.StatusBadGateway, "upstream unavailable")
+	}
+}
+
+// hashKey returns the HashHeader value of the request for hash balance, falling back to the
+// client IP if the header is not set or empty
+func (proxy *ReverseProxy) hashKey(request *webserver.Request) string {
+	if proxy.HashHeader != "" {
+		if key := request.Header.Get(proxy.HashHeader); key != "" {
+			return key
+		}
+	}
+	return request.GetClientIP().String()
+}
+
+// proxy sends the request to the upstream, and returns whether the response is written. Failed
+// responses are only written by the last attempt.
+func (proxy *ReverseProxy) proxy(request *webserver.Request, u *upstream, body io.Reader,
+	attempt, attempts int) bool {
+	atomic.AddInt64(&u.active, 1)
+	defer atomic.AddInt64(&u.active, -1)
+	response, err := proxy.roundTrip(request, u, body)
+	if err != nil {
+		u.report(false, proxy.MaxFails, proxy.EjectDuration)
+		request.Warn("Proxy to %s fail (%d/%d): %s", u.addr, attempt, attempts, err.Error())
+		return false
+	} else if proxy.failStatus[response.StatusCode] {
+		u.report(false, proxy.MaxFails, proxy.EjectDuration)
+		request.Warn("Proxy to %s fail (%d/%d): status %d", u.addr, attempt, attempts, response.StatusCode)
+		if attempt < attempts {
+			response.Body.Close()
+			return false
+		}
+	} else {
+		u.report(true, proxy.MaxFails, proxy.EjectDuration)
+	}
+	proxy.writeResponse(request, response)
+	return true
+}
+
+func (proxy *ReverseProxy) roundTrip(request *webserver.Request, u *upstream, body io.Reader) (*http.Response, error) {
+	uri := request.URL.RequestURI()
+	if proxy.StripPrefix != "" && strings.HasPrefix(request.URL.Path, proxy.StripPrefix) {
+		uri = "/" + strings.TrimPrefix(strings.TrimPrefix(uri, proxy.StripPrefix), "/")
+	}
+	if request.ContentLength == 0 {
+		body = nil
+	}
+	outRequest, err := http.NewRequest(request.Method, proxy.Scheme+"://"+u.addr+uri, body)
+	if err != nil {
+		return nil, err
+	}
+	outRequest = outRequest.WithContext(request.Context())
+	outRequest.ContentLength = request.ContentLength
+	outRequest.Header = cloneHeader(request.Header)
+	if proxy.PreserveHost {
+		outRequest.Host = request.Host
+	}
+	if clientIP := request.GetClientIP(); clientIP != nil {
+		if prior := outRequest.Header.Get("X-Forwarded-For"); prior != "" {
+			outRequest.Header.Set("X-Forwarded-For", prior+", "+clientIP.String())
+		} else {
+			outRequest.Header.Set("X-Forwarded-For", clientIP.String())
+		}
+	}
+	outRequest.Header.Set("X-Forwarded-Host", request.Host)
+	if request.TLS != nil {
+		outRequest.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		outRequest.Header.Set("X-Forwarded-Proto", "http")
+	}
+	rewriteHeader(outRequest.Header, proxy.RequestHeaders)
+	return proxy.transport.RoundTrip(outRequest)
+}
+
+func (proxy *ReverseProxy) writeResponse(request *webserver.Request, response *http.Response) {
+	defer response.Body.Close()
+	header := request.ResponseHeader()
+	for key, values := range cloneHeader(response.Header) {
+		header[key] = values
+	}
+	rewriteHeader(header, proxy.ResponseHeaders)
+	writer, err := request.Stream(response.StatusCode, "")
+	if err != nil {
+		content, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			request.Error("read upstream response fail: %s", err.Error())
+			proxy.writeError(request, http.StatusBadGateway, "read upstream response fail")
+			return
+		}
+		request.WriteAndStop(response.StatusCode, content, response.Header.Get("Content-Type"))
+		return
+	}
+	request.Stop()
+	if _, err := io.Copy(writer, response.Body); err != nil {
+		request.Warn("Copy upstream response fail: %s", err.Error())
+	}
+}
+
+func (proxy *ReverseProxy) writeError(request *webserver.Request, status int, message string) {
+	webserver.WriteStandardJSONResultWithStatus(request, status, false, "message", message)
+	request.Stop()
+}
+
+func rewriteHeader(header http.Header, values map[string]string) {
+	for key, value := range values {
+		if value == "" {
+			header.Del(key)
+		} else {
+			header.Set(key, value)
+		}
+	}
+}
+
+func cloneHeader(header http.Header) http.Header {
+	result := make(http.Header, len(header))
+	for key, values := range header {
+		result[key] = append([]string(nil), values...)
+	}
+	for _, value := range result["Connection"] {
+		for _, key := range strings.Split(value, ",") {
+			result.Del(strings.TrimSpace(key))
+		}
+	}
+	for _, key := range hopHeaders {
+		result.Del(key)
+	}
+	return result
+}
@@ -0,0 +1,21 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+func TestHashKey(t *testing.T) {
+	proxy := &ReverseProxy{HashHeader: "X-User"}
+	request := &webserver.Request{Request: httptest.NewRequest("GET", "/", nil)}
+	clientKey := (&ReverseProxy{}).hashKey(request)
+	if key := proxy.hashKey(request); key != clientKey {
+		t.Errorf("empty header not falling back to client ip: %q", key)
+	}
+	request.Header.Set("X-User", "alice")
+	if key := proxy.hashKey(request); key != "alice" {
+		t.Errorf("unexpected hash key: %q", key)
+	}
+}
@@ -28,17 +28,13 @@ func (handler *QueryParserHandler) Initialize() error {
 func (handler QueryParserHandler) Handle(request *webserver.Request) {
 	var err error
 	switch request.Method {
-	case "GET":
-		fallthrough
-	case "HEAD":
+	case "GET", "HEAD", "DELETE":
 		for key, values := range request.URL.Query() {
 			if len(values) != 0 {
 				request.Param[key] = values[0]
 			}
 		}
-	case "POST":
-		fallthrough
-	case "PUT":
+	case "POST", "PUT", "PATCH":
 		contentType := request.Header.Get("Content-Type")
 		if contentType != "" {
 			contentType = strings.ToLower(strings.Split(contentType, ";")[0])
@@ -2,8 +2,7 @@ package requestcache
 
 import (
 	"bytes"
-	"container/list"
-	"encoding/json"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
@@ -17,115 +16,254 @@ import (
 
 func init() {
 	application.RegisterModulePrototype("RequestCacheUpdateHandler", new(RequestCacheUpdateHandler))
+	application.RegisterModulePrototype("RequestCacheFetchHandler", new(RequestCacheFetchHandler))
 	application.RegisterBuiltinModule("RequestCacheFetchHandler", new(RequestCacheFetchHandler))
+	application.RegisterModulePrototype("RequestCacheMemoryStore", new(MemoryStore))
 }
 
+const (
+	defaultCapacity    = 16
+	defaultMaxBodySize = 1 << 20
+	defaultFetchCount  = 100
+	maxFetchCount      = 1000
+)
+
 var (
-	cache    = list.New()
-	capacity = 16
-	mutex    sync.Mutex
-	lastID   int64 = 0
+	capacity     = defaultCapacity
+	defaultStore *MemoryStore
+	defaultOnce  sync.Once
+	// DefaultRedactHeaders are request headers not captured unless RedactHeaders is set
+	DefaultRedactHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+	// DefaultRedactResponseHeaders are response headers not captured unless RedactResponseHeaders
+	// is set
+	DefaultRedactResponseHeaders = []string{"Set-Cookie", "Authorization"}
 )
 
+// SetCacheCapacity sets the capacity of the default store, before it is first used
 func SetCacheCapacity(value int) {
 	if value > 0 {
 		capacity = value
 	}
 }
 
-func add(req *request) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	req.id = time.Now().Unix() * 100000
-	if req.id < lastID {
-		req.id = lastID + 1
-	}
-	lastID = req.id
-	cache.PushBack(req)
-	for cache.Len() > capacity {
-		cache.Remove(cache.Front())
-	}
+// DefaultStore returns the in-memory store used by handlers without Store
+func DefaultStore() *MemoryStore {
+	defaultOnce.Do(func() {
+		defaultStore = &MemoryStore{Capacity: capacity}
+		defaultStore.Initialize()
+	})
+	return defaultStore
 }
 
-func get(next int64, count int) []*request {
-	mutex.Lock()
-	defer mutex.Unlock()
-	result := make([]*request, 0, count)
-	for item := cache.Front(); item != nil; item = item.Next() {
-		req := item.Value.(*request)
-		if req.id > next {
-			result = append(result, req)
-		}
-	}
-	return result
+// A Request is a captured request with its response. Bodies longer than the MaxBodySize of the
+// capture handler are truncated and flagged.
+type Request struct {
+	ID                int64         `json:"id"`
+	Time              time.Time     `json:"time"`
+	Method            string        `json:"method"`
+	URL               string        `json:"url"`
+	Host              string        `json:"host"`
+	Header            http.Header   `json:"header"`
+	Body              []byte        `json:"body,omitempty"`
+	BodyTruncated     bool          `json:"bodyTruncated,omitempty"`
+	Status            int           `json:"status"`
+	ResponseHeader    http.Header   `json:"responseHeader"`
+	ResponseBody      []byte        `json:"responseBody,omitempty"`
+	ResponseTruncated bool          `json:"responseTruncated,omitempty"`
+	Duration          time.Duration `json:"duration"`
 }
 
-type Request struct {
-	ID     int64
-	Method string
-	URL    string
-	Header http.Header
-	Body   []byte
+// A Store keeps captured requests. Add assigns the ID of the request, increasing in the order
+// requests are stored. Fetch returns at most count requests with ID greater than
+// cursor in ID order, and the cursor to fetch the following requests.
+type Store interface {
+	Add(req *Request) error
+	Fetch(cursor int64, count int) ([]*Request, int64, error)
 }
 
-type closableBuffer *bytes.Buffer
+var (
+	idLock sync.Mutex
+	lastID int64
+)
 
-func (buffer closableBuffer) Close() error {
-	return nil
+// nextID returns unique and increasing ids based on time, so that they increase across restarts
+func nextID() int64 {
+	idLock.Lock()
+	defer idLock.Unlock()
+	id := time.Now().UnixNano() / 1000
+	if id <= lastID {
+		id = lastID + 1
+	}
+	lastID = id
+	return id
 }
 
+// A RequestCacheUpdateHandler captures CacheRate of requests with their responses into Store, or
+// the default in-memory store. The capture is added after the response is sent. Headers in
+// RedactHeaders and RedactResponseHeaders are removed, but bodies are stored as they are, so
+// locations responding credentials or secrets in bodies should not be captured.
 type RequestCacheUpdateHandler struct {
-	CacheRate float32
+	CacheRate             float32
+	Store                 Store
+	MaxBodySize           int
+	RedactHeaders         []string
+	RedactResponseHeaders []string
 }
 
 func (handler *RequestCacheUpdateHandler) Initialize() error {
-	if handler.CacheSize == 0 {
-		handler.CacheSize = defaultCacheSize
+	if handler.Store == nil {
+		handler.Store = DefaultStore()
+	}
+	if handler.MaxBodySize == 0 {
+		handler.MaxBodySize = defaultMaxBodySize
+	}
+	if handler.RedactHeaders == nil {
+		handler.RedactHeaders = DefaultRedactHeaders
+	}
+	if handler.RedactResponseHeaders == nil {
+		handler.RedactResponseHeaders = DefaultRedactResponseHeaders
 	}
+	return nil
 }
 
-func (handler RequestCacheUpdateHandler) Handle(request *webserver.Request) {
-	if rand.Float32() > handler.CacheRate {
+func (handler *RequestCacheUpdateHandler) Handle(request *webserver.Request) {
+	if rand.Float32() >= handler.CacheRate {
 		return
 	}
 	req := &Request{
-		Method: request,
-		URL:    request.URL.String(),
-		Header: request.Header,
-		Body:   nil,
+		Time:   time.Now(),
+		Method: request.Method,
+		URL:    request.URL.RequestURI(),
+		Host:   request.Host,
+		Header: redact(request.Header, handler.RedactHeaders),
 	}
 	if request.Body != nil {
-		if body, err := ioutil.ReadAll(request.Body); err != nil {
-			request.Error("read request body fail: %s", err)
-		} else {
-			req.Body = body
-			request.Body = closableBuffer(bytes.NewBuffer(body))
+		body, err := ioutil.ReadAll(io.LimitReader(request.Body, int64(handler.MaxBodySize)+1))
+		if err != nil {
+			request.Error("read request body fail: %s", err.Error())
+			return
 		}
+		request.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), request.Body))
+		req.Body, req.BodyTruncated = handler.truncate(body)
 	}
-	go add(req)
+	request.OnFinish(func() {
+		req.Duration = time.Now().Sub(req.Time)
+		req.Status = request.Status()
+		req.ResponseHeader = redact(request.ResponseHeader(), handler.RedactResponseHeaders)
+		req.ResponseBody, req.ResponseTruncated = handler.truncate(request.Content())
+		if err := handler.Store.Add(req); err != nil {
+			request.Warn("Capture request fail: %s", err.Error())
+		}
+	})
 }
 
-type RequestCacheFetchHandler struct{}
+func redact(header http.Header, keys []string) http.Header {
+	result := cloneHeader(header)
+	for _, key := range keys {
+		result.Del(key)
+	}
+	return result
+}
+
+func (handler *RequestCacheUpdateHandler) truncate(body []byte) ([]byte, bool) {
+	if len(body) > handler.MaxBodySize {
+		return append([]byte(nil), body[:handler.MaxBodySize]...), true
+	}
+	return append([]byte(nil), body...), false
+}
 
-func (handler RequestCacheFetchHandler) Handle(request *webserver.Request) {
+func cloneHeader(header http.Header) http.Header {
+	result := make(http.Header, len(header))
+	for key, values := range header {
+		result[key] = append([]string(nil), values...)
+	}
+	return result
+}
+
+// A RequestCacheFetchHandler responds captured requests of Store, or the default store, after the
+// "cursor" param (or "next" for compatibility), at most "count" requests. The response has the
+// "next" cursor to continue with.
+type RequestCacheFetchHandler struct {
+	Store Store
+}
+
+func (handler *RequestCacheFetchHandler) Handle(request *webserver.Request) {
+	store := handler.Store
+	if store == nil {
+		store = DefaultStore()
+	}
 	query := request.URL.Query()
-	nextID := 0
-	count := capacity
-	if temp := query.Get("next"); temp != "" {
-		if value, err := strconv.Atoi(temp); err != nil {
-			request.Warn("invalid parameter: next")
-		} else {
-			nextID = value
+	var cursor int64
+	count := defaultFetchCount
+	value := query.Get("cursor")
+	if value == "" {
+		value = query.Get("next")
+	}
+	if value != "" {
+		var err error
+		if cursor, err = strconv.ParseInt(value, 10, 64); err != nil {
+			webserver.WriteStandardJSONResultWithStatus(request, http.StatusBadRequest, false,
+				"message", "invalid parameter: cursor")
+			return
 		}
 	}
-	if temp := query.Get("count"); temp != "" {
-		if value, err := strconv.Atoi(temp); err != nil {
-			request.Warn("invalid parameter: count")
-		} else {
-			count = value
+	if value := query.Get("count"); value != "" {
+		var err error
+		if count, err = strconv.Atoi(value); err != nil || count <= 0 {
+			webserver.WriteStandardJSONResultWithStatus(request, http.StatusBadRequest, false,
+				"message", "invalid parameter: count")
+			return
+		}
+	}
+	if count > maxFetchCount {
+		count = maxFetchCount
+	}
+	requests, next, err := store.Fetch(cursor, count)
+	if err != nil {
+		request.Error("Fetch captured requests fail: %s", err.Error())
+		webserver.WriteStandardJSONResultWithStatus(request, http.StatusInternalServerError, false,
+			"message", "fetch fail")
+		return
+	}
+	webserver.WriteStandardJSONResult(request, true, "entities", requests,
+		"next", strconv.FormatInt(next, 10))
+}
+
+// A MemoryStore keeps the latest Capacity requests in memory
+type MemoryStore struct {
+	sync.Mutex
+	Capacity int
+	requests []*Request
+}
+
+func (store *MemoryStore) Initialize() error {
+	if store.Capacity <= 0 {
+		store.Capacity = defaultCapacity
+	}
+	store.requests = make([]*Request, 0, store.Capacity)
+	return nil
+}
+
+func (store *MemoryStore) Add(req *Request) error {
+	store.Lock()
+	defer store.Unlock()
+	req.ID = nextID()
+	if len(store.requests) >= store.Capacity {
+		store.requests = append(store.requests[:0], store.requests[len(store.requests)-store.Capacity+1:]...)
+	}
+	store.requests = append(store.requests, req)
+	return nil
+}
+
+func (store *MemoryStore) Fetch(cursor int64, count int) ([]*Request, int64, error) {
+	store.Lock()
+	defer store.Unlock()
+	result := make([]*Request, 0, count)
+	for _, req := range store.requests {
+		if req.ID > cursor && len(result) < count {
+			result = append(result, req)
+			cursor = req.ID
 		}
 	}
-	result := get(nextID, count)
-	resultContent, _ := json.Marshal(result)
-	request.Write(http.StatusOK, resultContent, "text/json")
+	return result, cursor, nil
 }
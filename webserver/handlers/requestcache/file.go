@@ -0,0 +1,188 @@
+package requestcache
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/logging"
+)
+
+func init() {
+	application.RegisterModulePrototype("RequestCacheFileStore", new(FileStore))
+}
+
+const (
+	defaultMaxFileSize = 64 << 20
+	defaultMaxFiles    = 8
+	captureFilePrefix  = "capture."
+	captureFileSuffix  = ".jsonl"
+	maxCaptureLineSize = 64 << 20
+)
+
+// A FileStore writes captured requests as JSON lines to files in Directory, named by the ID of
+// their first request. A new file is started when the current one exceeds MaxFileSize, and the
+// oldest files are removed to keep at most MaxFiles.
+type FileStore struct {
+	sync.Mutex
+	Directory   string
+	MaxFileSize int64
+	MaxFiles    int
+	file        *os.File
+	size        int64
+}
+
+func (store *FileStore) Initialize() error {
+	if store.Directory == "" {
+		return errors.New("Missing Directory")
+	}
+	if store.MaxFileSize == 0 {
+		store.MaxFileSize = defaultMaxFileSize
+	}
+	if store.MaxFiles == 0 {
+		store.MaxFiles = defaultMaxFiles
+	}
+	if err := os.MkdirAll(store.Directory, 0755); err != nil {
+		return fmt.Errorf("create directory fail: %s", err.Error())
+	}
+	files, err := store.files()
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		path := store.path(files[len(files)-1])
+		if store.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return fmt.Errorf("open capture file fail: %s", err.Error())
+		}
+		info, err := store.file.Stat()
+		if err != nil {
+			return fmt.Errorf("stat capture file fail: %s", err.Error())
+		}
+		store.size = info.Size()
+	}
+	return nil
+}
+
+func (store *FileStore) Add(req *Request) error {
+	store.Lock()
+	defer store.Unlock()
+	req.ID = nextID()
+	line, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if store.file == nil || store.size+int64(len(line)) > store.MaxFileSize {
+		if err := store.rotate(req.ID); err != nil {
+			return err
+		}
+	}
+	n, err := store.file.Write(line)
+	store.size += int64(n)
+	return err
+}
+
+// rotate starts a new file with the first request id, the lock must be held
+func (store *FileStore) rotate(firstID int64) error {
+	if store.file != nil {
+		store.file.Close()
+	}
+	file, err := os.OpenFile(store.path(firstID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		store.file = nil
+		return fmt.Errorf("create capture file fail: %s", err.Error())
+	}
+	store.file = file
+	store.size = 0
+	files, err := store.files()
+	if err != nil {
+		return err
+	}
+	for len(files) > store.MaxFiles {
+		if err := os.Remove(store.path(files[0])); err != nil {
+			logging.Warn("Remove capture file fail: %s", err.Error())
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+func (store *FileStore) Fetch(cursor int64, count int) ([]*Request, int64, error) {
+	files, err := store.files()
+	if err != nil {
+		return nil, cursor, err
+	}
+	result := make([]*Request, 0, count)
+	for i, firstID := range files {
+		if i+1 < len(files) && files[i+1] <= cursor+1 {
+			continue
+		}
+		if err := store.scan(firstID, cursor, count, &result); err != nil {
+			return nil, cursor, err
+		}
+		if len(result) >= count {
+			break
+		}
+	}
+	if len(result) > 0 {
+		cursor = result[len(result)-1].ID
+	}
+	return result, cursor, nil
+}
+
+func (store *FileStore) scan(firstID, cursor int64, count int, result *[]*Request) error {
+	file, err := os.Open(store.path(firstID))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxCaptureLineSize)
+	for scanner.Scan() && len(*result) < count {
+		req := new(Request)
+		if err := json.Unmarshal(scanner.Bytes(), req); err != nil {
+			// the last line may be partially written
+			break
+		}
+		if req.ID > cursor {
+			*result = append(*result, req)
+		}
+	}
+	return scanner.Err()
+}
+
+// files returns the first request ids of the capture files in order
+func (store *FileStore) files() ([]int64, error) {
+	infos, err := ioutil.ReadDir(store.Directory)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, captureFilePrefix) || !strings.HasSuffix(name, captureFileSuffix) {
+			continue
+		}
+		id, err := strconv.ParseInt(name[len(captureFilePrefix):len(name)-len(captureFileSuffix)], 10, 64)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (store *FileStore) path(firstID int64) string {
+	return filepath.Join(store.Directory, captureFilePrefix+strconv.FormatInt(firstID, 10)+captureFileSuffix)
+}
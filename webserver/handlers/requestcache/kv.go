@@ -0,0 +1,125 @@
+package requestcache
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/client/kv"
+	"github.com/yangchenxing/cangshan/logging"
+)
+
+func init() {
+	application.RegisterModulePrototype("RequestCacheKVStore", new(KVStore))
+}
+
+const (
+	defaultKVCapacity = 1000
+	defaultKVPrefix   = "requestcache."
+	kvHeadKey         = "head"
+)
+
+// A KVStore keeps the latest Capacity captured requests in KV, in slots reused round robin.
+// Request IDs are sequence numbers saved under KeyPrefix + "head". Only one process should add
+// requests to the same KeyPrefix.
+type KVStore struct {
+	sync.Mutex
+	KV        kv.KV
+	KeyPrefix string
+	Capacity  int64
+	MaxAge    time.Duration
+	head      int64
+}
+
+func (store *KVStore) Initialize() error {
+	if store.KV == nil {
+		return errors.New("Missing KV")
+	}
+	if store.KeyPrefix == "" {
+		store.KeyPrefix = defaultKVPrefix
+	}
+	if store.Capacity == 0 {
+		store.Capacity = defaultKVCapacity
+	}
+	head, err := store.loadHead()
+	if err != nil {
+		return err
+	}
+	store.head = head
+	return nil
+}
+
+func (store *KVStore) loadHead() (int64, error) {
+	data, err := store.KV.Get(store.KeyPrefix + kvHeadKey)
+	if err == kv.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+func (store *KVStore) slotKey(id int64) string {
+	return store.KeyPrefix + strconv.FormatInt(id%store.Capacity, 10)
+}
+
+func (store *KVStore) Add(req *Request) error {
+	store.Lock()
+	defer store.Unlock()
+	req.ID = store.head + 1
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if err := store.KV.Set(store.slotKey(req.ID), data, store.MaxAge); err != nil {
+		return err
+	}
+	store.head = req.ID
+	return store.KV.Set(store.KeyPrefix+kvHeadKey, []byte(strconv.FormatInt(store.head, 10)), 0)
+}
+
+func (store *KVStore) Fetch(cursor int64, count int) ([]*Request, int64, error) {
+	head, err := store.loadHead()
+	if err != nil {
+		return nil, cursor, err
+	}
+	first := cursor + 1
+	if first <= head-store.Capacity {
+		first = head - store.Capacity + 1
+	}
+	last := first + int64(count) - 1
+	if last > head {
+		last = head
+	}
+	if first > last {
+		return []*Request{}, cursor, nil
+	}
+	keys := make([]string, 0, last-first+1)
+	for id := first; id <= last; id++ {
+		keys = append(keys, store.slotKey(id))
+	}
+	values, err := store.KV.GetMulti(keys...)
+	if err != nil {
+		return nil, cursor, err
+	}
+	result := make([]*Request, 0, len(keys))
+	for id := first; id <= last; id++ {
+		data, found := values[store.slotKey(id)]
+		if !found {
+			continue
+		}
+		req := new(Request)
+		if err := json.Unmarshal(data, req); err != nil {
+			logging.Warn("Decode captured request %d fail: %s", id, err.Error())
+			continue
+		}
+		// the slot may have been reused since head was loaded
+		if req.ID == id {
+			result = append(result, req)
+		}
+	}
+	return result, last, nil
+}
@@ -0,0 +1,232 @@
+package requestcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultIgnoreHeaders are response headers not compared unless IgnoreHeaders is set
+var DefaultIgnoreHeaders = []string{"Date", "Content-Length", "Set-Cookie", "Connection",
+	"Traceparent", "Tracestate"}
+
+// A Replayer sends captured requests to Target, like "http://host:port", and compares the
+// responses with the captured ones. The captured Host header is kept with KeepHost. Header is
+// set on replayed requests, e.g. to replace credentials redacted from captures.
+type Replayer struct {
+	Target        string
+	Client        *http.Client
+	IgnoreHeaders []string
+	KeepHost      bool
+	Header        http.Header
+}
+
+// A Diff is the difference of a replayed response with the captured one
+type Diff struct {
+	ID     int64
+	Method string
+	URL    string
+	// Status is the captured and replayed status
+	Status [2]int
+	// Headers are the captured and replayed values of different headers
+	Headers map[string][2][]string
+	// BodyOffset is the offset of the first different byte, or -1 for equal bodies
+	BodyOffset int
+	Error      error
+}
+
+// Equal returns if the replayed response is the same as the captured one
+func (diff *Diff) Equal() bool {
+	return diff.Error == nil && diff.Status[0] == diff.Status[1] && len(diff.Headers) == 0 &&
+		diff.BodyOffset < 0
+}
+
+func (diff *Diff) String() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "#%d %s %s", diff.ID, diff.Method, diff.URL)
+	if diff.Error != nil {
+		fmt.Fprintf(buf, "\n  error: %s", diff.Error.Error())
+		return buf.String()
+	}
+	if diff.Equal() {
+		buf.WriteString(" OK")
+		return buf.String()
+	}
+	if diff.Status[0] != diff.Status[1] {
+		fmt.Fprintf(buf, "\n  status: %d => %d", diff.Status[0], diff.Status[1])
+	}
+	keys := make([]string, 0, len(diff.Headers))
+	for key := range diff.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values := diff.Headers[key]
+		fmt.Fprintf(buf, "\n  header %s: %q => %q", key, values[0], values[1])
+	}
+	if diff.BodyOffset >= 0 {
+		fmt.Fprintf(buf, "\n  body differs at offset %d", diff.BodyOffset)
+	}
+	return buf.String()
+}
+
+// Replay sends the captured request to Target. Errors of the replayed request are set in the
+// Diff. Requests with truncated bodies are not replayed.
+func (replayer *Replayer) Replay(req *Request) *Diff {
+	diff := &Diff{
+		ID:         req.ID,
+		Method:     req.Method,
+		URL:        req.URL,
+		Status:     [2]int{req.Status, 0},
+		BodyOffset: -1,
+	}
+	if req.BodyTruncated {
+		diff.Error = errors.New("request body truncated")
+		return diff
+	}
+	httpRequest, err := http.NewRequest(req.Method, strings.TrimRight(replayer.Target, "/")+req.URL,
+		bytes.NewReader(req.Body))
+	if err != nil {
+		diff.Error = fmt.Errorf("create request fail: %s", err.Error())
+		return diff
+	}
+	httpRequest.Header = cloneHeader(req.Header)
+	for key, values := range replayer.Header {
+		httpRequest.Header[key] = values
+	}
+	if replayer.KeepHost {
+		httpRequest.Host = req.Host
+	}
+	client := replayer.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(httpRequest)
+	if err != nil {
+		diff.Error = fmt.Errorf("send request fail: %s", err.Error())
+		return diff
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		diff.Error = fmt.Errorf("read response fail: %s", err.Error())
+		return diff
+	}
+	diff.Status[1] = response.StatusCode
+	diff.Headers = replayer.compareHeader(req.ResponseHeader, response.Header)
+	if req.ResponseTruncated && len(body) > len(req.ResponseBody) {
+		body = body[:len(req.ResponseBody)]
+	}
+	diff.BodyOffset = compareBody(req.ResponseBody, body)
+	return diff
+}
+
+func (replayer *Replayer) compareHeader(captured, replayed http.Header) map[string][2][]string {
+	ignores := replayer.IgnoreHeaders
+	if ignores == nil {
+		ignores = DefaultIgnoreHeaders
+	}
+	ignored := make(map[string]bool, len(ignores))
+	for _, key := range ignores {
+		ignored[http.CanonicalHeaderKey(key)] = true
+	}
+	diffs := make(map[string][2][]string)
+	compare := func(key string) {
+		key = http.CanonicalHeaderKey(key)
+		if _, found := diffs[key]; found || ignored[key] {
+			return
+		}
+		values := [2][]string{captured[key], replayed[key]}
+		if strings.Join(values[0], "\n") != strings.Join(values[1], "\n") {
+			diffs[key] = values
+		}
+	}
+	for key := range captured {
+		compare(key)
+	}
+	for key := range replayed {
+		compare(key)
+	}
+	return diffs
+}
+
+func compareBody(captured, replayed []byte) int {
+	for i := 0; i < len(captured) && i < len(replayed); i++ {
+		if captured[i] != replayed[i] {
+			return i
+		}
+	}
+	if len(captured) != len(replayed) {
+		if len(captured) < len(replayed) {
+			return len(captured)
+		}
+		return len(replayed)
+	}
+	return -1
+}
+
+// FetchRequests fetches captured requests after cursor from a RequestCacheFetchHandler at
+// fetchURL, and returns the cursor of the following requests.
+func FetchRequests(client *http.Client, fetchURL string, cursor int64, count int) ([]*Request, int64, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	u, err := url.Parse(fetchURL)
+	if err != nil {
+		return nil, cursor, fmt.Errorf("parse fetch url fail: %s", err.Error())
+	}
+	query := u.Query()
+	query.Set("cursor", strconv.FormatInt(cursor, 10))
+	query.Set("count", strconv.Itoa(count))
+	u.RawQuery = query.Encode()
+	response, err := client.Get(u.String())
+	if err != nil {
+		return nil, cursor, fmt.Errorf("fetch captured requests fail: %s", err.Error())
+	}
+	defer response.Body.Close()
+	var result struct {
+		Success  bool       `json:"success"`
+		Message  string     `json:"message"`
+		Entities []*Request `json:"entities"`
+		Next     string     `json:"next"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, cursor, fmt.Errorf("decode captured requests fail: %s", err.Error())
+	} else if !result.Success {
+		return nil, cursor, fmt.Errorf("fetch captured requests fail: %d %s", response.StatusCode, result.Message)
+	}
+	next, err := strconv.ParseInt(result.Next, 10, 64)
+	if err != nil {
+		return nil, cursor, fmt.Errorf("invalid next cursor: %s", result.Next)
+	}
+	return result.Entities, next, nil
+}
+
+// ReadCaptureFile reads captured requests from a capture file of FileStore
+func ReadCaptureFile(path string) ([]*Request, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var requests []*Request
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxCaptureLineSize)
+	for scanner.Scan() {
+		req := new(Request)
+		if err := json.Unmarshal(scanner.Bytes(), req); err != nil {
+			return requests, fmt.Errorf("decode captured request fail: %s", err.Error())
+		}
+		requests = append(requests, req)
+	}
+	return requests, scanner.Err()
+}
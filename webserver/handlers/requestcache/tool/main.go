@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yangchenxing/cangshan/logging"
+	"github.com/yangchenxing/cangshan/webserver/handlers/requestcache"
+)
+
+var (
+	source   = flag.String("source", "", "url of the request cache fetch handler")
+	file     = flag.String("file", "", "capture file, instead of source")
+	target   = flag.String("target", "", "target to replay requests, like http://host:port")
+	cursor   = flag.Int64("cursor", 0, "fetch requests after the cursor")
+	count    = flag.Int("count", 100, "max count of requests to replay")
+	keepHost = flag.Bool("keephost", false, "keep the captured host header")
+	timeout  = flag.Duration("timeout", 10*time.Second, "replay request timeout")
+	onlyDiff = flag.Bool("diff", false, "only print different responses")
+	header   = make(headerFlag)
+)
+
+// headerFlag collects repeated "Name: value" flags
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h headerFlag) Set(value string) error {
+	pos := strings.Index(value, ":")
+	if pos <= 0 {
+		return fmt.Errorf("invalid header %q, expect \"Name: value\"", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(value[:pos]), strings.TrimSpace(value[pos+1:]))
+	return nil
+}
+
+func init() {
+	flag.Var(header, "header", "header of replayed requests like \"Name: value\", may be repeated")
+}
+
+func exit(code int) {
+	logging.Flush()
+	os.Exit(code)
+}
+
+func main() {
+	logging.CreateDefaultLogging()
+	flag.Parse()
+	if *target == "" {
+		logging.Error("\"target\" is required argument")
+		exit(1)
+	} else if *source == "" && *file == "" {
+		logging.Error("\"source\" or \"file\" is required argument")
+		exit(1)
+	}
+	client := &http.Client{Timeout: *timeout}
+	requests, err := loadRequests(client)
+	if err != nil {
+		logging.Error("Load captured requests fail: %s", err.Error())
+		exit(1)
+	}
+	replayer := &requestcache.Replayer{
+		Target:   *target,
+		Client:   client,
+		KeepHost: *keepHost,
+		Header:   http.Header(header),
+	}
+	different := 0
+	for _, req := range requests {
+		diff := replayer.Replay(req)
+		if !diff.Equal() {
+			different++
+		} else if *onlyDiff {
+			continue
+		}
+		fmt.Println(diff.String())
+	}
+	fmt.Printf("replayed %d requests, %d different\n", len(requests), different)
+	if different > 0 {
+		exit(2)
+	}
+	exit(0)
+}
+
+func loadRequests(client *http.Client) ([]*requestcache.Request, error) {
+	if *file != "" {
+		captured, err := requestcache.ReadCaptureFile(*file)
+		requests := make([]*requestcache.Request, 0, len(captured))
+		for _, req := range captured {
+			if req.ID > *cursor && len(requests) < *count {
+				requests = append(requests, req)
+			}
+		}
+		return requests, err
+	}
+	var requests []*requestcache.Request
+	next := *cursor
+	for len(requests) < *count {
+		batch, cursor, err := requestcache.FetchRequests(client, *source, next, *count-len(requests))
+		if err != nil {
+			return requests, err
+		} else if len(batch) == 0 {
+			break
+		}
+		requests = append(requests, batch...)
+		next = cursor
+	}
+	return requests, nil
+}
@@ -12,6 +12,9 @@ func init() {
 
 const (
 	DefaultRoleKey = "role"
+	// RolesAttrKey is the request attribute of roles granted for the request only, e.g. by
+	// a bearer token. It takes precedence over the roles in the session and is never saved.
+	RolesAttrKey = "request.roles"
 )
 
 type RoleAuth struct {
@@ -35,21 +38,30 @@ func (auth *RoleAuth) Initialize() error {
 	return nil
 }
 
+// Handle stops the request with 401 if there is no session or role, or 403 if none of the roles
+// is allowed. Roles in the RolesAttrKey attribute are checked instead of the session if set.
 func (auth RoleAuth) Handle(request *webserver.Request) {
-	if session, ok := request.Attr[auth.SessionKey].(map[string]interface{}); !ok || session == nil {
-		request.Error("Missing session")
-		request.WriteAndStop(500, nil, "")
+	if roles, ok := request.Attr[RolesAttrKey].([]string); ok && roles != nil {
+		auth.check(request, roles)
+	} else if session, ok := request.Attr[auth.SessionKey].(map[string]interface{}); !ok || session == nil {
+		request.Info("Deny: missing session")
+		request.WriteAndStop(401, nil, "")
 		return
 	} else if roles, ok := session[auth.RoleKey].([]string); !ok || roles == nil {
-		request.Error("Missing role")
-		request.WriteAndStop(500, nil, "")
+		request.Info("Deny: missing role")
+		request.WriteAndStop(401, nil, "")
 		return
 	} else {
-		for _, role := range roles {
-			if auth.roles[role] {
-				return
-			}
+		auth.check(request, roles)
+	}
+}
+
+func (auth RoleAuth) check(request *webserver.Request, roles []string) {
+	for _, role := range roles {
+		if auth.roles[role] {
+			return
 		}
-		request.WriteAndStop(403, nil, "")
 	}
+	request.Info("Deny: roles %v not allowed", roles)
+	request.WriteAndStop(403, nil, "")
 }
@@ -0,0 +1,46 @@
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"github.com/yangchenxing/cangshan/application"
+)
+
+func init() {
+	application.RegisterBuiltinModule("WebServerSessionGobCodec", GobCodec{})
+	application.RegisterBuiltinModule("WebServerSessionJSONCodec", JSONCodec{})
+}
+
+// A Codec encodes session records for storage. Values stored in sessions must be supported by
+// the codec: gob requires concrete types to be registered with gob.Register, while JSON decodes
+// numbers as float64 and lists as []interface{}.
+type Codec interface {
+	Encode(value interface{}) ([]byte, error)
+	Decode(data []byte, value interface{}) error
+}
+
+type GobCodec struct{}
+
+func (codec GobCodec) Encode(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (codec GobCodec) Decode(data []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+type JSONCodec struct{}
+
+func (codec JSONCodec) Encode(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (codec JSONCodec) Decode(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
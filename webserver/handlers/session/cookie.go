@@ -0,0 +1,163 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/client/kv"
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+const defaultMaxCookieSize = 4096
+
+var errBadCookie = errors.New("bad session cookie")
+
+func init() {
+	application.RegisterModulePrototype("WebServerCookieSessionLoader", new(CookieSessionLoader))
+}
+
+// A cookieRecord is the content of an encrypted session cookie
+type cookieRecord struct {
+	ID string
+	Record
+}
+
+// A CookieSessionLoader keeps the whole session in an AES-GCM encrypted cookie, so no KV is
+// needed. Keys are secrets hashed to AES-256 keys: the first key encrypts, all keys decrypt,
+// so keys can be rotated. Sessions encoding to cookies longer than MaxCookieSize are not saved.
+// Like SessionLoader, unmodified sessions are re-sent every TouchInterval only with IdleTimeout.
+// Use WebServerSessionSaver to write the cookie back, its KV and SessionMaxAge are ignored.
+type CookieSessionLoader struct {
+	SessionKey   string
+	SessionIDKey string
+	SessionCookie
+	Keys            []string
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+	TouchInterval   time.Duration
+	MaxCookieSize   int
+	Codec           Codec
+	aeads           []cipher.AEAD
+}
+
+func (loader *CookieSessionLoader) Initialize() error {
+	if loader.SessionKey == "" {
+		loader.SessionKey = DefaultSessionAttrKey
+	}
+	if loader.SessionIDKey == "" {
+		loader.SessionIDKey = DefaultSessionIDAttrKey
+	}
+	if len(loader.Keys) == 0 {
+		return errors.New("Missing Keys")
+	}
+	if loader.MaxCookieSize == 0 {
+		loader.MaxCookieSize = defaultMaxCookieSize
+	}
+	if loader.Codec == nil {
+		loader.Codec = GobCodec{}
+	}
+	if loader.TouchInterval == 0 && loader.IdleTimeout > 0 {
+		loader.TouchInterval = loader.IdleTimeout / 4
+	}
+	loader.aeads = make([]cipher.AEAD, len(loader.Keys))
+	for i, key := range loader.Keys {
+		hash := sha256.Sum256([]byte(key))
+		block, err := aes.NewCipher(hash[:])
+		if err != nil {
+			return fmt.Errorf("create cipher fail: %s", err.Error())
+		}
+		if loader.aeads[i], err = cipher.NewGCM(block); err != nil {
+			return fmt.Errorf("create cipher fail: %s", err.Error())
+		}
+	}
+	return loader.SessionCookie.initialize(loader.AbsoluteTimeout)
+}
+
+func (loader *CookieSessionLoader) Handle(request *webserver.Request) {
+	state := &State{idKey: loader.SessionIDKey, store: loader}
+	now := time.Now()
+	if cookie, err := request.Cookie(loader.cookieName(request)); err == nil {
+		if record, snapshot, err := loader.decrypt(cookie.Value); err != nil {
+			request.Warn("Reject session cookie: %s", err.Error())
+		} else if record.expired(now, loader.IdleTimeout, loader.AbsoluteTimeout) {
+			request.Debug("Session %s expired", record.ID)
+		} else {
+			state.ID = record.ID
+			state.Record = record.Record
+			state.snapshot = snapshot
+		}
+	}
+	state.attach(request, loader.SessionKey, now)
+}
+
+// decrypt returns the session in the cookie and a separately decoded copy of its data
+func (loader *CookieSessionLoader) decrypt(value string) (cookieRecord, map[string]interface{}, error) {
+	var record, snapshot cookieRecord
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return record, nil, errBadCookie
+	}
+	var plain []byte
+	for _, aead := range loader.aeads {
+		if len(data) < aead.NonceSize() {
+			return record, nil, errBadCookie
+		}
+		if plain, err = aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return record, nil, errBadCookie
+	}
+	if err := loader.Codec.Decode(plain, &record); err != nil {
+		return record, nil, fmt.Errorf("decode fail: %s", err.Error())
+	}
+	if err := loader.Codec.Decode(plain, &snapshot); err != nil {
+		return record, nil, fmt.Errorf("decode fail: %s", err.Error())
+	}
+	return record, snapshot.Data, nil
+}
+
+func (loader *CookieSessionLoader) encrypt(record *cookieRecord) (string, error) {
+	plain, err := loader.Codec.Encode(record)
+	if err != nil {
+		return "", err
+	}
+	aead := loader.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+func (loader *CookieSessionLoader) save(request *webserver.Request, state *State, kvStore kv.KV, maxAge time.Duration) error {
+	if state.removed {
+		if !state.New {
+			loader.setCookie(request, "", -1)
+		}
+		return nil
+	}
+	now := time.Now()
+	if !state.needSave(now, loader.TouchInterval) {
+		return nil
+	}
+	state.Record.LastAccess = now
+	value, err := loader.encrypt(&cookieRecord{ID: state.ID, Record: state.Record})
+	if err != nil {
+		return fmt.Errorf("encrypt session %s fail: %s", state.ID, err.Error())
+	}
+	cookie := loader.newCookie(request, value, 0)
+	if size := len(cookie.String()); size > loader.MaxCookieSize {
+		return fmt.Errorf("session %s cookie of %d bytes exceeds %d", state.ID, size, loader.MaxCookieSize)
+	}
+	request.SetCookie(cookie)
+	return nil
+}
@@ -1,12 +1,16 @@
 package session
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/gob"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
-	"math/rand"
+	"errors"
+	"fmt"
 	"net/http"
+	"reflect"
+	"regexp"
 	"strings"
 	"time"
 
@@ -19,6 +23,21 @@ import (
 const (
 	DefaultSessionAttrKey   = "session"
 	DefaultSessionIDAttrKey = "sessionid"
+	// StateAttrKey is the request attribute key of the *State of the loaded session
+	StateAttrKey = "session.state"
+
+	sessionIDBytes        = 16
+	defaultCookieSameSite = "Lax"
+)
+
+var (
+	errNoSession     = errors.New("no session loaded")
+	errBadSignature  = errors.New("bad session cookie signature")
+	errMissingSecret = errors.New("Missing SecretKeys: session cookies are signed now, set SecretKeys, " +
+		"and AcceptUnsignedCookies to keep sessions of former unsigned cookies")
+	legacySessionIDPattern = regexp.MustCompile("^[0-9A-F]{32}$")
+	// DefaultRegenerateKeys are the session keys whose changes regenerate the session ID
+	DefaultRegenerateKeys = []string{"role"}
 )
 
 func init() {
@@ -26,12 +45,70 @@ func init() {
 	application.RegisterModulePrototype("WebServerSessionSaver", new(SessionSaver))
 }
 
+// A Record is what is stored in KV for a session
+type Record struct {
+	Created    time.Time
+	LastAccess time.Time
+	Data       map[string]interface{}
+}
+
+func (record *Record) expired(now time.Time, idleTimeout, absoluteTimeout time.Duration) bool {
+	return (idleTimeout > 0 && now.Sub(record.LastAccess) > idleTimeout) ||
+		(absoluteTimeout > 0 && now.Sub(record.Created) > absoluteTimeout)
+}
+
+// A sessionStore persists a session state for the saver
+type sessionStore interface {
+	save(request *webserver.Request, state *State, kvStore kv.KV, maxAge time.Duration) error
+}
+
+// A State tracks the session loaded for a request, so that the saver only writes sessions that
+// are new, modified, rotated or due for an idle timeout refresh.
+type State struct {
+	ID       string
+	Record   Record
+	New      bool
+	oldID    string
+	rotated  bool
+	dirty    bool
+	removed  bool
+	snapshot map[string]interface{}
+	idKey    string
+	store    sessionStore
+}
+
+// A SessionCookie holds the attributes of session cookies. The cookie is always HttpOnly.
+type SessionCookie struct {
+	CookieName     string
+	CookieDomain   string
+	CookiePath     string
+	CookieSecure   bool
+	CookieSameSite string
+	CookieMaxAge   time.Duration
+	sameSite       http.SameSite
+}
+
+// A SessionLoader loads the session identified by a signed cookie from KV into request.Attr.
+// Session IDs are 128-bit random values signed with HMAC-SHA256 by the first of SecretKeys;
+// the other keys are accepted for verification only, so keys can be rotated. Sessions expire
+// after IdleTimeout without access, or AbsoluteTimeout after creation, if set. Unmodified
+// sessions are saved to refresh the idle timeout every TouchInterval, a quarter of IdleTimeout
+// by default, and only saved when modified without IdleTimeout.
+//
+// Unsigned cookies of former versions are rejected unless AcceptUnsignedCookies, in which case
+// their sessions are loaded and moved to new signed IDs. Session IDs must be regenerated on
+// privilege changes, see Regenerate and SessionSaver.RegenerateKeys.
 type SessionLoader struct {
 	SessionKey   string
 	SessionIDKey string
-	CookieName   string
-	KV           kv.KV
-	CookieMaxAge time.Duration
+	SessionCookie
+	SecretKeys            []string
+	IdleTimeout           time.Duration
+	AbsoluteTimeout       time.Duration
+	TouchInterval         time.Duration
+	KV                    kv.KV
+	Codec                 Codec
+	AcceptUnsignedCookies bool
 }
 
 func (loader *SessionLoader) Initialize() error {
@@ -41,58 +118,322 @@ func (loader *SessionLoader) Initialize() error {
 	if loader.SessionIDKey == "" {
 		loader.SessionIDKey = DefaultSessionIDAttrKey
 	}
-	return nil
+	if loader.KV == nil {
+		return errors.New("Missing KV")
+	}
+	if len(loader.SecretKeys) == 0 {
+		return errMissingSecret
+	}
+	if loader.Codec == nil {
+		loader.Codec = GobCodec{}
+	}
+	if loader.TouchInterval == 0 && loader.IdleTimeout > 0 {
+		loader.TouchInterval = loader.IdleTimeout / 4
+	}
+	return loader.SessionCookie.initialize(loader.AbsoluteTimeout)
+}
+
+func (loader *SessionLoader) Handle(request *webserver.Request) {
+	state := &State{idKey: loader.SessionIDKey, store: loader}
+	now := time.Now()
+	legacy := false
+	if sessionID, unsigned, err := loader.readCookie(request); err == nil {
+		if record, snapshot, err := loader.load(sessionID, unsigned, now, request); err != nil {
+			request.Debug("Load session %s fail: %s", sessionID, err.Error())
+		} else if record.expired(now, loader.IdleTimeout, loader.AbsoluteTimeout) {
+			request.Debug("Session %s expired", sessionID)
+		} else {
+			state.ID = sessionID
+			state.Record = record
+			state.snapshot = snapshot
+			legacy = unsigned
+		}
+	} else if err != http.ErrNoCookie {
+		request.Warn("Reject session cookie: %s", err.Error())
+	}
+	state.attach(request, loader.SessionKey, now)
+	if legacy {
+		request.Info("Move session of unsigned cookie to a new ID")
+		Regenerate(request)
+	}
+}
+
+// attach creates a new session if none was loaded, and puts the state into request.Attr
+func (state *State) attach(request *webserver.Request, sessionKey string, now time.Time) {
+	if state.ID == "" {
+		state.ID = generateSessionID()
+		state.New = true
+		state.Record = Record{Created: now, LastAccess: now}
+		logging.Debug("Create session %s", state.ID)
+	}
+	if state.Record.Data == nil {
+		state.Record.Data = make(map[string]interface{})
+	}
+	request.Attr[sessionKey] = state.Record.Data
+	request.Attr[state.idKey] = state.ID
+	request.Attr[StateAttrKey] = state
+}
+
+func (cookie *SessionCookie) initialize(defaultMaxAge time.Duration) error {
+	if cookie.CookiePath == "" {
+		cookie.CookiePath = "/"
+	}
+	if cookie.CookieMaxAge == 0 {
+		cookie.CookieMaxAge = defaultMaxAge
+	}
+	var err error
+	cookie.sameSite, err = parseSameSite(cookie.CookieSameSite)
+	return err
+}
+
+func (cookie *SessionCookie) cookieName(request *webserver.Request) string {
+	if cookie.CookieName != "" {
+		return cookie.CookieName
+	}
+	cookieName := request.Host
+	if pos := strings.Index(cookieName, ":"); pos > 0 {
+		cookieName = cookieName[:pos]
+	}
+	return cookieName + "_SESSION"
+}
+
+// readCookie returns the session ID of the cookie, and whether it is an accepted unsigned cookie
+func (loader *SessionLoader) readCookie(request *webserver.Request) (string, bool, error) {
+	cookie, err := request.Cookie(loader.cookieName(request))
+	if err != nil {
+		return "", false, err
+	}
+	if loader.AcceptUnsignedCookies && legacySessionIDPattern.MatchString(cookie.Value) {
+		return cookie.Value, true, nil
+	}
+	sessionID, err := loader.verify(cookie.Value)
+	return sessionID, false, err
 }
 
-func (loader SessionLoader) Handle(request *webserver.Request) {
-	cookieName := loader.CookieName
-	if cookieName == "" {
-		cookieName := request.Host
-		if pos := strings.Index(cookieName, ":"); pos > 0 {
-			cookieName = cookieName[:pos]
+// load returns the stored record and a separately decoded copy of its data, used to detect
+// modifications when saving. Sessions of unsigned cookies may be stored as bare gob maps.
+func (loader *SessionLoader) load(sessionID string, unsigned bool, now time.Time, request *webserver.Request) (Record, map[string]interface{}, error) {
+	var record, snapshot Record
+	data, err := kv.WithSpan(loader.KV, "session", request.Span()).Get(sessionID)
+	if err != nil {
+		return record, nil, err
+	}
+	if err := loader.Codec.Decode(data, &record); err != nil {
+		if !unsigned {
+			return record, nil, fmt.Errorf("decode fail: %s", err.Error())
 		}
-		cookieName += "_SESSION"
-	}
-	var session map[string]interface{}
-	var sessionID string
-	if cookie, err := request.Cookie(cookieName); err != nil || cookie == nil {
-		sessionID = generateSessionID(request)
-		cookie = new(http.Cookie)
-		cookie.Name = cookieName
-		cookie.Value = sessionID
-		cookie.Path = "/"
-		cookie.Domain = request.Host
-		cookie.Expires = time.Now().Add(loader.CookieMaxAge)
-		request.SetCookie(cookie)
-		logging.Debug("Create session %s", sessionID)
-		session = make(map[string]interface{})
-	} else {
-		sessionID = cookie.Value
-		if data, err := loader.KV.Get(sessionID); err != nil {
-			logging.Debug("Get session %s data fail: %s", sessionID, err.Error())
-			session = make(map[string]interface{})
-		} else if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&session); err != nil {
-			logging.Warn("Decode session %s data fail: %s", sessionID, err.Error())
-			session = make(map[string]interface{})
+		record = Record{Created: now, LastAccess: now}
+		if err := (GobCodec{}).Decode(data, &record.Data); err != nil {
+			return record, nil, fmt.Errorf("decode fail: %s", err.Error())
 		}
+		snapshot := make(map[string]interface{})
+		GobCodec{}.Decode(data, &snapshot)
+		return record, snapshot, nil
+	}
+	if err := loader.Codec.Decode(data, &snapshot); err != nil {
+		return record, nil, fmt.Errorf("decode fail: %s", err.Error())
 	}
-	request.Attr[loader.SessionKey] = session
-	request.Attr[loader.SessionIDKey] = sessionID
+	return record, snapshot.Data, nil
+}
+
+func (loader *SessionLoader) sign(sessionID string) string {
+	mac := hmac.New(sha256.New, []byte(loader.SecretKeys[0]))
+	mac.Write([]byte(sessionID))
+	return sessionID + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
 }
 
-func generateSessionID(request *webserver.Request) string {
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, time.Now().Unix())
-	binary.Write(buf, binary.LittleEndian, rand.Uint32())
-	binary.Write(buf, binary.LittleEndian, rand.Uint32())
-	return strings.ToUpper(hex.EncodeToString(buf.Bytes())[:32])
+func (loader *SessionLoader) verify(value string) (string, error) {
+	pos := strings.LastIndex(value, ".")
+	if pos <= 0 {
+		return "", errBadSignature
+	}
+	sessionID := value[:pos]
+	signature, err := base64.RawURLEncoding.DecodeString(value[pos+1:])
+	if err != nil {
+		return "", errBadSignature
+	}
+	for _, key := range loader.SecretKeys {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(sessionID))
+		if hmac.Equal(signature, mac.Sum(nil)) {
+			return sessionID, nil
+		}
+	}
+	return "", errBadSignature
+}
+
+// newCookie returns the session cookie with value, a negative maxAge expires the cookie
+func (cookie *SessionCookie) newCookie(request *webserver.Request, value string, maxAge int) *http.Cookie {
+	if maxAge == 0 {
+		maxAge = int(cookie.CookieMaxAge.Seconds())
+	}
+	result := &http.Cookie{
+		Name:     cookie.cookieName(request),
+		Value:    value,
+		Path:     cookie.CookiePath,
+		Domain:   cookie.CookieDomain,
+		Secure:   cookie.CookieSecure,
+		HttpOnly: true,
+		SameSite: cookie.sameSite,
+		MaxAge:   maxAge,
+	}
+	if maxAge > 0 {
+		result.Expires = time.Now().Add(time.Duration(maxAge) * time.Second)
+	}
+	return result
 }
 
+func (cookie *SessionCookie) setCookie(request *webserver.Request, value string, maxAge int) {
+	request.SetCookie(cookie.newCookie(request, value, maxAge))
+}
+
+// save writes the session if needed, using kvStore and maxAge if provided by the saver
+func (loader *SessionLoader) save(request *webserver.Request, state *State, kvStore kv.KV, maxAge time.Duration) error {
+	if kvStore == nil {
+		kvStore = loader.KV
+	}
+	store := kv.WithSpan(kvStore, "session", request.Span())
+	if state.removed {
+		loader.setCookie(request, "", -1)
+		if state.oldID != "" {
+			return store.Remove(state.oldID)
+		} else if state.New || state.rotated {
+			return nil
+		}
+		return store.Remove(state.ID)
+	}
+	now := time.Now()
+	if !state.needSave(now, loader.TouchInterval) {
+		return nil
+	}
+	state.Record.LastAccess = now
+	content, err := loader.Codec.Encode(&state.Record)
+	if err != nil {
+		return fmt.Errorf("encode session %s fail: %s", state.ID, err.Error())
+	}
+	if maxAge == 0 {
+		maxAge = loader.IdleTimeout
+	}
+	if maxAge == 0 {
+		maxAge = loader.AbsoluteTimeout
+	}
+	if err := store.Set(state.ID, content, maxAge); err != nil {
+		return fmt.Errorf("save session %s fail: %s", state.ID, err.Error())
+	}
+	if state.New || state.rotated {
+		loader.setCookie(request, loader.sign(state.ID), 0)
+	}
+	if state.oldID != "" {
+		if err := store.Remove(state.oldID); err != nil {
+			logging.Warn("Remove rotated session %s fail: %s", state.oldID, err.Error())
+		}
+	}
+	return nil
+}
+
+// needSave reports whether the session is modified, rotated or due for an idle timeout refresh.
+// Sessions are refreshed only if touchInterval is positive. New sessions without data are not
+// saved.
+func (state *State) needSave(now time.Time, touchInterval time.Duration) bool {
+	if state.New {
+		return len(state.Record.Data) > 0
+	}
+	snapshot := state.snapshot
+	if snapshot == nil {
+		snapshot = make(map[string]interface{})
+	}
+	return state.dirty || state.rotated || !reflect.DeepEqual(snapshot, state.Record.Data) ||
+		touchInterval > 0 && now.Sub(state.Record.LastAccess) >= touchInterval
+}
+
+// privilegeChanged reports whether values of keys differ from the loaded session
+func (state *State) privilegeChanged(keys []string) bool {
+	for _, key := range keys {
+		if !reflect.DeepEqual(state.snapshot[key], state.Record.Data[key]) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkDirty forces the session to be saved, for changes the saver can not detect
+func (state *State) MarkDirty() {
+	state.dirty = true
+}
+
+// GetState returns the session state loaded for the request
+func GetState(request *webserver.Request) (*State, error) {
+	state, ok := request.Attr[StateAttrKey].(*State)
+	if !ok || state == nil {
+		return nil, errNoSession
+	}
+	return state, nil
+}
+
+// Regenerate gives the session a new ID keeping its data. It must be called on privilege
+// changes like login, so that a session ID known before can not be used afterwards. SessionSaver
+// calls it when values of RegenerateKeys change, integrators storing privileges under other keys
+// must call it themselves.
+func Regenerate(request *webserver.Request) error {
+	state, err := GetState(request)
+	if err != nil {
+		return err
+	}
+	if !state.New && state.oldID == "" {
+		state.oldID = state.ID
+	}
+	state.ID = generateSessionID()
+	state.rotated = true
+	request.Attr[state.idKey] = state.ID
+	return nil
+}
+
+// Destroy clears the session data, removes it from storage and expires the cookie
+func Destroy(request *webserver.Request) error {
+	state, err := GetState(request)
+	if err != nil {
+		return err
+	}
+	for key := range state.Record.Data {
+		delete(state.Record.Data, key)
+	}
+	state.removed = true
+	return nil
+}
+
+func generateSessionID() string {
+	var buf [sessionIDBytes]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("read crypto random fail: %s", err.Error()))
+	}
+	return strings.ToUpper(hex.EncodeToString(buf[:]))
+}
+
+func parseSameSite(value string) (http.SameSite, error) {
+	if value == "" {
+		value = defaultCookieSameSite
+	}
+	switch strings.ToLower(value) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return http.SameSiteDefaultMode, fmt.Errorf("Unknown CookieSameSite: %s", value)
+}
+
+// A SessionSaver saves the session loaded by SessionLoader or CookieSessionLoader if it was
+// changed. KV and SessionMaxAge override the storage and expiration of SessionLoader if set.
+// The session ID is regenerated if values of RegenerateKeys, DefaultRegenerateKeys by default,
+// changed in a stored session, e.g. when a user logs in.
 type SessionSaver struct {
-	SessionKey    string
-	SessionIDKey  string
-	KV            kv.KV
-	SessionMaxAge time.Duration
+	SessionKey     string
+	SessionIDKey   string
+	KV             kv.KV
+	SessionMaxAge  time.Duration
+	RegenerateKeys []string
 }
 
 func (saver *SessionSaver) Initialize() error {
@@ -102,18 +443,27 @@ func (saver *SessionSaver) Initialize() error {
 	if saver.SessionIDKey == "" {
 		saver.SessionIDKey = DefaultSessionIDAttrKey
 	}
+	if saver.RegenerateKeys == nil {
+		saver.RegenerateKeys = DefaultRegenerateKeys
+	}
 	return nil
 }
 
 func (saver SessionSaver) Handle(request *webserver.Request) {
-	var data bytes.Buffer
-	if sessionID, ok := request.Attr["sessionid"].(string); !ok {
-		logging.Error("No session id")
-	} else if session, ok := request.Attr["session"].(map[string]interface{}); !ok {
-		logging.Error("No session %s", sessionID)
-	} else if err := gob.NewEncoder(&data).Encode(session); err != nil {
-		logging.Error("Encode session %s data fail: %s", sessionID, err.Error())
-	} else if err := saver.KV.Set(sessionID, data.Bytes(), saver.SessionMaxAge); err != nil {
+	state, err := GetState(request)
+	if err != nil {
+		logging.Error("No session: %s", err.Error())
+		return
+	}
+	if session, ok := request.Attr[saver.SessionKey].(map[string]interface{}); ok && session != nil {
+		state.Record.Data = session
+	}
+	if !state.New && !state.rotated && state.privilegeChanged(saver.RegenerateKeys) {
+		if err := Regenerate(request); err != nil {
+			logging.Error("Regenerate session fail: %s", err.Error())
+		}
+	}
+	if err := state.store.save(request, state, saver.KV, saver.SessionMaxAge); err != nil {
 		logging.Error("Save session fail: %s", err.Error())
 	}
 }
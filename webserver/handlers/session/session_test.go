@@ -0,0 +1,172 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yangchenxing/cangshan/client/kv"
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+type mapKV map[string][]byte
+
+func (store mapKV) Ping() error { return nil }
+
+func (store mapKV) Get(key string) ([]byte, error) {
+	if value, ok := store[key]; ok {
+		return value, nil
+	}
+	return nil, kv.ErrNotFound
+}
+
+func (store mapKV) GetMulti(keys ...string) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	for _, key := range keys {
+		if value, ok := store[key]; ok {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+func (store mapKV) Set(key string, value []byte, maxAge time.Duration) error {
+	store[key] = value
+	return nil
+}
+
+func (store mapKV) SetMulti(items []kv.Item) error {
+	for _, item := range items {
+		store[item.Key] = item.Value
+	}
+	return nil
+}
+
+func (store mapKV) Remove(key string) error {
+	delete(store, key)
+	return nil
+}
+
+func newTestLoader(t *testing.T, store mapKV, secretKeys ...string) *SessionLoader {
+	loader := &SessionLoader{KV: store, SecretKeys: secretKeys}
+	loader.CookieName = "SESSION"
+	if err := loader.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return loader
+}
+
+func newTestRequest(loader *SessionLoader, cookie string) *webserver.Request {
+	request := httptest.NewRequest("GET", "/", nil)
+	if cookie != "" {
+		request.AddCookie(&http.Cookie{Name: loader.CookieName, Value: cookie})
+	}
+	return &webserver.Request{Request: request, Attr: make(map[string]interface{})}
+}
+
+func TestSignVerify(t *testing.T) {
+	loader := newTestLoader(t, mapKV{}, "new", "old")
+	oldLoader := newTestLoader(t, mapKV{}, "old")
+	otherLoader := newTestLoader(t, mapKV{}, "other")
+	signed := loader.sign("ID")
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"current key", signed, true},
+		{"rotated key", oldLoader.sign("ID"), true},
+		{"unknown key", otherLoader.sign("ID"), false},
+		{"tampered id", "ID2" + signed[2:], false},
+		{"bad encoding", "ID.!!", false},
+		{"unsigned", "ID", false},
+		{"empty id", signed[2:], false},
+	}
+	for _, test := range tests {
+		sessionID, err := loader.verify(test.value)
+		if test.ok && (err != nil || sessionID != "ID") {
+			t.Errorf("%s: verify(%q) = %q, %v", test.name, test.value, sessionID, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: verify(%q) accepted", test.name, test.value)
+		}
+	}
+	if err := (&SessionLoader{KV: mapKV{}}).Initialize(); err != errMissingSecret {
+		t.Errorf("unexpected error without SecretKeys: %v", err)
+	}
+}
+
+func TestLoadSession(t *testing.T) {
+	store := mapKV{}
+	loader := newTestLoader(t, store, "secret")
+	content, _ := loader.Codec.Encode(&Record{Created: time.Now(), LastAccess: time.Now(),
+		Data: map[string]interface{}{"user": "alice"}})
+	store["ID"] = content
+	request := newTestRequest(loader, loader.sign("ID"))
+	loader.Handle(request)
+	state, err := GetState(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.New || state.ID != "ID" || state.Record.Data["user"] != "alice" {
+		t.Errorf("unexpected session: %+v", state)
+	}
+	if state.needSave(time.Now(), 0) {
+		t.Error("unmodified session needs save")
+	}
+	state.Record.Data["user"] = "bob"
+	if !state.needSave(time.Now(), 0) {
+		t.Error("modified session does not need save")
+	}
+
+	request = newTestRequest(loader, "ID")
+	loader.Handle(request)
+	if state, _ := GetState(request); !state.New {
+		t.Error("unsigned cookie accepted")
+	}
+}
+
+func TestLoadUnsignedSession(t *testing.T) {
+	store := mapKV{}
+	loader := newTestLoader(t, store, "secret")
+	loader.AcceptUnsignedCookies = true
+	legacyID := "0123456789ABCDEF0123456789ABCDEF"
+	content, _ := GobCodec{}.Encode(map[string]interface{}{"user": "alice"})
+	store[legacyID] = content
+	request := newTestRequest(loader, legacyID)
+	loader.Handle(request)
+	state, err := GetState(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.New || state.Record.Data["user"] != "alice" {
+		t.Errorf("unexpected session: %+v", state)
+	}
+	if state.ID == legacyID || state.oldID != legacyID || !state.rotated {
+		t.Errorf("session of unsigned cookie not moved: %s, %s", state.ID, state.oldID)
+	}
+
+	request = newTestRequest(loader, "0123")
+	loader.Handle(request)
+	if state, _ := GetState(request); !state.New {
+		t.Error("malformed unsigned cookie accepted")
+	}
+}
+
+func TestPrivilegeChanged(t *testing.T) {
+	state := &State{
+		Record:   Record{Data: map[string]interface{}{"role": []string{"user"}, "page": 1}},
+		snapshot: map[string]interface{}{"role": []string{"user"}, "page": 2},
+	}
+	if state.privilegeChanged(DefaultRegenerateKeys) {
+		t.Error("unchanged role regenerates session")
+	}
+	state.Record.Data["role"] = []string{"admin"}
+	if !state.privilegeChanged(DefaultRegenerateKeys) {
+		t.Error("changed role does not regenerate session")
+	}
+	delete(state.Record.Data, "role")
+	if !state.privilegeChanged(DefaultRegenerateKeys) {
+		t.Error("removed role does not regenerate session")
+	}
+}
@@ -0,0 +1,316 @@
+package simplerest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerSimpleRESTBatch", new(SimpleRESTBatch))
+}
+
+const (
+	defaultMaxBatchSize     = 100
+	defaultMaxBatchBodySize = 10 << 20
+)
+
+// A BatchResource is a Resource changing many entities at once, e.g. with multi-row statements.
+// Errors of single entities are returned as BatchError.
+type BatchResource interface {
+	Resource
+	CreateBatch(queries []map[string]interface{}, before, after []Trigger, request *webserver.Request) ([]map[string]interface{}, error)
+	UpdateBatch(queries []map[string]interface{}, before, after []Trigger, request *webserver.Request) ([]map[string]interface{}, error)
+	DeleteBatch(queries []map[string]interface{}, before, after []Trigger, request *webserver.Request) ([]map[string]interface{}, error)
+}
+
+// A Transactional resource runs operations of a request in one transaction, which is rolled
+// back if operation fails. Resources with the same TransactionScope, e.g. the database, join the
+// transactions of each other.
+type Transactional interface {
+	Transaction(request *webserver.Request, operation func() error) error
+	TransactionScope() interface{}
+}
+
+// A BatchError is the error of the entity at Index of a batch
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (err *BatchError) Error() string {
+	return fmt.Sprintf("entity %d: %s", err.Index, err.Err.Error())
+}
+
+func (err *BatchError) Status() int {
+	return errorStatus(err.Err)
+}
+
+// A SimpleRESTBatch runs a JSON array of operations on Resources by their names, like
+//
+//	[{"resource": "users", "method": "create", "entity": {"name": "x"}},
+//	 {"resource": "users", "method": "update", "entity": {"id": 1, "name": "y"}}]
+//
+// Methods are create, update (modifying given fields), replace and delete. Consecutive
+// operations of the same method and resource are run together if the resource is a
+// BatchResource. The operations run in one transaction if the resource of the first operation
+// is Transactional, and batches with operations on resources out of its TransactionScope are
+// rejected with 422, so that no operation is committed when the batch fails.
+//
+// The response has a result with status for each operation. If an operation fails, the
+// response has the status of the failed operation, and other operations not run or rolled back
+// have status 424.
+//
+// Operations call Resources directly, so the PreProcess handlers of their own Locations, like
+// RoleAuth or PolicyAuth, are NOT run. Only list resources every client of the batch Location
+// may change, protect the batch Location itself, and check rows with triggers like
+// PolicyTrigger, which are invoked as usual.
+type SimpleRESTBatch struct {
+	Resources   map[string]*SimpleREST
+	MaxSize     int
+	MaxBodySize int64
+}
+
+type batchOperation struct {
+	Resource string                 `json:"resource"`
+	Method   string                 `json:"method"`
+	Entity   map[string]interface{} `json:"entity"`
+	rest     *SimpleREST
+}
+
+type batchResult struct {
+	Status   int                      `json:"status"`
+	Message  string                   `json:"message,omitempty"`
+	Entities []map[string]interface{} `json:"entities,omitempty"`
+}
+
+func (handler *SimpleRESTBatch) Initialize() error {
+	if len(handler.Resources) == 0 {
+		return errors.New("Missing Resources")
+	}
+	if handler.MaxSize == 0 {
+		handler.MaxSize = defaultMaxBatchSize
+	}
+	if handler.MaxBodySize == 0 {
+		handler.MaxBodySize = defaultMaxBatchBodySize
+	}
+	return nil
+}
+
+func (handler *SimpleRESTBatch) APIMethods() []string {
+	return []string{"POST"}
+}
+
+func (handler *SimpleRESTBatch) Handle(request *webserver.Request) {
+	if request.Method != "POST" {
+		writeBatchError(request, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var operations []*batchOperation
+	decoder := json.NewDecoder(io.LimitReader(request.Body, handler.MaxBodySize))
+	decoder.UseNumber()
+	if err := decoder.Decode(&operations); err != nil {
+		writeBatchError(request, http.StatusBadRequest, "invalid batch: "+err.Error())
+		return
+	} else if len(operations) == 0 {
+		writeBatchError(request, http.StatusUnprocessableEntity, "empty batch")
+		return
+	} else if len(operations) > handler.MaxSize {
+		writeBatchError(request, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("batch size exceeds %d", handler.MaxSize))
+		return
+	}
+	for i, op := range operations {
+		if op == nil {
+			writeBatchError(request, http.StatusUnprocessableEntity, fmt.Sprintf("operation %d: missing", i))
+			return
+		}
+		op.rest = handler.Resources[op.Resource]
+		if op.rest == nil {
+			writeBatchError(request, http.StatusUnprocessableEntity,
+				fmt.Sprintf("operation %d: unknown resource %s", i, op.Resource))
+			return
+		}
+		switch op.Method {
+		case "create", "update", "replace", "delete":
+		default:
+			writeBatchError(request, http.StatusUnprocessableEntity,
+				fmt.Sprintf("operation %d: unknown method %s", i, op.Method))
+			return
+		}
+		op.Entity = normalizeNumbers(op.Entity)
+		if op.Entity == nil {
+			op.Entity = make(map[string]interface{})
+		}
+	}
+	if err := checkTransactionScope(operations); err != nil {
+		writeBatchError(request, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	results := make([]*batchResult, len(operations))
+	failed := -1
+	run := func() error {
+		for i := 0; i < len(operations); {
+			n := handler.group(operations, i)
+			if err := handler.run(operations[i:i+n], results[i:i+n], request); err != nil {
+				for j := i; j < i+n; j++ {
+					if results[j] != nil && results[j].Status != http.StatusFailedDependency {
+						failed = j
+					}
+				}
+				return err
+			}
+			i += n
+		}
+		return nil
+	}
+	var err error
+	transactional, ok := operations[0].rest.Resource.(Transactional)
+	if ok {
+		err = transactional.Transaction(request, run)
+	} else {
+		err = run()
+	}
+	for i, result := range results {
+		if result == nil {
+			results[i] = &batchResult{Status: http.StatusFailedDependency, Message: "not run"}
+		} else if err != nil && ok && i != failed {
+			results[i] = &batchResult{Status: http.StatusFailedDependency, Message: "rolled back"}
+		}
+	}
+	if err != nil {
+		status := errorStatus(err)
+		if status >= 500 {
+			request.Error("Run batch fail: %s", err.Error())
+		} else {
+			request.Info("Run batch fail: %s", err.Error())
+		}
+		webserver.WriteStandardJSONResultWithStatus(request, status, false, "message", err.Error(),
+			"results", results)
+		return
+	}
+	webserver.WriteStandardJSONResult(request, true, "results", results)
+}
+
+// checkTransactionScope checks that all operations share the transaction of the first one
+func checkTransactionScope(operations []*batchOperation) error {
+	first, ok := operations[0].rest.Resource.(Transactional)
+	if !ok {
+		return nil
+	}
+	for i, op := range operations[1:] {
+		if op.rest == operations[0].rest {
+			continue
+		}
+		if transactional, ok := op.rest.Resource.(Transactional); !ok ||
+			transactional.TransactionScope() != first.TransactionScope() {
+			return fmt.Errorf("operation %d: resource %s is out of the transaction of resource %s",
+				i+1, op.Resource, operations[0].Resource)
+		}
+	}
+	return nil
+}
+
+// group returns the count of operations from i to run together
+func (handler *SimpleRESTBatch) group(operations []*batchOperation, i int) int {
+	if _, ok := operations[i].rest.Resource.(BatchResource); !ok {
+		return 1
+	}
+	n := 1
+	for i+n < len(operations) && operations[i+n].rest == operations[i].rest &&
+		operations[i+n].Method == operations[i].Method {
+		n++
+	}
+	return n
+}
+
+// run runs operations of the same method and resource, and fills their results. The result of
+// the failed operation is filled as well.
+func (handler *SimpleRESTBatch) run(operations []*batchOperation, results []*batchResult, request *webserver.Request) error {
+	rest := operations[0].rest
+	method := operations[0].Method
+	if method == "replace" {
+		request.Attr[ReplaceAttrKey] = true
+		defer delete(request.Attr, ReplaceAttrKey)
+	}
+	var entities []map[string]interface{}
+	var err error
+	if batch, ok := rest.Resource.(BatchResource); ok {
+		queries := make([]map[string]interface{}, len(operations))
+		for i, op := range operations {
+			queries[i] = op.Entity
+		}
+		switch method {
+		case "create":
+			entities, err = batch.CreateBatch(queries, rest.Triggers.BeforeCreate, rest.Triggers.AfterCreate, request)
+		case "update", "replace":
+			entities, err = batch.UpdateBatch(queries, rest.Triggers.BeforeUpdate, rest.Triggers.AfterUpdate, request)
+		case "delete":
+			entities, err = batch.DeleteBatch(queries, rest.Triggers.BeforeDelete, rest.Triggers.AfterDelete, request)
+		}
+	} else {
+		var entity map[string]interface{}
+		switch method {
+		case "create":
+			entity, err = rest.Resource.Create(operations[0].Entity, rest.Triggers.BeforeCreate, rest.Triggers.AfterCreate, request)
+		case "update", "replace":
+			entity, err = rest.Resource.Update(operations[0].Entity, rest.Triggers.BeforeUpdate, rest.Triggers.AfterUpdate, request)
+		case "delete":
+			entity, err = rest.Resource.Delete(operations[0].Entity, rest.Triggers.BeforeDelete, rest.Triggers.AfterDelete, request)
+		}
+		if err != nil {
+			err = &BatchError{Index: 0, Err: err}
+		}
+		entities = []map[string]interface{}{entity}
+	}
+	if err != nil {
+		index := 0
+		if batchErr, ok := err.(*BatchError); ok {
+			index = batchErr.Index
+			err = batchErr.Err
+		}
+		for i := 0; i < index; i++ {
+			results[i] = &batchResult{Status: http.StatusFailedDependency, Message: "rolled back"}
+		}
+		results[index] = &batchResult{Status: errorStatus(err), Message: err.Error()}
+		return err
+	}
+	for i := range operations {
+		switch method {
+		case "create":
+			results[i] = &batchResult{Status: http.StatusCreated, Entities: entities[i : i+1]}
+		case "delete":
+			results[i] = &batchResult{Status: http.StatusNoContent}
+		default:
+			results[i] = &batchResult{Status: http.StatusOK, Entities: entities[i : i+1]}
+		}
+	}
+	return nil
+}
+
+// normalizeNumbers converts json numbers to strings, which are decoded by resources
+func normalizeNumbers(entity map[string]interface{}) map[string]interface{} {
+	for key, value := range entity {
+		switch v := value.(type) {
+		case json.Number:
+			entity[key] = string(v)
+		case []interface{}:
+			for i, item := range v {
+				if number, ok := item.(json.Number); ok {
+					v[i] = string(number)
+				}
+			}
+		}
+	}
+	return entity
+}
+
+func writeBatchError(request *webserver.Request, status int, message string) {
+	webserver.WriteStandardJSONResultWithStatus(request, status, false, "message", message)
+	request.Stop()
+}
@@ -0,0 +1,73 @@
+package simplerest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrNotFound is returned by resources when the entity does not exist
+	ErrNotFound = errors.New("entity not found")
+	// ErrConflict is returned by resources when the entity conflicts with an existing one
+	ErrConflict = errors.New("entity conflict")
+)
+
+// A StatusError is an error with the http status to respond, e.g. errors of triggers
+type StatusError interface {
+	error
+	Status() int
+}
+
+// A ValidationError is returned by resources for invalid entity fields
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (err *ValidationError) Error() string {
+	return fmt.Sprintf("invalid field %s: %s", err.Field, err.Message)
+}
+
+func (err *ValidationError) Status() int {
+	return http.StatusUnprocessableEntity
+}
+
+// A TriggerError is returned by resources when a trigger of Operation fails. The status is the
+// status of Err if it is a StatusError, or 422 for failures before the operation and 500 after.
+type TriggerError struct {
+	Operation string
+	Before    bool
+	Err       error
+}
+
+func (err *TriggerError) Error() string {
+	when := "after"
+	if err.Before {
+		when = "before"
+	}
+	return fmt.Sprintf("%s %s trigger fail: %s", when, err.Operation, err.Err.Error())
+}
+
+func (err *TriggerError) Status() int {
+	if statusErr, ok := err.Err.(StatusError); ok {
+		return statusErr.Status()
+	} else if err.Before {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// errorStatus returns the http status of errors returned by resources
+func errorStatus(err error) int {
+	if statusErr, ok := err.(StatusError); ok {
+		return statusErr.Status()
+	}
+	switch err {
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrConflict:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
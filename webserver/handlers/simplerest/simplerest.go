@@ -1,6 +1,8 @@
 package simplerest
 
 import (
+	"net/http"
+
 	"github.com/yangchenxing/cangshan/application"
 	"github.com/yangchenxing/cangshan/logging"
 	"github.com/yangchenxing/cangshan/webserver"
@@ -10,15 +12,46 @@ func init() {
 	application.RegisterModulePrototype("WebServerSimpleREST", new(SimpleREST))
 	application.RegisterBuiltinModule("WebServerSimpleRESTOperationIdentifier",
 		new(SimpleRESTOperationIdentifier))
+	application.RegisterModulePrototype("WebServerSimpleRESTOperationIdentifier",
+		new(SimpleRESTOperationIdentifier))
 }
 
+// Attributes set by SimpleRESTOperationIdentifier
+const (
+	MethodAttrKey  = "simplerest.method"
+	ReplaceAttrKey = "simplerest.replace"
+)
+
+// A Resource is the storage of SimpleREST entities. Get, Update and Delete return ErrNotFound
+// for missing entities, and errors implementing StatusError are responded with their status.
+// Update replaces all modifiable fields if the ReplaceAttrKey attribute is true, or only the
+// given fields otherwise. Delete returns the deleted entity.
 type Resource interface {
 	Get(query map[string]interface{}, request *webserver.Request) (map[string]interface{}, error)
 	Search(query map[string]interface{}, request *webserver.Request) ([]map[string]interface{}, error)
 	Create(query map[string]interface{}, before, after []Trigger, request *webserver.Request) (map[string]interface{}, error)
 	Update(query map[string]interface{}, before, after []Trigger, request *webserver.Request) (map[string]interface{}, error)
+	Delete(query map[string]interface{}, before, after []Trigger, request *webserver.Request) (map[string]interface{}, error)
 }
 
+// A Page is a page of search results. Total is the count of all matched entities, and Next is
+// the cursor of the following page, empty if the page is not full.
+type Page struct {
+	Entities []map[string]interface{}
+	Total    int64
+	Limit    int
+	Offset   int
+	Next     string
+}
+
+// A PageSearcher is a Resource searching entities by pages. SimpleREST responds the page
+// metadata with the entities if the resource is a PageSearcher.
+type PageSearcher interface {
+	SearchPage(query map[string]interface{}, request *webserver.Request) (*Page, error)
+}
+
+// A Trigger is invoked before or after entity changes. The old entity is nil on creation, and
+// the new entity is nil on deletion.
 type Trigger interface {
 	Handle(table string, oldEntity, newEntity map[string]interface{}, request *webserver.Request) error
 }
@@ -30,79 +63,166 @@ type SimpleREST struct {
 		AfterCreate  []Trigger
 		BeforeUpdate []Trigger
 		AfterUpdate  []Trigger
+		BeforeDelete []Trigger
+		AfterDelete  []Trigger
 	}
 }
 
 func (handler SimpleREST) Handle(request *webserver.Request) {
-	method, ok := request.Attr["simplerest.method"].(string)
+	method, ok := request.Attr[MethodAttrKey].(string)
 	if !ok {
-		logging.Error("Missing attribute: simplerest.method")
+		logging.Error("Missing attribute: %s", MethodAttrKey)
 		request.WriteAndStop(500, nil, "")
+		return
 	}
 	switch method {
 	case "Get":
 		entity, err := handler.Resource.Get(request.Param, request)
+		if err == nil && entity == nil {
+			err = ErrNotFound
+		}
 		if err != nil {
-			logging.Error("Get entity fail: %s", err.Error())
-			webserver.WriteStandardJSONResult(request, false, "message", err.Error())
-		} else if entity == nil {
-			webserver.WriteStandardJSONResult(request, true, "entities", []interface{}{})
+			writeError(request, "Get", err)
 		} else {
 			webserver.WriteStandardJSONResult(request, true, "entities", []interface{}{entity})
 		}
 	case "Search":
+		if searcher, ok := handler.Resource.(PageSearcher); ok {
+			handler.searchPage(searcher, request)
+			return
+		}
 		entities, err := handler.Resource.Search(request.Param, request)
 		if err != nil {
-			logging.Error("Search entity fail: %s", err.Error())
-			webserver.WriteStandardJSONResult(request, false, "message", err.Error())
+			writeError(request, "Search", err)
 		} else {
+			if entities == nil {
+				entities = []map[string]interface{}{}
+			}
 			webserver.WriteStandardJSONResult(request, true, "entities", entities)
 		}
 	case "Create":
 		entity, err := handler.Resource.Create(request.Param,
 			handler.Triggers.BeforeCreate, handler.Triggers.AfterCreate, request)
 		if err != nil {
-			logging.Error("Search entity fail: %s", err.Error())
-			webserver.WriteStandardJSONResult(request, false, "message", err.Error())
+			writeError(request, "Create", err)
 		} else {
-			webserver.WriteStandardJSONResult(request, true, "entities", []interface{}{entity})
+			webserver.WriteStandardJSONResultWithStatus(request, http.StatusCreated, true,
+				"entities", []interface{}{entity})
 		}
 	case "Update":
-		entity, err := handler.Resource.Create(request.Param,
+		entity, err := handler.Resource.Update(request.Param,
 			handler.Triggers.BeforeUpdate, handler.Triggers.AfterUpdate, request)
 		if err != nil {
-			logging.Error("Update entity fail: %s", err.Error())
-			webserver.WriteStandardJSONResult(request, false, "message", err.Error())
+			writeError(request, "Update", err)
 		} else {
 			webserver.WriteStandardJSONResult(request, true, "entities", []interface{}{entity})
 		}
+	case "Delete":
+		if _, err := handler.Resource.Delete(request.Param,
+			handler.Triggers.BeforeDelete, handler.Triggers.AfterDelete, request); err != nil {
+			writeError(request, "Delete", err)
+		} else {
+			request.Write(http.StatusNoContent, nil, "")
+		}
 	default:
-		logging.Error("Unknown simplerest.method: %s", method)
+		logging.Error("Unknown %s: %s", MethodAttrKey, method)
 		request.WriteAndStop(500, nil, "")
 	}
 }
 
-type SimpleRESTOperationIdentifier struct{}
+func (handler SimpleREST) searchPage(searcher PageSearcher, request *webserver.Request) {
+	page, err := searcher.SearchPage(request.Param, request)
+	if err != nil {
+		writeError(request, "Search", err)
+		return
+	}
+	if page.Entities == nil {
+		page.Entities = []map[string]interface{}{}
+	}
+	params := []interface{}{"entities", page.Entities, "total", page.Total, "limit", page.Limit,
+		"offset", page.Offset}
+	if page.Next != "" {
+		params = append(params, "next", page.Next)
+	}
+	webserver.WriteStandardJSONResult(request, true, params...)
+}
+
+func writeError(request *webserver.Request, method string, err error) {
+	status := errorStatus(err)
+	if status >= 500 {
+		request.Error("%s entity fail: %s", method, err.Error())
+	} else {
+		request.Info("%s entity fail: %s", method, err.Error())
+	}
+	webserver.WriteStandardJSONResultWithStatus(request, status, false, "message", err.Error())
+}
+
+// DescribeAPI delegates OpenAPI description to the resource if supported
+func (handler SimpleREST) DescribeAPI(op *webserver.APIOperation) {
+	if describer, ok := handler.Resource.(webserver.APIDescriber); ok {
+		describer.DescribeAPI(op)
+	}
+}
+
+// A SimpleRESTOperationIdentifier maps REST verbs to SimpleREST methods. Requests on entities
+// are identified by KeyParams, DefaultKeyParams if empty, captured by the location path, e.g.
+// "^/users/(?P<id>\d+)$", while other captures like "^/users/(?P<user>\d+)/posts$" are
+// collection filters:
+//
+//	GET    collection: Search   entity: Get
+//	POST   collection: Create
+//	PUT                         entity: Update, replacing all modifiable fields
+//	PATCH                       entity: Update, modifying given fields
+//	DELETE                      entity: Delete
+//
+// Path parameters override the same parameters in the query or body. Other requests stop with 405.
+type SimpleRESTOperationIdentifier struct {
+	KeyParams []string
+}
+
+// DefaultKeyParams are the key params of SimpleRESTOperationIdentifier without KeyParams
+var DefaultKeyParams = []string{"id"}
+
+func (handler SimpleRESTOperationIdentifier) APIMethods() []string {
+	return []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+}
 
 func (handler SimpleRESTOperationIdentifier) Handle(request *webserver.Request) {
-	switch request.Method {
-	case "GET":
-		if len(request.Param) > 0 {
-			request.Attr["simplerest.method"] = "Get"
-			request.Debug("identify simplerest method: Get")
-		} else {
-			request.Attr["simplerest.method"] = "Search"
-			request.Debug("identify simplerest method: Search")
-		}
-	case "POST":
-		if len(request.Param) > 0 {
-			request.Attr["simplerest.method"] = "Update"
-			request.Debug("identify simplerest method: Update")
-		} else {
-			request.Attr["simplerest.method"] = "Create"
-			request.Debug("identify simplerest method: Create")
+	pathParams, _ := request.Attr[webserver.PathParamsAttrKey].(map[string]string)
+	for name, value := range pathParams {
+		request.Param[name] = value
+	}
+	keyParams := handler.KeyParams
+	if len(keyParams) == 0 {
+		keyParams = DefaultKeyParams
+	}
+	entity := true
+	for _, name := range keyParams {
+		if _, found := pathParams[name]; !found {
+			entity = false
 		}
+	}
+	var method string
+	switch {
+	case request.Method == "GET" && entity:
+		method = "Get"
+	case request.Method == "GET":
+		method = "Search"
+	case request.Method == "POST" && !entity:
+		method = "Create"
+	case request.Method == "PUT" && entity:
+		method = "Update"
+		request.Attr[ReplaceAttrKey] = true
+	case request.Method == "PATCH" && entity:
+		method = "Update"
+	case request.Method == "DELETE" && entity:
+		method = "Delete"
 	default:
-		request.WriteAndStop(405, nil, "")
+		webserver.WriteStandardJSONResultWithStatus(request, http.StatusMethodNotAllowed, false,
+			"message", "method not allowed")
+		request.Stop()
+		return
 	}
+	request.Attr[MethodAttrKey] = method
+	request.Debug("identify simplerest method: %s", method)
 }
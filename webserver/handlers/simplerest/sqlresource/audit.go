@@ -0,0 +1,266 @@
+package sqlresource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	msgq "github.com/yangchenxing/cangshan/client/messagequeue"
+	"github.com/yangchenxing/cangshan/client/sql"
+	"github.com/yangchenxing/cangshan/logging"
+	"github.com/yangchenxing/cangshan/webserver"
+	"github.com/yangchenxing/cangshan/webserver/handlers/session"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerSimpleRESTSQLAuditTrigger", new(AuditTrigger))
+}
+
+const (
+	// DefaultUserKey is the session value of the user changing entities
+	DefaultUserKey = "user"
+
+	defaultAuditMessageType = "audit"
+)
+
+func (res *Resource) initializeAudit() error {
+	if res.SessionKey == "" {
+		res.SessionKey = session.DefaultSessionAttrKey
+	}
+	if res.UserKey == "" {
+		res.UserKey = DefaultUserKey
+	}
+	for _, name := range []string{res.SoftDeleteField, res.CreatedAtField, res.UpdatedAtField,
+		res.CreatedByField, res.UpdatedByField} {
+		if f, found := res.Fields[name]; name != "" && (!found || f.PrimaryKey) {
+			return fmt.Errorf("Invalid audit field: %s", name)
+		}
+	}
+	return nil
+}
+
+// RequestUser returns the user in the session of the request, or the authenticated user set by
+// auth handlers, or nil if there is none.
+func RequestUser(request *webserver.Request, sessionKey, userKey string) interface{} {
+	if sess, ok := request.Attr[sessionKey].(map[string]interface{}); ok && sess[userKey] != nil {
+		return fmt.Sprint(sess[userKey])
+	}
+	if user, ok := request.Attr["request.user"].(string); ok && user != "" && user != "-" {
+		return user
+	}
+	return nil
+}
+
+// stampCreate sets audit fields of a new entity, overriding the given values
+func (res *Resource) stampCreate(param map[string]interface{}, request *webserver.Request) {
+	now := time.Now()
+	user := RequestUser(request, res.SessionKey, res.UserKey)
+	for name, value := range map[string]interface{}{
+		res.CreatedAtField: now,
+		res.UpdatedAtField: now,
+		res.CreatedByField: user,
+		res.UpdatedByField: user,
+	} {
+		if name != "" {
+			param[name] = value
+		}
+	}
+	if res.SoftDeleteField != "" {
+		delete(param, res.SoftDeleteField)
+	}
+}
+
+// stampUpdate sets audit fields of a modified entity, and removes the fields set on creation
+func (res *Resource) stampUpdate(param map[string]interface{}, request *webserver.Request) {
+	for _, name := range []string{res.CreatedAtField, res.CreatedByField, res.SoftDeleteField} {
+		if name != "" {
+			delete(param, name)
+		}
+	}
+	if res.UpdatedAtField != "" {
+		param[res.UpdatedAtField] = time.Now()
+	}
+	if res.UpdatedByField != "" {
+		param[res.UpdatedByField] = RequestUser(request, res.SessionKey, res.UserKey)
+	}
+}
+
+// notDeleted returns the condition excluding soft deleted entities, or empty if soft deletion is
+// disabled
+func (res *Resource) notDeleted() string {
+	if res.SoftDeleteField == "" {
+		return ""
+	}
+	return res.SoftDeleteField + " IS NULL"
+}
+
+// An AuditTrigger records changes of entities to the audit Table of DB, or publishes them to
+// MessageQueue with MessageType (default "audit") after the request succeeds. Use it as an after
+// trigger of creation, update and deletion. Records join the transaction of the change if it is
+// on DB, otherwise they are inserted on their own and kept if the change is rolled back.
+//
+// The audit table has columns resource, entity_key, action, actor, changed_at, old_values and
+// new_values, where entity_key is the comma separated KeyFields (default "id") and the values
+// are JSON objects of the changed fields.
+type AuditTrigger struct {
+	DB           *sql.DB
+	Table        string
+	MessageQueue msgq.MessageQueue
+	MessageType  string
+	KeyFields    []string
+	SessionKey   string
+	UserKey      string
+}
+
+// An AuditRecord is a change of an entity
+type AuditRecord struct {
+	Resource  string                 `json:"resource"`
+	EntityKey string                 `json:"entityKey"`
+	Action    string                 `json:"action"`
+	Actor     interface{}            `json:"actor"`
+	ChangedAt time.Time              `json:"changedAt"`
+	Old       map[string]interface{} `json:"old"`
+	New       map[string]interface{} `json:"new"`
+}
+
+func (trigger *AuditTrigger) Initialize() error {
+	if trigger.DB == nil && trigger.MessageQueue == nil {
+		return errors.New("Missing DB or MessageQueue")
+	}
+	if trigger.DB != nil && trigger.Table == "" {
+		return errors.New("Missing Table")
+	}
+	if trigger.MessageType == "" {
+		trigger.MessageType = defaultAuditMessageType
+	}
+	if len(trigger.KeyFields) == 0 {
+		trigger.KeyFields = []string{"id"}
+	}
+	if trigger.SessionKey == "" {
+		trigger.SessionKey = session.DefaultSessionAttrKey
+	}
+	if trigger.UserKey == "" {
+		trigger.UserKey = DefaultUserKey
+	}
+	return nil
+}
+
+func (trigger *AuditTrigger) Handle(table string, oldEntity, newEntity map[string]interface{}, request *webserver.Request) error {
+	record := &AuditRecord{
+		Resource:  table,
+		Actor:     RequestUser(request, trigger.SessionKey, trigger.UserKey),
+		ChangedAt: time.Now(),
+		Old:       make(map[string]interface{}),
+		New:       make(map[string]interface{}),
+	}
+	entity := newEntity
+	switch {
+	case oldEntity == nil:
+		record.Action = "create"
+		for name, value := range newEntity {
+			record.New[name] = value
+		}
+	case newEntity == nil:
+		record.Action = "delete"
+		entity = oldEntity
+		for name, value := range oldEntity {
+			record.Old[name] = value
+		}
+	default:
+		record.Action = "update"
+		for name, value := range newEntity {
+			if !reflect.DeepEqual(oldEntity[name], value) {
+				record.Old[name] = oldEntity[name]
+				record.New[name] = value
+			}
+		}
+		if len(record.New) == 0 {
+			return nil
+		}
+	}
+	keys := make([]string, len(trigger.KeyFields))
+	for i, name := range trigger.KeyFields {
+		keys[i] = fmt.Sprint(entity[name])
+	}
+	record.EntityKey = strings.Join(keys, ",")
+	if trigger.DB != nil {
+		if err := trigger.insert(record, request); err != nil {
+			return err
+		}
+	}
+	if trigger.MessageQueue != nil {
+		trigger.publish(record, request)
+	}
+	return nil
+}
+
+func (trigger *AuditTrigger) insert(record *AuditRecord, request *webserver.Request) error {
+	oldValues, err := json.Marshal(record.Old)
+	if err != nil {
+		return fmt.Errorf("Marshal audit values fail: %s", err.Error())
+	}
+	newValues, err := json.Marshal(record.New)
+	if err != nil {
+		return fmt.Errorf("Marshal audit values fail: %s", err.Error())
+	}
+	// only a transaction on the audit DB is joined, the resource may be on another DB
+	var db querier
+	if tx := RequestTx(request, trigger.DB); tx != nil {
+		db = tx
+	} else {
+		db = trigger.DB.WithSpan(request.Span())
+	}
+	if _, err := db.Exec(fmt.Sprintf("INSERT INTO %s(resource, entity_key, action, actor, changed_at, "+
+		"old_values, new_values) VALUES(?, ?, ?, ?, ?, ?, ?)", trigger.Table), record.Resource,
+		record.EntityKey, record.Action, record.Actor, record.ChangedAt, string(oldValues),
+		string(newValues)); err != nil {
+		return fmt.Errorf("Insert audit record fail: %s", err.Error())
+	}
+	return nil
+}
+
+// publish publishes the record when the request finishes successfully, so that rolled back
+// changes are not published
+func (trigger *AuditTrigger) publish(record *AuditRecord, request *webserver.Request) {
+	request.OnFinish(func() {
+		if request.Status() >= 400 {
+			return
+		}
+		body, err := json.Marshal(record)
+		if err != nil {
+			logging.Error("Marshal audit record fail: %s", err.Error())
+			return
+		}
+		if err := trigger.MessageQueue.Publish(&msgq.Message{
+			Type:   trigger.MessageType,
+			Header: map[string]interface{}{"resource": record.Resource, "action": record.Action},
+			Body:   body,
+		}); err != nil {
+			logging.Error("Publish audit record fail: %s", err.Error())
+		}
+	})
+}
+
+// softDeleteStatement returns the statement marking the entity matching conditions deleted
+func (res *Resource) softDeleteStatement(conditions []string, conditionValues []interface{}, request *webserver.Request) (string, []interface{}) {
+	fields := []string{res.SoftDeleteField + "=?"}
+	values := []interface{}{time.Now()}
+	if res.VersionField != "" {
+		fields = append(fields, res.VersionField+"="+res.VersionField+"+1")
+	}
+	if res.UpdatedAtField != "" {
+		fields = append(fields, res.UpdatedAtField+"=?")
+		values = append(values, values[0])
+	}
+	if res.UpdatedByField != "" {
+		fields = append(fields, res.UpdatedByField+"=?")
+		values = append(values, RequestUser(request, res.SessionKey, res.UserKey))
+	}
+	conditions = append(conditions, res.notDeleted())
+	return fmt.Sprintf("UPDATE %s SET %s WHERE %s", res.Name, strings.Join(fields, ", "),
+		strings.Join(conditions, " AND ")), append(values, conditionValues...)
+}
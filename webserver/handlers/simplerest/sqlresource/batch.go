@@ -0,0 +1,179 @@
+package sqlresource
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/yangchenxing/cangshan/client/sql"
+	"github.com/yangchenxing/cangshan/logging"
+	"github.com/yangchenxing/cangshan/webserver"
+	"github.com/yangchenxing/cangshan/webserver/handlers/simplerest"
+)
+
+var errTransactionFail = errors.New("Transaction fail")
+
+// maxInsertArgs limits the arguments of a multi-row INSERT, below the 999 of old sqlite
+const maxInsertArgs = 900
+
+// TransactionScope returns the DB, as resources join transactions on the same DB
+func (res *Resource) TransactionScope() interface{} {
+	return res.DB
+}
+
+// Transaction runs operation in the transaction of the request, see RequestTx
+func (res *Resource) Transaction(request *webserver.Request, operation func() error) error {
+	_, err := res.transaction(request, errTransactionFail, func(tx *sql.Tx) (map[string]interface{}, error) {
+		return nil, operation()
+	})
+	return err
+}
+
+// CreateBatch inserts the entities and invokes triggers in a transaction. Consecutive entities
+// with the same fields are inserted by multi-row INSERT, unless the primary key is auto increment.
+func (res *Resource) CreateBatch(params []map[string]interface{}, before, after []simplerest.Trigger, request *webserver.Request) ([]map[string]interface{}, error) {
+	for i, param := range params {
+		params[i] = res.filterParam(param)
+		if err := res.DecodeParams(params[i], request); err != nil {
+			return nil, &simplerest.BatchError{Index: i, Err: err}
+		}
+	}
+	var entities []map[string]interface{}
+	err := res.Transaction(request, func() error {
+		tx := RequestTx(request, res.DB)
+		var err error
+		entities, err = res.createBatch(tx, params, before, after, request)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+func (res *Resource) createBatch(tx *sql.Tx, params []map[string]interface{}, before, after []simplerest.Trigger, request *webserver.Request) ([]map[string]interface{}, error) {
+	rows := make([]*insertedRow, len(params))
+	for i, param := range params {
+		res.stampCreate(param, request)
+		for _, trigger := range before {
+			if err := trigger.Handle(res.Name, nil, param, request); err != nil {
+				logging.Error("invoke trigger before create of resource %s fail: %s", res.Name, err.Error())
+				return nil, &simplerest.BatchError{Index: i,
+					Err: &simplerest.TriggerError{Operation: "create", Before: true, Err: err}}
+			}
+		}
+		row, err := res.insertion(param)
+		if err != nil {
+			return nil, &simplerest.BatchError{Index: i, Err: err}
+		}
+		rows[i] = row
+	}
+	if len(rows) > 0 && rows[0].autoKeyName != "" {
+		// keys of multi-row inserts are not reported by all drivers
+		entities := make([]map[string]interface{}, len(params))
+		for i, param := range params {
+			entity, err := res.create(tx, param, nil, after, request)
+			if err != nil {
+				return nil, &simplerest.BatchError{Index: i, Err: err}
+			}
+			entities[i] = entity
+		}
+		return entities, nil
+	}
+	for start := 0; start < len(rows); {
+		end := start + 1
+		for end < len(rows) && end-start < maxInsertArgs/len(rows[start].values) &&
+			strings.Join(rows[end].fieldNames, ",") == strings.Join(rows[start].fieldNames, ",") {
+			end++
+		}
+		if err := res.insertRows(tx, rows[start:end]); err != nil {
+			return nil, &simplerest.BatchError{Index: start, Err: err}
+		}
+		start = end
+	}
+	entities := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		entity, err := res.Get(row.keys, request)
+		if err != nil || entity == nil {
+			return nil, &simplerest.BatchError{Index: i, Err: errCreateFail}
+		}
+		if entities[i], err = res.afterCreate(entity, after, request); err != nil {
+			return nil, &simplerest.BatchError{Index: i, Err: err}
+		}
+	}
+	return entities, nil
+}
+
+// insertRows inserts rows with the same fields by one statement
+func (res *Resource) insertRows(tx *sql.Tx, rows []*insertedRow) error {
+	placeholder := "(?" + strings.Repeat(", ?", len(rows[0].values)-1) + ")"
+	placeholders := make([]string, len(rows))
+	values := make([]interface{}, 0, len(rows)*len(rows[0].values))
+	for i, row := range rows {
+		placeholders[i] = placeholder
+		values = append(values, row.values...)
+	}
+	statement := fmt.Sprintf("INSERT INTO %s(%s) VALUES%s", res.Name,
+		strings.Join(rows[0].fieldNames, ", "), strings.Join(placeholders, ", "))
+	if _, err := tx.Exec(statement, values...); err != nil {
+		if isDuplicateKeyError(err) {
+			return simplerest.ErrConflict
+		}
+		logging.Error("Insert %s entities fail: %s", res.Name, err.Error())
+		return errCreateFail
+	}
+	return nil
+}
+
+// UpdateBatch updates the entities like Update in a transaction
+func (res *Resource) UpdateBatch(params []map[string]interface{}, before, after []simplerest.Trigger, request *webserver.Request) ([]map[string]interface{}, error) {
+	keys := make([]map[string]interface{}, len(params))
+	for i, param := range params {
+		var err error
+		if params[i], keys[i], err = res.updateParam(param, request); err != nil {
+			return nil, &simplerest.BatchError{Index: i, Err: err}
+		}
+	}
+	entities := make([]map[string]interface{}, len(params))
+	err := res.Transaction(request, func() error {
+		tx := RequestTx(request, res.DB)
+		for i, param := range params {
+			entity, err := res.update(tx, keys[i], param, before, after, request)
+			if err != nil {
+				return &simplerest.BatchError{Index: i, Err: err}
+			}
+			entities[i] = entity
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+// DeleteBatch deletes the entities like Delete in a transaction
+func (res *Resource) DeleteBatch(params []map[string]interface{}, before, after []simplerest.Trigger, request *webserver.Request) ([]map[string]interface{}, error) {
+	for i, param := range params {
+		params[i] = res.filterParam(param)
+		if err := res.DecodeParams(params[i], request); err != nil {
+			return nil, &simplerest.BatchError{Index: i, Err: err}
+		}
+	}
+	entities := make([]map[string]interface{}, len(params))
+	err := res.Transaction(request, func() error {
+		tx := RequestTx(request, res.DB)
+		for i, param := range params {
+			entity, err := res.delete(tx, param, before, after, request)
+			if err != nil {
+				return &simplerest.BatchError{Index: i, Err: err}
+			}
+			entities[i] = entity
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
@@ -0,0 +1,92 @@
+package sqlresource
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+)
+
+func init() {
+	application.RegisterBuiltinModule("SimpleREST.SQLResource.UUIDGenerater", new(UUIDGenerater))
+	application.RegisterModulePrototype("SimpleRESTSQLResourceSnowflakeGenerater", new(SnowflakeGenerater))
+}
+
+// UUIDGenerater generates random (version 4) UUIDs for UUIDType keys
+type UUIDGenerater struct{}
+
+func (generater UUIDGenerater) Generate() (interface{}, error) {
+	return NewUUID()
+}
+
+// NewUUID returns a random (version 4) UUID
+func NewUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("Read random fail: %s", err.Error())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+	snowflakeMaxNode      = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSequence  = 1<<snowflakeSequenceBits - 1
+	// 2020-01-01T00:00:00Z
+	defaultSnowflakeEpoch = 1577836800000
+)
+
+// SnowflakeGenerater generates int64 keys ordered by time, made of 41 bits of milliseconds since
+// Epoch (unix milliseconds, default 2020-01-01), 10 bits of Node and 12 bits of sequence. Each
+// process generating keys of the same table must have a distinct Node.
+type SnowflakeGenerater struct {
+	sync.Mutex
+	Epoch    int64
+	Node     int64
+	last     int64
+	sequence int64
+}
+
+func (generater *SnowflakeGenerater) Initialize() error {
+	if generater.Epoch == 0 {
+		generater.Epoch = defaultSnowflakeEpoch
+	}
+	if generater.Node < 0 || generater.Node > snowflakeMaxNode {
+		return fmt.Errorf("Invalid Node: %d", generater.Node)
+	}
+	return nil
+}
+
+func (generater *SnowflakeGenerater) Generate() (interface{}, error) {
+	generater.Lock()
+	defer generater.Unlock()
+	now := time.Now().UnixNano()/int64(time.Millisecond) - generater.Epoch
+	if now < generater.last {
+		// the clock moved backwards, keep generating in the last millisecond
+		now = generater.last
+	}
+	if now == generater.last {
+		generater.sequence = (generater.sequence + 1) & snowflakeMaxSequence
+		if generater.sequence == 0 {
+			// sequence exhausted, wait for the next millisecond
+			for now <= generater.last {
+				time.Sleep(100 * time.Microsecond)
+				now = time.Now().UnixNano()/int64(time.Millisecond) - generater.Epoch
+			}
+		}
+	} else {
+		generater.sequence = 0
+	}
+	if now < 0 || now >= 1<<41 {
+		return nil, errors.New("Time out of snowflake range")
+	}
+	generater.last = now
+	return now<<(snowflakeNodeBits+snowflakeSequenceBits) | generater.Node<<snowflakeSequenceBits |
+		generater.sequence, nil
+}
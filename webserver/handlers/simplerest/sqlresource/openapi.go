@@ -0,0 +1,129 @@
+package sqlresource
+
+import (
+	"sort"
+
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+// An APISchemaType is a Type that describes its OpenAPI schema
+type APISchemaType interface {
+	APISchema() map[string]interface{}
+}
+
+func typeAPISchema(t Type) map[string]interface{} {
+	switch v := t.(type) {
+	case APISchemaType:
+		return v.APISchema()
+	case Int64Type, *Int64Type:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case NullInt64Type, *NullInt64Type:
+		return map[string]interface{}{"type": "integer", "format": "int64", "nullable": true}
+	case Float64Type, *Float64Type:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case NullFloat64Type, *NullFloat64Type:
+		return map[string]interface{}{"type": "number", "format": "double", "nullable": true}
+	case BoolType, *BoolType:
+		return map[string]interface{}{"type": "boolean"}
+	case NullBoolType, *NullBoolType:
+		return map[string]interface{}{"type": "boolean", "nullable": true}
+	case NullStringType, *NullStringType:
+		return map[string]interface{}{"type": "string", "nullable": true}
+	case NullTime:
+		return nullTimeAPISchema(v)
+	case *NullTime:
+		return nullTimeAPISchema(*v)
+	}
+	return map[string]interface{}{"type": "string"}
+}
+
+func nullTimeAPISchema(t NullTime) map[string]interface{} {
+	schema := map[string]interface{}{"type": "string", "nullable": true}
+	if t.Format == "" {
+		schema["format"] = "date-time"
+	} else {
+		schema["x-format"] = t.Format
+	}
+	return schema
+}
+
+func (res *Resource) sortedFieldNames() []string {
+	names := make([]string, 0, len(res.Fields))
+	for name := range res.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DescribeAPI adds the entity schema of the resource and the parameters of the operation
+func (res *Resource) DescribeAPI(op *webserver.APIOperation) {
+	properties := make(map[string]interface{})
+	keys := make([]string, 0, 1)
+	for _, name := range res.sortedFieldNames() {
+		f := res.Fields[name]
+		properties[name] = typeAPISchema(f.Type)
+		if f.PrimaryKey {
+			keys = append(keys, name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(keys) > 0 {
+		schema["required"] = keys
+	}
+	op.Schemas[res.Name] = schema
+	ref := map[string]interface{}{"$ref": "#/components/schemas/" + res.Name}
+	switch op.Method {
+	case "GET", "HEAD":
+		search := true
+		for _, name := range res.sortedFieldNames() {
+			in := "query"
+			if op.HasPathParameter(name) {
+				in = "path"
+				search = false
+			}
+			op.AddParameter(name, in, false, typeAPISchema(res.Fields[name].Type), "")
+		}
+		if search {
+			integer := map[string]interface{}{"type": "integer"}
+			text := map[string]interface{}{"type": "string"}
+			op.AddParameter(LimitParam, "query", false, integer, "max count of entities")
+			op.AddParameter(OffsetParam, "query", false, integer, "count of entities to skip")
+			op.AddParameter(CursorParam, "query", false, text, "next cursor of the previous page")
+			op.AddParameter(SortParam, "query", false, text, "sort fields like -created,name")
+			op.AddParameter(FieldsParam, "query", false, text, "comma separated fields to respond")
+		}
+		if res.expandable() {
+			op.AddParameter(ExpandParam, "query", false, map[string]interface{}{"type": "string"},
+				"comma separated relations to embed")
+		}
+	case "DELETE":
+		op.RequestBody = nil
+		op.Responses["204"] = map[string]interface{}{"description": res.Name + " entity deleted"}
+		op.SetJSONResponse("404", res.Name+" entity not found", nil)
+		return
+	default:
+		body := make(map[string]interface{})
+		for _, name := range res.sortedFieldNames() {
+			if f := res.Fields[name]; f.Creatable || f.Modifiable || f.PrimaryKey {
+				body[name] = typeAPISchema(f.Type)
+			}
+		}
+		schema := map[string]interface{}{"type": "object", "properties": body}
+		op.RequestBody = map[string]interface{}{
+			"content": map[string]interface{}{
+				"application/json":                  map[string]interface{}{"schema": schema},
+				"application/x-www-form-urlencoded": map[string]interface{}{"schema": schema},
+			},
+		}
+		op.SetJSONResponse("422", "invalid "+res.Name+" entity", nil)
+	}
+	status := "200"
+	if op.Method == "POST" {
+		status = "201"
+	}
+	op.SetJSONResponse(status, res.Name+" entities", map[string]interface{}{
+		"type":  "array",
+		"items": ref,
+	})
+}
@@ -0,0 +1,240 @@
+package sqlresource
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/yangchenxing/cangshan/logging"
+	"github.com/yangchenxing/cangshan/webserver"
+	"github.com/yangchenxing/cangshan/webserver/handlers/simplerest"
+)
+
+// ExpandParam is the comma separated relations to embed into Get and Search results
+const ExpandParam = "expand"
+
+// Relation kinds
+const (
+	BelongsTo = "belongsTo"
+	HasMany   = "hasMany"
+)
+
+const (
+	// maxExpandKeys limits the keys of a query loading related entities
+	maxExpandKeys = 500
+	// defaultRelationLimit is the default max count of related entities of HasMany relations
+	defaultRelationLimit = 100
+)
+
+var relationFilterPattern = regexp.MustCompile(`^(\w+)\.(\w+)(?:\[(\w+)\])?$`)
+
+// A Relation relates entities to entities of another Resource. For BelongsTo, ForeignKey is the
+// field of this resource referencing the primary key of Resource, and the related entity is
+// embedded as an object, or null. For HasMany, ForeignKey is the field of Resource referencing
+// the primary key of this resource, and the related entities are embedded as an array of at
+// most Limit entities, 100 by default, with the least primary keys if Resource has one.
+//
+// Relations are embedded only if Expandable, as related entities are loaded directly without
+// the triggers or policies of Locations serving Resource, so only relations readable by every
+// client of this resource should be expandable.
+type Relation struct {
+	Kind       string
+	Resource   *Resource
+	ForeignKey string
+	Expandable bool
+	Limit      int
+}
+
+func (res *Resource) initializeRelations() error {
+	for name, relation := range res.Relations {
+		if _, found := res.Fields[name]; found {
+			return fmt.Errorf("Relation %s conflicts with field", name)
+		} else if relation.Resource == nil {
+			return fmt.Errorf("Missing Resource of relation %s", name)
+		}
+		var referenced *Resource
+		switch relation.Kind {
+		case BelongsTo:
+			if _, found := res.Fields[relation.ForeignKey]; !found {
+				return fmt.Errorf("Invalid ForeignKey of relation %s: %s", name, relation.ForeignKey)
+			}
+			referenced = relation.Resource
+		case HasMany:
+			if _, found := relation.Resource.Fields[relation.ForeignKey]; !found {
+				return fmt.Errorf("Invalid ForeignKey of relation %s: %s", name, relation.ForeignKey)
+			}
+			referenced = res
+		default:
+			return fmt.Errorf("Invalid Kind of relation %s: %s", name, relation.Kind)
+		}
+		if referenced.primaryKey() == "" {
+			return fmt.Errorf("Resource %s of relation %s must have one primary key", referenced.Name, name)
+		}
+		if relation.Limit == 0 {
+			relation.Limit = defaultRelationLimit
+		}
+	}
+	return nil
+}
+
+// expandable reports whether any relation can be expanded
+func (res *Resource) expandable() bool {
+	for _, relation := range res.Relations {
+		if relation.Expandable {
+			return true
+		}
+	}
+	return false
+}
+
+// primaryKey returns the name of the single primary key, or empty if there are none or many
+func (res *Resource) primaryKey() string {
+	key := ""
+	for name, f := range res.Fields {
+		if f.PrimaryKey {
+			if key != "" {
+				return ""
+			}
+			key = name
+		}
+	}
+	return key
+}
+
+// keys returns the fields of this resource and of the related resource joining the relation
+func (relation *Relation) keys(res *Resource) (string, string) {
+	if relation.Kind == BelongsTo {
+		return relation.ForeignKey, relation.Resource.primaryKey()
+	}
+	return res.primaryKey(), relation.ForeignKey
+}
+
+func (res *Resource) parseExpand(param map[string]interface{}) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(paramString(param, ExpandParam), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		} else if relation, found := res.Relations[name]; !found {
+			return nil, &simplerest.ValidationError{Field: ExpandParam, Message: "unknown relation " + name}
+		} else if !relation.Expandable {
+			return nil, &simplerest.ValidationError{Field: ExpandParam, Message: "relation " + name + " is not expandable"}
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// addRelationFilter adds filters like "author.name[like]=a%" as subqueries on the related
+// resource. Entities of HasMany relations match if any related entity matches.
+func (query *searchQuery) addRelationFilter(res *Resource, name, field, op string, value interface{}) error {
+	relation := res.Relations[name]
+	f, found := relation.Resource.Fields[field]
+	if !found {
+		return &simplerest.ValidationError{Field: name + "." + field, Message: "unknown field"}
+	}
+	sub := new(searchQuery)
+	if err := sub.addFilter(field, op, f.Type, value); err != nil {
+		return err
+	}
+	if condition := relation.Resource.notDeleted(); condition != "" {
+		sub.conditions = append(sub.conditions, condition)
+	}
+	local, remote := relation.keys(res)
+	query.conditions = append(query.conditions, fmt.Sprintf("%s IN (SELECT %s FROM %s WHERE %s)",
+		local, remote, relation.Resource.Name, strings.Join(sub.conditions, " AND ")))
+	query.args = append(query.args, sub.args...)
+	return nil
+}
+
+// expand embeds related entities into entities, with one query for each relation and each
+// maxExpandKeys keys. Rows are the entities with their key fields, which may not be projected.
+func (res *Resource) expand(entities, rows []map[string]interface{}, names []string, request *webserver.Request) error {
+	for _, name := range names {
+		relation := res.Relations[name]
+		local, remote := relation.keys(res)
+		var keys []interface{}
+		seen := make(map[string]bool)
+		for _, row := range rows {
+			if key := row[local]; key != nil && !seen[fmt.Sprint(key)] {
+				seen[fmt.Sprint(key)] = true
+				keys = append(keys, key)
+			}
+		}
+		related := make(map[string][]map[string]interface{}, len(keys))
+		for start := 0; start < len(keys); start += maxExpandKeys {
+			end := start + maxExpandKeys
+			if end > len(keys) {
+				end = len(keys)
+			}
+			limit := 1
+			if relation.Kind == HasMany {
+				limit = relation.Limit
+			}
+			if err := relation.Resource.selectIn(remote, keys[start:end], limit, related, request); err != nil {
+				return err
+			}
+		}
+		for i, row := range rows {
+			matched := related[fmt.Sprint(row[local])]
+			if row[local] == nil {
+				matched = nil
+			}
+			if relation.Kind == HasMany {
+				if matched == nil {
+					matched = []map[string]interface{}{}
+				}
+				entities[i][name] = matched
+			} else if len(matched) > 0 {
+				entities[i][name] = matched[0]
+			} else {
+				entities[i][name] = nil
+			}
+		}
+	}
+	return nil
+}
+
+// selectIn selects entities with the field in values, and adds at most limit entities with the
+// least primary keys to result for each value of the field
+func (res *Resource) selectIn(field string, values []interface{}, limit int, result map[string][]map[string]interface{}, request *webserver.Request) error {
+	names := res.sortedFieldNames()
+	statement := fmt.Sprintf("SELECT %s FROM %s WHERE %s IN (?%s)", strings.Join(names, ", "),
+		res.Name, field, strings.Repeat(", ?", len(values)-1))
+	if condition := res.notDeleted(); condition != "" {
+		statement += " AND " + condition
+	}
+	statement += " ORDER BY " + field
+	if key := res.primaryKey(); key != "" {
+		statement += ", " + key
+	}
+	rows, err := res.querier(request).Query(statement, values...)
+	if err != nil {
+		logging.Error("Query related %s entities fail: %s", res.Name, err.Error())
+		return errSearchFail
+	}
+	defer rows.Close()
+	holders := make([]interface{}, len(names))
+	for rows.Next() {
+		for i, name := range names {
+			holders[i] = res.Fields[name].Type.ValueHolder()
+		}
+		if err := rows.Scan(holders...); err != nil {
+			logging.Error("Scan related %s entities fail: %s", res.Name, err.Error())
+			return errSearchFail
+		}
+		entity := make(map[string]interface{}, len(names))
+		for i, name := range names {
+			entity[name] = res.Fields[name].Type.Encode(holders[i])
+		}
+		key := fmt.Sprint(entity[field])
+		if len(result[key]) < limit {
+			result[key] = append(result[key], entity)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logging.Error("Scan related %s entities fail: %s", res.Name, err.Error())
+		return errSearchFail
+	}
+	return nil
+}
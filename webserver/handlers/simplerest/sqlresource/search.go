@@ -0,0 +1,481 @@
+package sqlresource
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yangchenxing/cangshan/logging"
+	"github.com/yangchenxing/cangshan/webserver"
+	"github.com/yangchenxing/cangshan/webserver/handlers/simplerest"
+)
+
+func init() {
+	gob.Register(time.Time{})
+}
+
+const (
+	defaultLimit    = 100
+	defaultMaxLimit = 1000
+)
+
+// Search parameters, other parameters are filters on fields
+const (
+	LimitParam  = "limit"
+	OffsetParam = "offset"
+	CursorParam = "cursor"
+	SortParam   = "sort"
+	FieldsParam = "fields"
+)
+
+var filterPattern = regexp.MustCompile(`^(\w+)\[(\w+)\]$`)
+
+var filterOperators = map[string]string{
+	"eq":  "=",
+	"ne":  "<>",
+	"gt":  ">",
+	"gte": ">=",
+	"lt":  "<",
+	"lte": "<=",
+}
+
+type sortField struct {
+	name     string
+	desc     bool
+	nullable bool
+	scalar   bool
+}
+
+// A searchQuery is a parsed search. Only names of Fields are put in statements, and values are
+// decoded by the field types and passed as arguments.
+type searchQuery struct {
+	conditions []string
+	args       []interface{}
+	order      []sortField
+	fields     []string
+	limit      int
+	offset     int
+	cursor     []interface{}
+	expand     []string
+}
+
+func (res *Resource) parseSearch(param map[string]interface{}) (*searchQuery, error) {
+	query := &searchQuery{limit: res.DefaultLimit}
+	if condition := res.notDeleted(); condition != "" {
+		query.conditions = append(query.conditions, condition)
+	}
+	for key, value := range param {
+		switch key {
+		case LimitParam, OffsetParam, CursorParam, SortParam, FieldsParam, ExpandParam:
+			continue
+		}
+		if match := relationFilterPattern.FindStringSubmatch(key); match != nil {
+			if _, found := res.Relations[match[1]]; found {
+				op := match[3]
+				if op == "" {
+					op = "eq"
+				}
+				if err := query.addRelationFilter(res, match[1], match[2], op, value); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		name, op := key, "eq"
+		if match := filterPattern.FindStringSubmatch(key); match != nil {
+			name, op = match[1], match[2]
+		}
+		f, found := res.Fields[name]
+		if !found {
+			if name != key {
+				return nil, &simplerest.ValidationError{Field: name, Message: "unknown field"}
+			}
+			continue
+		}
+		if err := query.addFilter(name, op, f.Type, value); err != nil {
+			return nil, err
+		}
+	}
+	if value := paramString(param, LimitParam); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return nil, &simplerest.ValidationError{Field: LimitParam, Message: "invalid limit"}
+		}
+		query.limit = limit
+	}
+	if query.limit > res.MaxLimit {
+		query.limit = res.MaxLimit
+	}
+	if value := paramString(param, OffsetParam); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return nil, &simplerest.ValidationError{Field: OffsetParam, Message: "invalid offset"}
+		}
+		query.offset = offset
+	}
+	if err := query.parseSort(res, paramString(param, SortParam)); err != nil {
+		return nil, err
+	}
+	if err := query.parseFields(res, paramString(param, FieldsParam)); err != nil {
+		return nil, err
+	}
+	var err error
+	if query.expand, err = res.parseExpand(param); err != nil {
+		return nil, err
+	}
+	if value := paramString(param, CursorParam); value != "" {
+		if err := query.parseCursor(res, value); err != nil {
+			return nil, err
+		}
+		query.offset = 0
+	}
+	return query, nil
+}
+
+func (query *searchQuery) addFilter(name, op string, t Type, value interface{}) error {
+	invalid := func(message string) error {
+		return &simplerest.ValidationError{Field: name, Message: message}
+	}
+	switch op {
+	case "in":
+		var values []interface{}
+		switch v := value.(type) {
+		case string:
+			for _, item := range strings.Split(v, ",") {
+				values = append(values, item)
+			}
+		case []interface{}:
+			values = v
+		default:
+			return invalid("invalid in value")
+		}
+		if len(values) == 0 {
+			return invalid("empty in value")
+		}
+		for _, item := range values {
+			decoded, err := t.Decode(item)
+			if err != nil {
+				return invalid(err.Error())
+			}
+			query.args = append(query.args, decoded)
+		}
+		query.conditions = append(query.conditions,
+			fmt.Sprintf("%s IN (?%s)", name, strings.Repeat(", ?", len(values)-1)))
+	case "like":
+		text, ok := value.(string)
+		if !ok {
+			return invalid("invalid like value")
+		}
+		query.conditions = append(query.conditions, name+" LIKE ?")
+		query.args = append(query.args, text)
+	case "isnull":
+		isNull, err := BoolType{}.Decode(value)
+		if err != nil {
+			return invalid("invalid isnull value")
+		} else if isNull.(bool) {
+			query.conditions = append(query.conditions, name+" IS NULL")
+		} else {
+			query.conditions = append(query.conditions, name+" IS NOT NULL")
+		}
+	default:
+		operator, found := filterOperators[op]
+		if !found {
+			return invalid("unknown operator " + op)
+		}
+		decoded, err := t.Decode(value)
+		if err != nil {
+			return invalid(err.Error())
+		}
+		query.conditions = append(query.conditions, name+operator+"?")
+		query.args = append(query.args, decoded)
+	}
+	return nil
+}
+
+// parseSort parses sort fields like "-created,name", and appends primary keys to keep the order
+// stable for pagination
+func (query *searchQuery) parseSort(res *Resource, value string) error {
+	sorted := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		field := sortField{name: item}
+		if item[0] == '-' || item[0] == '+' {
+			field = sortField{name: item[1:], desc: item[0] == '-'}
+		}
+		if f, found := res.Fields[field.name]; !found {
+			return &simplerest.ValidationError{Field: SortParam, Message: "unknown field " + field.name}
+		} else if !sorted[field.name] {
+			field.nullable = typeAPISchema(f.Type)["nullable"] == true
+			field.scalar = cursorSortable(f.Type)
+			query.order = append(query.order, field)
+			sorted[field.name] = true
+		}
+	}
+	for _, name := range res.sortedFieldNames() {
+		if f := res.Fields[name]; f.PrimaryKey && !sorted[name] {
+			query.order = append(query.order, sortField{name: name, scalar: cursorSortable(f.Type)})
+		}
+	}
+	return nil
+}
+
+func (query *searchQuery) parseFields(res *Resource, value string) error {
+	if value == "" {
+		query.fields = res.sortedFieldNames()
+		return nil
+	}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if _, found := res.Fields[name]; !found {
+			return &simplerest.ValidationError{Field: FieldsParam, Message: "unknown field " + name}
+		}
+		query.fields = append(query.fields, name)
+	}
+	return nil
+}
+
+// cursorSortable reports whether values of the type can be compared in cursors. JSON values
+// can not.
+func cursorSortable(t Type) bool {
+	switch t.(type) {
+	case JSONType, *JSONType:
+		return false
+	}
+	return true
+}
+
+// cursorEnabled reports whether all order fields can be compared in cursors
+func (query *searchQuery) cursorEnabled() bool {
+	for _, field := range query.order {
+		if !field.scalar {
+			return false
+		}
+	}
+	return len(query.order) > 0
+}
+
+// A cursor is the gob encoded values of the order fields of the last entity of a page, with nil
+// for NULL. Values are decoded by field types, so that tampered cursors cannot inject values of
+// other types.
+func (query *searchQuery) parseCursor(res *Resource, value string) error {
+	if !query.cursorEnabled() {
+		return &simplerest.ValidationError{Field: CursorParam, Message: "not supported by the sort fields"}
+	}
+	invalid := &simplerest.ValidationError{Field: CursorParam, Message: "invalid cursor"}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return invalid
+	}
+	var values []interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values); err != nil ||
+		len(values) == 0 || len(values) != len(query.order) {
+		return invalid
+	}
+	for i, field := range query.order {
+		if values[i] == nil {
+			if !field.nullable {
+				return invalid
+			}
+			continue
+		}
+		if values[i], err = res.Fields[field.name].Type.Decode(values[i]); err != nil {
+			return invalid
+		}
+	}
+	query.cursor = values
+	return nil
+}
+
+func (query *searchQuery) encodeCursor(entity map[string]interface{}) (string, error) {
+	values := make([]interface{}, len(query.order))
+	for i, field := range query.order {
+		values[i] = entity[field.name]
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(values); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// cursorCondition returns the keyset condition of entities after the cursor, like
+// "(a > ? OR (a = ? AND b < ?))". NULL is ordered before other values, like orderBy does.
+func (query *searchQuery) cursorCondition() (string, []interface{}) {
+	terms := make([]string, 0, len(query.order))
+	args := make([]interface{}, 0, len(query.order)*(len(query.order)+1)/2)
+	for i, field := range query.order {
+		parts := make([]string, 0, i+1)
+		termArgs := make([]interface{}, 0, i+1)
+		for j := 0; j < i; j++ {
+			if query.cursor[j] == nil {
+				parts = append(parts, query.order[j].name+" IS NULL")
+			} else {
+				parts = append(parts, query.order[j].name+"=?")
+				termArgs = append(termArgs, query.cursor[j])
+			}
+		}
+		switch {
+		case query.cursor[i] == nil && field.desc:
+			// nothing follows NULL in descending order
+			continue
+		case query.cursor[i] == nil:
+			parts = append(parts, field.name+" IS NOT NULL")
+		case field.desc && field.nullable:
+			parts = append(parts, "("+field.name+"<? OR "+field.name+" IS NULL)")
+			termArgs = append(termArgs, query.cursor[i])
+		case field.desc:
+			parts = append(parts, field.name+"<?")
+			termArgs = append(termArgs, query.cursor[i])
+		default:
+			parts = append(parts, field.name+">?")
+			termArgs = append(termArgs, query.cursor[i])
+		}
+		terms = append(terms, "("+strings.Join(parts, " AND ")+")")
+		args = append(args, termArgs...)
+	}
+	if len(terms) == 0 {
+		return "1=0", args
+	}
+	return "(" + strings.Join(terms, " OR ") + ")", args
+}
+
+func (query *searchQuery) where(withCursor bool) (string, []interface{}) {
+	conditions := query.conditions
+	args := query.args
+	if withCursor && query.cursor != nil {
+		condition, cursorArgs := query.cursorCondition()
+		conditions = append(append([]string(nil), conditions...), condition)
+		args = append(append([]interface{}(nil), args...), cursorArgs...)
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func (query *searchQuery) orderBy() string {
+	if len(query.order) == 0 {
+		return ""
+	}
+	items := make([]string, 0, len(query.order))
+	for _, field := range query.order {
+		// order NULL explicitly, since databases differ
+		if field.nullable && field.desc {
+			items = append(items, "("+field.name+" IS NULL) ASC")
+		} else if field.nullable {
+			items = append(items, "("+field.name+" IS NULL) DESC")
+		}
+		if field.desc {
+			items = append(items, field.name+" DESC")
+		} else {
+			items = append(items, field.name+" ASC")
+		}
+	}
+	return " ORDER BY " + strings.Join(items, ", ")
+}
+
+// SearchPage searches entities by filters like "age[gt]=30", with "limit" and "offset" or
+// "cursor" pagination, "sort" like "-created,name" and "fields" projection. Supported filter
+// operators are eq (default), ne, gt, gte, lt, lte, in (comma separated), like and isnull. NULL
+// is sorted first in ascending order, and cursors are not supported when sorting by JSON fields.
+func (res *Resource) SearchPage(param map[string]interface{}, request *webserver.Request) (*simplerest.Page, error) {
+	query, err := res.parseSearch(param)
+	if err != nil {
+		return nil, err
+	}
+	db := res.querier(request)
+	where, args := query.where(false)
+	page := &simplerest.Page{Limit: query.limit, Offset: query.offset}
+	if err := db.QueryRow("SELECT COUNT(*) FROM "+res.Name+where, args...).Scan(&page.Total); err != nil {
+		logging.Error("Count %s entities fail: %s", res.Name, err.Error())
+		return nil, errSearchFail
+	}
+	// select order fields for the next cursor and key fields of relations as well
+	selected := append([]string(nil), query.fields...)
+	projected := make(map[string]bool, len(query.fields))
+	for _, name := range query.fields {
+		projected[name] = true
+	}
+	added := make(map[string]bool)
+	for _, field := range query.order {
+		if !projected[field.name] && !added[field.name] {
+			selected = append(selected, field.name)
+			added[field.name] = true
+		}
+	}
+	for _, name := range query.expand {
+		if local, _ := res.Relations[name].keys(res); !projected[local] && !added[local] {
+			selected = append(selected, local)
+			added[local] = true
+		}
+	}
+	where, args = query.where(true)
+	statement := fmt.Sprintf("SELECT %s FROM %s%s%s LIMIT ? OFFSET ?", strings.Join(selected, ", "),
+		res.Name, where, query.orderBy())
+	rows, err := db.Query(statement, append(args, query.limit, query.offset)...)
+	if err != nil {
+		logging.Error("Query %s entities fail: %s", res.Name, err.Error())
+		return nil, errSearchFail
+	}
+	defer rows.Close()
+	holders := make([]interface{}, len(selected))
+	var last map[string]interface{}
+	var rowsSelected []map[string]interface{}
+	page.Entities = make([]map[string]interface{}, 0, query.limit)
+	for rows.Next() {
+		for i, name := range selected {
+			holders[i] = res.Fields[name].Type.ValueHolder()
+		}
+		if err := rows.Scan(holders...); err != nil {
+			logging.Error("Scan %s entities fail: %s", res.Name, err.Error())
+			return nil, errSearchFail
+		}
+		last = make(map[string]interface{}, len(selected))
+		entity := make(map[string]interface{}, len(query.fields))
+		for i, name := range selected {
+			last[name] = res.Fields[name].Type.Encode(holders[i])
+			if projected[name] {
+				entity[name] = last[name]
+			}
+		}
+		page.Entities = append(page.Entities, entity)
+		rowsSelected = append(rowsSelected, last)
+	}
+	if err := rows.Err(); err != nil {
+		logging.Error("Scan %s entities fail: %s", res.Name, err.Error())
+		return nil, errSearchFail
+	}
+	if len(query.expand) > 0 {
+		if err := res.expand(page.Entities, rowsSelected, query.expand, request); err != nil {
+			return nil, err
+		}
+	}
+	if len(page.Entities) == query.limit && query.cursorEnabled() {
+		if page.Next, err = query.encodeCursor(last); err != nil {
+			logging.Error("Encode %s cursor fail: %s", res.Name, err.Error())
+			return nil, errSearchFail
+		}
+	}
+	return page, nil
+}
+
+func paramString(param map[string]interface{}, name string) string {
+	switch v := param[name].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,176 @@
+package sqlresource
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/yangchenxing/cangshan/client/sql"
+	"github.com/yangchenxing/cangshan/webserver"
+	"github.com/yangchenxing/cangshan/webserver/handlers/simplerest"
+)
+
+type testField = struct {
+	Type          Type
+	PrimaryKey    bool
+	Creatable     bool
+	Modifiable    bool
+	Generater     ResourcePrimaryKeyGenerater
+	AutoIncrement bool
+	Validators    []simplerest.FieldValidator
+	i             int
+}
+
+// newTestResource returns a resource of users in an in-memory sqlite database, where user 4 has
+// no age
+func newTestResource(t *testing.T) *Resource {
+	db := &sql.DB{Driver: "sqlite3", DataSource: ":memory:"}
+	if err := db.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	for _, statement := range []string{
+		"CREATE TABLE users(id INTEGER PRIMARY KEY, name TEXT UNIQUE, age INTEGER, profile TEXT)",
+		"INSERT INTO users(id, name, age) VALUES(1,'a',30),(2,'b',40),(3,'c',40),(4,'d',NULL),(5,'e',50)",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res := &Resource{DB: db, Name: "users"}
+	res.Fields = map[string]*testField{
+		"id":      {Type: Int64Type{}, PrimaryKey: true, AutoIncrement: true},
+		"name":    {Type: StringType{}, Creatable: true, Modifiable: true},
+		"age":     {Type: NullInt64Type{}, Creatable: true, Modifiable: true},
+		"profile": {Type: JSONType{}, Creatable: true, Modifiable: true},
+	}
+	if err := res.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func newTestRequest() *webserver.Request {
+	return &webserver.Request{
+		Request: httptest.NewRequest("GET", "/users", nil),
+		Attr:    make(map[string]interface{}),
+		Param:   make(map[string]interface{}),
+	}
+}
+
+func TestCursorEncodeDecode(t *testing.T) {
+	res := newTestResource(t)
+	query, err := res.parseSearch(map[string]interface{}{SortParam: "-age"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		entity map[string]interface{}
+		values []interface{}
+	}{
+		{"value", map[string]interface{}{"age": int64(30), "id": int64(1)}, []interface{}{int64(30), int64(1)}},
+		{"null", map[string]interface{}{"age": nil, "id": int64(4)}, []interface{}{nil, int64(4)}},
+	}
+	for _, test := range tests {
+		cursor, err := query.encodeCursor(test.entity)
+		if err != nil {
+			t.Fatalf("%s: encode fail: %s", test.name, err.Error())
+		}
+		decoded, _ := res.parseSearch(map[string]interface{}{SortParam: "-age"})
+		if err := decoded.parseCursor(res, cursor); err != nil {
+			t.Errorf("%s: decode fail: %s", test.name, err.Error())
+		} else if !reflect.DeepEqual(decoded.cursor, test.values) {
+			t.Errorf("%s: unexpected cursor values: %#v", test.name, decoded.cursor)
+		}
+	}
+
+	nullID, _ := query.encodeCursor(map[string]interface{}{"age": int64(30), "id": nil})
+	stringAge, _ := query.encodeCursor(map[string]interface{}{"age": "30 OR 1=1", "id": int64(1)})
+	short, _ := (&searchQuery{order: query.order[:1]}).encodeCursor(map[string]interface{}{"age": int64(30)})
+	invalid := []struct {
+		name   string
+		sort   string
+		cursor string
+	}{
+		{"not base64", "-age", "!!"},
+		{"not gob", "-age", base64.RawURLEncoding.EncodeToString([]byte("cursor"))},
+		{"null primary key", "-age", nullID},
+		{"value of other type", "-age", stringAge},
+		{"wrong length", "-age", short},
+		{"json sort field", "profile", short},
+	}
+	for _, test := range invalid {
+		if _, err := res.parseSearch(map[string]interface{}{SortParam: test.sort, CursorParam: test.cursor}); err == nil {
+			t.Errorf("%s: cursor accepted", test.name)
+		}
+	}
+}
+
+func TestCursorCondition(t *testing.T) {
+	order := []sortField{{name: "age", nullable: true, scalar: true}, {name: "id", scalar: true}}
+	descOrder := []sortField{{name: "age", desc: true, nullable: true, scalar: true}, {name: "id", scalar: true}}
+	tests := []struct {
+		name      string
+		order     []sortField
+		cursor    []interface{}
+		condition string
+		args      []interface{}
+	}{
+		{"ascending", order, []interface{}{int64(30), int64(1)},
+			"((age>?) OR (age=? AND id>?))", []interface{}{int64(30), int64(30), int64(1)}},
+		{"ascending null", order, []interface{}{nil, int64(4)},
+			"((age IS NOT NULL) OR (age IS NULL AND id>?))", []interface{}{int64(4)}},
+		{"descending", descOrder, []interface{}{int64(30), int64(1)},
+			"(((age<? OR age IS NULL)) OR (age=? AND id>?))", []interface{}{int64(30), int64(30), int64(1)}},
+		{"descending null", descOrder, []interface{}{nil, int64(4)},
+			"((age IS NULL AND id>?))", []interface{}{int64(4)}},
+		{"descending null last", descOrder[:1], []interface{}{nil}, "1=0", []interface{}{}},
+	}
+	for _, test := range tests {
+		query := &searchQuery{order: test.order, cursor: test.cursor}
+		condition, args := query.cursorCondition()
+		if condition != test.condition || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: unexpected condition %s %v", test.name, condition, args)
+		}
+	}
+}
+
+func TestSearchCursorWithNulls(t *testing.T) {
+	res := newTestResource(t)
+	tests := []struct {
+		sort string
+		ids  []int64
+	}{
+		{"age", []int64{4, 1, 2, 3, 5}},
+		{"-age", []int64{5, 2, 3, 1, 4}},
+		{"-age,-id", []int64{5, 3, 2, 1, 4}},
+		{"name", []int64{1, 2, 3, 4, 5}},
+	}
+	for _, test := range tests {
+		var ids []int64
+		param := map[string]interface{}{SortParam: test.sort, LimitParam: "2"}
+		for pages := 0; pages < 5; pages++ {
+			page, err := res.SearchPage(param, newTestRequest())
+			if err != nil {
+				t.Fatalf("%s: search fail: %s", test.sort, err.Error())
+			}
+			for _, entity := range page.Entities {
+				ids = append(ids, entity["id"].(int64))
+			}
+			if page.Next == "" {
+				break
+			}
+			param[CursorParam] = page.Next
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(test.ids) {
+			t.Errorf("sort %s: unexpected entities %v", test.sort, ids)
+		}
+	}
+	if _, err := res.SearchPage(map[string]interface{}{SortParam: "profile", LimitParam: "2"}, newTestRequest()); err != nil {
+		t.Errorf("search sorted by json fail: %s", err.Error())
+	}
+}
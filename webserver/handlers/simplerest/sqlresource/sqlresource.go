@@ -1,7 +1,6 @@
 package sqlresource
 
 import (
-	"container/list"
 	"errors"
 	"fmt"
 	"strings"
@@ -22,6 +21,7 @@ var (
 	errSearchFail = errors.New("Search entities fail")
 	errCreateFail = errors.New("Create entity fail")
 	errUpdateFail = errors.New("Update entity fail")
+	errDeleteFail = errors.New("Delete entity fail")
 )
 
 type Type interface {
@@ -34,10 +34,34 @@ type ResourcePrimaryKeyGenerater interface {
 	Generate() (interface{}, error)
 }
 
+// A Resource is a simplerest resource of the table Name. Searches return DefaultLimit entities
+// (default 100) unless the "limit" param is set, and at most MaxLimit (default 1000).
+//
+// Creations, updates and deletions run in transactions with their triggers, see RequestTx. The
+// integer field VersionField, if set, is the version for optimistic concurrency control.
+//
+// SoftDeleteField, if set, is the time field set by Delete instead of deleting the row, and
+// entities with it are excluded from Get and Search. CreatedAtField, UpdatedAtField,
+// CreatedByField and UpdatedByField are set by creations and updates, overriding given values,
+// with the user of the request, see RequestUser with SessionKey and UserKey.
+//
+// Expandable relations are embedded by the "expand" param of Get and Search, like
+// "expand=author,comments", and Search filters on fields of related resources like "author.name=a".
 type Resource struct {
-	DB     *sql.DB
-	Name   string
-	Fields map[string]*struct {
+	DB              *sql.DB
+	Name            string
+	DefaultLimit    int
+	MaxLimit        int
+	VersionField    string
+	Relations       map[string]*Relation
+	SoftDeleteField string
+	CreatedAtField  string
+	UpdatedAtField  string
+	CreatedByField  string
+	UpdatedByField  string
+	SessionKey      string
+	UserKey         string
+	Fields          map[string]*struct {
 		Type          Type
 		PrimaryKey    bool
 		Creatable     bool
@@ -50,6 +74,24 @@ type Resource struct {
 }
 
 func (res *Resource) Initialize() error {
+	if res.DefaultLimit == 0 {
+		res.DefaultLimit = defaultLimit
+	}
+	if res.MaxLimit == 0 {
+		res.MaxLimit = defaultMaxLimit
+	}
+	if res.DefaultLimit > res.MaxLimit {
+		res.DefaultLimit = res.MaxLimit
+	}
+	if f, found := res.Fields[res.VersionField]; res.VersionField != "" && (!found || f.PrimaryKey) {
+		return fmt.Errorf("Invalid VersionField: %s", res.VersionField)
+	}
+	if err := res.initializeRelations(); err != nil {
+		return err
+	}
+	if err := res.initializeAudit(); err != nil {
+		return err
+	}
 	i := 0
 	for _, f := range res.Fields {
 		f.i = i
@@ -66,11 +108,11 @@ func (res *Resource) DecodeParams(param map[string]interface{}, request *webserv
 		}
 		w, err := f.Type.Decode(v)
 		if err != nil {
-			return fmt.Errorf("Decode field %s fail: %s", name, err.Error())
+			return &simplerest.ValidationError{Field: name, Message: err.Error()}
 		}
 		for _, validator := range f.Validators {
 			if err := validator.Validate(w, request); err != nil {
-				return fmt.Errorf("Validate field %s fail: %s", name, err.Error())
+				return &simplerest.ValidationError{Field: name, Message: err.Error()}
 			}
 		}
 		param[name] = w
@@ -89,10 +131,13 @@ func (res *Resource) filterParam(param map[string]interface{}) map[string]interf
 }
 
 func (res *Resource) Get(param map[string]interface{}, request *webserver.Request) (map[string]interface{}, error) {
+	expand, err := res.parseExpand(param)
+	if err != nil {
+		return nil, err
+	}
 	param = res.filterParam(param)
 	if err := res.DecodeParams(param, request); err != nil {
-		logging.Error("Decode get query param fail: %s", err.Error())
-		return nil, errGetFail
+		return nil, err
 	}
 	sqlParams := make([]interface{}, 0, len(res.Fields))
 	fieldNames := make([]string, len(res.Fields))
@@ -104,17 +149,19 @@ func (res *Resource) Get(param map[string]interface{}, request *webserver.Reques
 		if f.PrimaryKey {
 			value, found := param[name]
 			if !found {
-				logging.Error("Missing %s entity primary key: %s", res.Name, name)
-				return nil, errGetFail
+				return nil, &simplerest.ValidationError{Field: name, Message: "missing primary key"}
 			}
 			conditions = append(conditions, name+"=?")
 			sqlParams = append(sqlParams, value)
 		}
 	}
+	if condition := res.notDeleted(); condition != "" {
+		conditions = append(conditions, condition)
+	}
 	statement := fmt.Sprintf("SELECT %s FROM %s WHERE %s",
 		strings.Join(fieldNames, ", "), res.Name, strings.Join(conditions, " AND "))
-	row := res.DB.QueryRow(statement, sqlParams...)
-	err := row.Scan(valueHolders...)
+	row := res.querier(request).QueryRow(statement, sqlParams...)
+	err = row.Scan(valueHolders...)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -122,79 +169,91 @@ func (res *Resource) Get(param map[string]interface{}, request *webserver.Reques
 		logging.Error("Scan %s entity fail: %s", res.Name, err.Error())
 		return nil, errGetFail
 	}
-	return res.scanEntity(valueHolders), nil
+	entity := res.scanEntity(valueHolders)
+	if len(expand) > 0 {
+		entities := []map[string]interface{}{entity}
+		if err := res.expand(entities, entities, expand, request); err != nil {
+			return nil, err
+		}
+	}
+	return entity, nil
 }
 
+// Search returns the entities of SearchPage
 func (res *Resource) Search(param map[string]interface{}, request *webserver.Request) ([]map[string]interface{}, error) {
-	param = res.filterParam(param)
-	if err := res.DecodeParams(param, request); err != nil {
-		logging.Error("Decode search query param fail: %s", err.Error())
-		return nil, errSearchFail
-	}
-	sqlParams := make([]interface{}, 0, len(res.Fields))
-	fieldNames := make([]string, len(res.Fields))
-	valueHolders := make([]interface{}, len(res.Fields))
-	conditions := make([]string, 0, 1)
-	for name, f := range res.Fields {
-		fieldNames[f.i] = name
-		valueHolders[f.i] = f.Type.ValueHolder()
-		if value, found := param[name]; found {
-			conditions = append(conditions, name+"=?")
-			if v, err := f.Type.Decode(value); err != nil {
-				return nil, fmt.Errorf("Decode param %s fail: %s", name, err.Error())
-			} else {
-				sqlParams = append(sqlParams, v)
-			}
-		}
-	}
-	rows, err := res.DB.Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s",
-		strings.Join(fieldNames, ", "), res.Name, strings.Join(conditions, " AND ")), sqlParams...)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
+	page, err := res.SearchPage(param, request)
 	if err != nil {
-		logging.Error("Query %s entities fail: %s", res.Name, err.Error())
-		return nil, errSearchFail
-	}
-	result := list.New()
-	for rows.Next() {
-		if err := rows.Scan(valueHolders...); err != nil {
-			logging.Error("Scan %s entities fail: %s", res.Name, err.Error())
-			return nil, errSearchFail
-		}
-		result.PushBack(res.scanEntity(valueHolders))
-	}
-	entities := make([]map[string]interface{}, result.Len())
-	for i, entity := 0, result.Front(); entity != nil; i, entity = i+1, entity.Next() {
-		entities[i] = entity.Value.(map[string]interface{})
+		return nil, err
 	}
-	return entities, nil
+	return page.Entities, nil
 }
 
+// Create inserts the entity and invokes triggers in a transaction
 func (res *Resource) Create(param map[string]interface{}, before, after []simplerest.Trigger, request *webserver.Request) (map[string]interface{}, error) {
 	param = res.filterParam(param)
 	if err := res.DecodeParams(param, request); err != nil {
-		logging.Error("Decode create query param fail: %s", err.Error())
-		return nil, errCreateFail
+		return nil, err
 	}
+	return res.transaction(request, errCreateFail, func(tx *sql.Tx) (map[string]interface{}, error) {
+		return res.create(tx, param, before, after, request)
+	})
+}
+
+func (res *Resource) create(tx *sql.Tx, param map[string]interface{}, before, after []simplerest.Trigger, request *webserver.Request) (map[string]interface{}, error) {
+	res.stampCreate(param, request)
 	// before creation trigger
-	if before != nil {
-		for _, trigger := range before {
-			if err := trigger.Handle(res.Name, nil, param, request); err != nil {
-				logging.Error("invoke trigger before create of resource %s fail: %s", res.Name, err.Error())
-				return nil, fmt.Errorf("before create trigger fail: %s", err.Error())
-			}
+	for _, trigger := range before {
+		if err := trigger.Handle(res.Name, nil, param, request); err != nil {
+			logging.Error("invoke trigger before create of resource %s fail: %s", res.Name, err.Error())
+			return nil, &simplerest.TriggerError{Operation: "create", Before: true, Err: err}
 		}
 	}
+	row, err := res.insertion(param)
+	if err != nil {
+		return nil, err
+	}
+	if result, err := tx.Exec(fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)",
+		res.Name, strings.Join(row.fieldNames, ", "),
+		"?"+(strings.Repeat(", ?", len(row.values)-1))), row.values...); err != nil {
+		if isDuplicateKeyError(err) {
+			return nil, simplerest.ErrConflict
+		}
+		logging.Error("Insert %s entity fail: %s", res.Name, err.Error())
+		return nil, errCreateFail
+	} else if row.autoKeyName != "" {
+		key, err := result.LastInsertId()
+		if err != nil {
+			logging.Error("Get %s entity auto increment key fail: %s", res.Name, err.Error())
+			return nil, errCreateFail
+		}
+		row.keys[row.autoKeyName] = key
+	}
+	entity, err := res.Get(row.keys, request)
+	if err != nil {
+		return nil, errCreateFail
+	}
+	return res.afterCreate(entity, after, request)
+}
 
-	fieldNames := make([]string, 0, len(res.Fields))
-	values := make([]interface{}, 0, len(res.Fields))
-	autoKeyName := ""
-	keys := make(map[string]interface{})
-	for name, f := range res.Fields {
+// An insertedRow is the fields and values of an entity to insert, in the order of field names
+type insertedRow struct {
+	fieldNames  []string
+	values      []interface{}
+	keys        map[string]interface{}
+	autoKeyName string
+}
+
+func (res *Resource) insertion(param map[string]interface{}) (*insertedRow, error) {
+	row := &insertedRow{
+		fieldNames: make([]string, 0, len(res.Fields)),
+		values:     make([]interface{}, 0, len(res.Fields)),
+		keys:       make(map[string]interface{}),
+	}
+	for _, name := range res.sortedFieldNames() {
+		f := res.Fields[name]
 		if f.PrimaryKey {
 			if f.AutoIncrement {
-				autoKeyName = name
+				row.autoKeyName = name
 			} else if f.Generater != nil {
 				v, err := f.Generater.Generate()
 				if err != nil {
@@ -202,87 +261,101 @@ func (res *Resource) Create(param map[string]interface{}, before, after []simple
 						res.Name, name, err.Error())
 					return nil, errCreateFail
 				}
-				keys[name] = v
-				values = append(values, v)
-				fieldNames = append(fieldNames, name)
+				row.keys[name] = v
+				row.values = append(row.values, v)
+				row.fieldNames = append(row.fieldNames, name)
 			} else if !f.Creatable {
 				logging.Error("Primary key %s of resource %s must be generatable or creatable",
 					name, res.Name)
 				return nil, errCreateFail
 			} else if v, found := param[name]; found {
-				values = append(values, v)
-				fieldNames = append(fieldNames, name)
+				row.keys[name] = v
+				row.values = append(row.values, v)
+				row.fieldNames = append(row.fieldNames, name)
 			} else {
-				logging.Error("Pimary key %s of resource %s is missing", name, res.Name)
-				return nil, errCreateFail
+				return nil, &simplerest.ValidationError{Field: name, Message: "missing primary key"}
 			}
+		} else if name == res.VersionField {
+			row.values = append(row.values, 1)
+			row.fieldNames = append(row.fieldNames, name)
 		} else if v, found := param[name]; found {
-			values = append(values, v)
-			fieldNames = append(fieldNames, name)
+			row.values = append(row.values, v)
+			row.fieldNames = append(row.fieldNames, name)
 		}
 	}
-	if autoKeyName != "" && len(keys) > 0 {
+	if row.autoKeyName != "" && len(row.keys) > 0 {
 		logging.Error("Resource %s has both auto increment key and user generated key", res.Name)
 		return nil, errCreateFail
 	}
-	if result, err := res.DB.Exec(fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)",
-		res.Name, strings.Join(fieldNames, ", "),
-		"?"+(strings.Repeat(" ,?", len(values)-1)))); err != nil {
-		logging.Error("Insert %s entity fail: %s", res.Name, err.Error())
-		return nil, errCreateFail
-	} else if autoKeyName != "" {
-		key, err := result.LastInsertId()
-		if err != nil {
-			logging.Error("Get %s entity auto increment key fail: %s", res.Name, err.Error())
-			return nil, errCreateFail
-		}
-		keys[autoKeyName] = key
-	}
-	entity, err := res.Get(keys, request)
-	if err != nil {
-		return nil, errCreateFail
-	}
+	return row, nil
+}
+
+func (res *Resource) afterCreate(entity map[string]interface{}, after []simplerest.Trigger, request *webserver.Request) (map[string]interface{}, error) {
 	// after creation trigger
-	if after != nil {
-		for _, trigger := range after {
-			if err := trigger.Handle(res.Name, nil, entity, request); err != nil {
-				logging.Error("invoke trigger after create of resource %s fail: %s", res.Name, err.Error())
-				return nil, fmt.Errorf("after create trigger fail: %s", err.Error())
-			}
+	for _, trigger := range after {
+		if err := trigger.Handle(res.Name, nil, entity, request); err != nil {
+			logging.Error("invoke trigger after create of resource %s fail: %s", res.Name, err.Error())
+			return nil, &simplerest.TriggerError{Operation: "create", Err: err}
 		}
 	}
-	return nil, errCreateFail
+	return entity, nil
 }
 
+// Update modifies the entity and invokes triggers in a transaction. With VersionField, the
+// version param must be the current version of the entity, or ErrConflict is returned, and the
+// version is increased by each update.
 func (res *Resource) Update(param map[string]interface{}, before, after []simplerest.Trigger, request *webserver.Request) (map[string]interface{}, error) {
+	param, keys, err := res.updateParam(param, request)
+	if err != nil {
+		return nil, err
+	}
+	return res.transaction(request, errUpdateFail, func(tx *sql.Tx) (map[string]interface{}, error) {
+		return res.update(tx, keys, param, before, after, request)
+	})
+}
+
+// updateParam decodes the update param and returns it with the primary keys. Fields other than
+// primary keys, VersionField and Modifiable fields are dropped.
+func (res *Resource) updateParam(param map[string]interface{}, request *webserver.Request) (map[string]interface{}, map[string]interface{}, error) {
 	param = res.filterParam(param)
+	for name := range param {
+		if f := res.Fields[name]; !f.PrimaryKey && !f.Modifiable && name != res.VersionField {
+			delete(param, name)
+		}
+	}
 	if err := res.DecodeParams(param, request); err != nil {
-		logging.Error("Decode update query param fail: %s", err.Error())
-		return nil, errUpdateFail
+		return nil, nil, err
 	}
-	// prepare primary key
 	keys := make(map[string]interface{})
+	replace, _ := request.Attr[simplerest.ReplaceAttrKey].(bool)
 	for name, f := range res.Fields {
 		if f.PrimaryKey {
-			keys[name] = param[name]
+			v, found := param[name]
+			if !found {
+				return nil, nil, &simplerest.ValidationError{Field: name, Message: "missing primary key"}
+			}
+			keys[name] = v
+		} else if _, found := param[name]; !found && (name == res.VersionField || replace && f.Modifiable) {
+			return nil, nil, &simplerest.ValidationError{Field: name, Message: "missing field"}
 		}
 	}
-	var oldEntity map[string]interface{}
-	// prepare old entity for triggers
-	if before != nil || after != nil {
-		var err error
-		if oldEntity, err = res.Get(param, request); err != nil {
-			logging.Error("Get old %s entity %v fail: %s", res.Name, keys, err.Error())
-			return nil, errCreateFail
-		}
+	res.stampUpdate(param, request)
+	return param, keys, nil
+}
+
+func (res *Resource) update(tx *sql.Tx, keys, param map[string]interface{}, before, after []simplerest.Trigger, request *webserver.Request) (map[string]interface{}, error) {
+	oldEntity, err := res.Get(keys, request)
+	if err != nil {
+		logging.Error("Get old %s entity %v fail: %s", res.Name, keys, err.Error())
+		return nil, errUpdateFail
+	} else if oldEntity == nil {
+		return nil, simplerest.ErrNotFound
 	}
 	// before update trigger
-	if before != nil {
-		for _, trigger := range before {
-			if err := trigger.Handle(res.Name, oldEntity, param, request); err != nil {
-				logging.Error("invoke trigger before update of resource %s fail: %s", res.Name, err.Error())
-				return nil, fmt.Errorf("before update trigger fail: %s", err.Error())
-			}
+	for _, trigger := range before {
+		if err := trigger.Handle(res.Name, oldEntity, param, request); err != nil {
+			logging.Error("invoke trigger before update of resource %s fail: %s", res.Name, err.Error())
+			return nil, &simplerest.TriggerError{Operation: "update", Before: true, Err: err}
 		}
 	}
 
@@ -292,6 +365,10 @@ func (res *Resource) Update(param map[string]interface{}, before, after []simple
 	conditionValues := make([]interface{}, 0, 1)
 	for name, f := range res.Fields {
 		if f.PrimaryKey {
+			conditions = append(conditions, name+"=?")
+			conditionValues = append(conditionValues, keys[name])
+		} else if name == res.VersionField {
+			fieldNames = append(fieldNames, name+"="+name+"+1")
 			conditions = append(conditions, name+"=?")
 			conditionValues = append(conditionValues, param[name])
 		} else if v, found := param[name]; found {
@@ -299,37 +376,112 @@ func (res *Resource) Update(param map[string]interface{}, before, after []simple
 			values = append(values, v)
 		}
 	}
-	statement := fmt.Sprintf("UPDATE %s SET %s WHERE %s", res.Name,
-		strings.Join(fieldNames, ", "), strings.Join(conditions, " AND "))
-	if result, err := res.DB.Exec(statement); err != nil {
-		logging.Error("Update %s entity fail: %s", res.Name, err.Error())
-		return nil, errUpdateFail
-	} else if count, err := result.RowsAffected(); err != nil {
-		logging.Error("Update %s entity fail: cannot get count of rows affected, %s",
-			res.Name, err.Error())
-		return nil, errUpdateFail
-	} else if count == 0 {
-		logging.Warn("No %s entity updated", res.Name)
-		return nil, errUpdateFail
-	} else if count > 1 {
-		logging.Error("More than one %s entity updated: %s", res.Name, statement)
+	if condition := res.notDeleted(); condition != "" {
+		conditions = append(conditions, condition)
+	}
+	if len(fieldNames) > 0 {
+		statement := fmt.Sprintf("UPDATE %s SET %s WHERE %s", res.Name,
+			strings.Join(fieldNames, ", "), strings.Join(conditions, " AND "))
+		if result, err := tx.Exec(statement, append(values, conditionValues...)...); err != nil {
+			if isDuplicateKeyError(err) {
+				return nil, simplerest.ErrConflict
+			}
+			logging.Error("Update %s entity fail: %s", res.Name, err.Error())
+			return nil, errUpdateFail
+		} else if count, err := result.RowsAffected(); err != nil {
+			logging.Error("Update %s entity fail: cannot get count of rows affected, %s",
+				res.Name, err.Error())
+			return nil, errUpdateFail
+		} else if count == 0 && res.VersionField != "" {
+			// the entity exists, so the version is outdated
+			return nil, simplerest.ErrConflict
+		} else if count > 1 {
+			logging.Error("More than one %s entity updated: %s", res.Name, statement)
+			return nil, errUpdateFail
+		}
 	}
 	entity, err := res.Get(keys, request)
 	if err != nil {
 		return nil, errUpdateFail
+	} else if entity == nil {
+		return nil, simplerest.ErrNotFound
 	}
 	// after update trigger
-	if after != nil {
-		for _, trigger := range after {
-			if err := trigger.Handle(res.Name, oldEntity, entity, request); err != nil {
-				logging.Error("invoke trigger after update of resource %s fail: %s", res.Name, err.Error())
-				return nil, fmt.Errorf("after update trigger fail: %s", err.Error())
-			}
+	for _, trigger := range after {
+		if err := trigger.Handle(res.Name, oldEntity, entity, request); err != nil {
+			logging.Error("invoke trigger after update of resource %s fail: %s", res.Name, err.Error())
+			return nil, &simplerest.TriggerError{Operation: "update", Err: err}
 		}
 	}
 	return entity, nil
 }
 
+// Delete removes the entity and invokes triggers in a transaction. With VersionField, the version
+// param is checked like Update if set. With SoftDeleteField, the entity is marked deleted, and
+// the version and update audit fields are updated as well.
+func (res *Resource) Delete(param map[string]interface{}, before, after []simplerest.Trigger, request *webserver.Request) (map[string]interface{}, error) {
+	param = res.filterParam(param)
+	if err := res.DecodeParams(param, request); err != nil {
+		return nil, err
+	}
+	return res.transaction(request, errDeleteFail, func(tx *sql.Tx) (map[string]interface{}, error) {
+		return res.delete(tx, param, before, after, request)
+	})
+}
+
+func (res *Resource) delete(tx *sql.Tx, param map[string]interface{}, before, after []simplerest.Trigger, request *webserver.Request) (map[string]interface{}, error) {
+	oldEntity, err := res.Get(param, request)
+	if err != nil {
+		return nil, err
+	} else if oldEntity == nil {
+		return nil, simplerest.ErrNotFound
+	}
+	// before delete trigger
+	for _, trigger := range before {
+		if err := trigger.Handle(res.Name, oldEntity, nil, request); err != nil {
+			logging.Error("invoke trigger before delete of resource %s fail: %s", res.Name, err.Error())
+			return nil, &simplerest.TriggerError{Operation: "delete", Before: true, Err: err}
+		}
+	}
+	conditions := make([]string, 0, 1)
+	conditionValues := make([]interface{}, 0, 1)
+	for name, f := range res.Fields {
+		if _, found := param[name]; f.PrimaryKey || (name == res.VersionField && found) {
+			conditions = append(conditions, name+"=?")
+			conditionValues = append(conditionValues, param[name])
+		}
+	}
+	statement := fmt.Sprintf("DELETE FROM %s WHERE %s", res.Name, strings.Join(conditions, " AND "))
+	if res.SoftDeleteField != "" {
+		statement, conditionValues = res.softDeleteStatement(conditions, conditionValues, request)
+	}
+	if result, err := tx.Exec(statement, conditionValues...); err != nil {
+		logging.Error("Delete %s entity fail: %s", res.Name, err.Error())
+		return nil, errDeleteFail
+	} else if count, err := result.RowsAffected(); err != nil {
+		logging.Error("Delete %s entity fail: cannot get count of rows affected, %s",
+			res.Name, err.Error())
+		return nil, errDeleteFail
+	} else if count == 0 {
+		// the entity was found, so the version is outdated or it is deleted concurrently
+		return nil, simplerest.ErrConflict
+	}
+	// after delete trigger
+	for _, trigger := range after {
+		if err := trigger.Handle(res.Name, oldEntity, nil, request); err != nil {
+			logging.Error("invoke trigger after delete of resource %s fail: %s", res.Name, err.Error())
+			return nil, &simplerest.TriggerError{Operation: "delete", Err: err}
+		}
+	}
+	return oldEntity, nil
+}
+
+// isDuplicateKeyError reports whether err is a unique constraint violation of common drivers
+func isDuplicateKeyError(err error) bool {
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "duplicate") || strings.Contains(message, "unique constraint")
+}
+
 func (res *Resource) scanEntity(values []interface{}) map[string]interface{} {
 	entity := make(map[string]interface{})
 	for name, f := range res.Fields {
@@ -0,0 +1,69 @@
+package sqlresource
+
+import (
+	"github.com/yangchenxing/cangshan/client/sql"
+	"github.com/yangchenxing/cangshan/logging"
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+// TxAttrKey is the request attribute of the transactions of the running creates, updates or
+// deletes by DB, a map[*sql.DB]*sql.Tx, so that triggers can make their changes in the same
+// transaction.
+const TxAttrKey = "sqlresource.tx"
+
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// RequestTx returns the transaction on db of the running create, update or delete of the request,
+// or nil if there is none. Transactions on other DBs are never returned.
+func RequestTx(request *webserver.Request, db *sql.DB) *sql.Tx {
+	txs, _ := request.Attr[TxAttrKey].(map[*sql.DB]*sql.Tx)
+	return txs[db]
+}
+
+// querier returns the transaction of the request on the DB of the resource if any, or the traced
+// DB
+func (res *Resource) querier(request *webserver.Request) querier {
+	if tx := RequestTx(request, res.DB); tx != nil {
+		return tx
+	}
+	return res.DB.WithSpan(request.Span())
+}
+
+// transaction runs operation in a transaction set in the request attributes, and commits it if
+// operation succeeds or rolls it back otherwise. If the request already has a transaction on the
+// DB of the resource, the operation joins it and the owner of the transaction commits or rolls
+// back.
+func (res *Resource) transaction(request *webserver.Request, fail error,
+	operation func(tx *sql.Tx) (map[string]interface{}, error)) (map[string]interface{}, error) {
+	if tx := RequestTx(request, res.DB); tx != nil {
+		return operation(tx)
+	}
+	tx, err := res.DB.Begin()
+	if err != nil {
+		logging.Error("Begin %s transaction fail: %s", res.Name, err.Error())
+		return nil, fail
+	}
+	txs, _ := request.Attr[TxAttrKey].(map[*sql.DB]*sql.Tx)
+	if txs == nil {
+		txs = make(map[*sql.DB]*sql.Tx)
+		request.Attr[TxAttrKey] = txs
+	}
+	txs[res.DB] = tx
+	defer delete(txs, res.DB)
+	entity, err := operation(tx)
+	if err != nil {
+		if err := tx.Rollback(); err != nil {
+			logging.Error("Rollback %s transaction fail: %s", res.Name, err.Error())
+		}
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		logging.Error("Commit %s transaction fail: %s", res.Name, err.Error())
+		return nil, fail
+	}
+	return entity, nil
+}
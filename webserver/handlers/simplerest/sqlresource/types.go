@@ -2,11 +2,17 @@ package sqlresource
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/yangchenxing/cangshan/application"
 	cssql "github.com/yangchenxing/cangshan/client/sql"
+	"math"
 	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -21,6 +27,12 @@ func init() {
 	application.RegisterBuiltinModule("SimpleREST.SQLResource.NullStringType", new(NullStringType))
 	application.RegisterBuiltinModule("SimpleREST.SQLResource.DefaultNullTimeType", new(NullTime))
 	application.RegisterModulePrototype("SimpleRESTSQLResourceNullTimeType", new(NullTime))
+	application.RegisterBuiltinModule("SimpleREST.SQLResource.JSONType", new(JSONType))
+	application.RegisterBuiltinModule("SimpleREST.SQLResource.DecimalType", new(DecimalType))
+	application.RegisterModulePrototype("SimpleRESTSQLResourceDecimalType", new(DecimalType))
+	application.RegisterModulePrototype("SimpleRESTSQLResourceEnumType", new(EnumType))
+	application.RegisterBuiltinModule("SimpleREST.SQLResource.BytesType", new(BytesType))
+	application.RegisterBuiltinModule("SimpleREST.SQLResource.UUIDType", new(UUIDType))
 }
 
 type Int64Type struct{}
@@ -37,6 +49,12 @@ func (t Int64Type) Decode(i interface{}) (interface{}, error) {
 		return v, nil
 	case uint, uint8, uint16, uint32, uint64:
 		return int(reflect.ValueOf(i).Uint()), nil
+	case float64:
+		// numbers of json bodies are decoded as float64
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return nil, fmt.Errorf("Not an integer: %v", v)
+		}
+		return int64(v), nil
 	case string:
 		return strconv.ParseInt(v, 10, 64)
 	}
@@ -290,3 +308,225 @@ func (t NullTime) Encode(i interface{}) interface{} {
 	}
 	return v.Time
 }
+
+// Structured types, all nullable
+
+// JSONType stores JSON values as text. Strings are decoded as JSON text, and other values are
+// marshaled, so JSON request bodies may contain nested objects.
+type JSONType struct{}
+
+func (t JSONType) ValueHolder() interface{} {
+	return new(sql.NullString)
+}
+
+func (t JSONType) Decode(i interface{}) (interface{}, error) {
+	switch v := i.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "null" {
+			return nil, nil
+		} else if !json.Valid([]byte(v)) {
+			return nil, errors.New("Invalid JSON value")
+		}
+		return v, nil
+	case json.RawMessage:
+		return t.Decode(string(v))
+	}
+	data, err := json.Marshal(i)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JSON value: %s", err.Error())
+	}
+	return string(data), nil
+}
+
+func (t JSONType) Encode(i interface{}) interface{} {
+	v := *(i.(*sql.NullString))
+	if !v.Valid {
+		return nil
+	}
+	return json.RawMessage(v.String)
+}
+
+func (t JSONType) APISchema() map[string]interface{} {
+	return map[string]interface{}{"nullable": true}
+}
+
+var decimalPattern = regexp.MustCompile(`^[-+]?(\d+)(?:\.(\d+))?$`)
+
+// DecimalType stores exact decimals, encoded as strings like "-12.50" to keep the precision.
+// Precision and Scale limit the total digits and the digits after the point if set.
+type DecimalType struct {
+	Precision int
+	Scale     int
+}
+
+func (t DecimalType) ValueHolder() interface{} {
+	return new(sql.NullString)
+}
+
+func (t DecimalType) Decode(i interface{}) (interface{}, error) {
+	var text string
+	switch v := i.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "null" || v == "nil" {
+			return nil, nil
+		}
+		text = v
+	case json.Number:
+		text = string(v)
+	case int, int8, int16, int32, int64:
+		text = strconv.FormatInt(reflect.ValueOf(i).Int(), 10)
+	case uint, uint8, uint16, uint32, uint64:
+		text = strconv.FormatUint(reflect.ValueOf(i).Uint(), 10)
+	case float64:
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return nil, fmt.Errorf("Unsupported type: %T", i)
+	}
+	match := decimalPattern.FindStringSubmatch(text)
+	if match == nil {
+		return nil, fmt.Errorf("Invalid decimal value: %s", text)
+	}
+	integer := strings.TrimLeft(match[1], "0")
+	if t.Scale > 0 && len(match[2]) > t.Scale {
+		return nil, fmt.Errorf("Decimal value %s exceeds scale %d", text, t.Scale)
+	} else if t.Precision > 0 && len(integer)+len(match[2]) > t.Precision {
+		return nil, fmt.Errorf("Decimal value %s exceeds precision %d", text, t.Precision)
+	}
+	return strings.TrimPrefix(text, "+"), nil
+}
+
+func (t DecimalType) Encode(i interface{}) interface{} {
+	v := *(i.(*sql.NullString))
+	if !v.Valid {
+		return nil
+	}
+	return v.String
+}
+
+func (t DecimalType) APISchema() map[string]interface{} {
+	return map[string]interface{}{"type": "string", "format": "decimal", "nullable": true}
+}
+
+// EnumType stores strings of Values
+type EnumType struct {
+	Values []string
+}
+
+func (t *EnumType) Initialize() error {
+	if len(t.Values) == 0 {
+		return errors.New("Missing Values")
+	}
+	return nil
+}
+
+func (t EnumType) ValueHolder() interface{} {
+	return new(sql.NullString)
+}
+
+func (t EnumType) Decode(i interface{}) (interface{}, error) {
+	switch v := i.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "null" || v == "nil" {
+			return nil, nil
+		}
+		for _, value := range t.Values {
+			if v == value {
+				return v, nil
+			}
+		}
+		return nil, fmt.Errorf("Invalid enum value: %s", v)
+	}
+	return nil, fmt.Errorf("Unsupported type: %T", i)
+}
+
+func (t EnumType) Encode(i interface{}) interface{} {
+	v := *(i.(*sql.NullString))
+	if !v.Valid {
+		return nil
+	}
+	return v.String
+}
+
+func (t EnumType) APISchema() map[string]interface{} {
+	return map[string]interface{}{"type": "string", "enum": t.Values, "nullable": true}
+}
+
+// BytesType stores binary values, encoded as standard base64 strings
+type BytesType struct{}
+
+func (t BytesType) ValueHolder() interface{} {
+	return new([]byte)
+}
+
+func (t BytesType) Decode(i interface{}) (interface{}, error) {
+	switch v := i.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return v, nil
+	case string:
+		if v == "null" || v == "nil" {
+			return nil, nil
+		}
+		data, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid base64 value: %s", err.Error())
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("Unsupported type: %T", i)
+}
+
+func (t BytesType) Encode(i interface{}) interface{} {
+	v := *(i.(*[]byte))
+	if v == nil {
+		return nil
+	}
+	return base64.StdEncoding.EncodeToString(v)
+}
+
+func (t BytesType) APISchema() map[string]interface{} {
+	return map[string]interface{}{"type": "string", "format": "byte", "nullable": true}
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// UUIDType stores UUIDs as lower case strings like "123e4567-e89b-12d3-a456-426614174000"
+type UUIDType struct{}
+
+func (t UUIDType) ValueHolder() interface{} {
+	return new(sql.NullString)
+}
+
+func (t UUIDType) Decode(i interface{}) (interface{}, error) {
+	switch v := i.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "null" || v == "nil" {
+			return nil, nil
+		} else if !uuidPattern.MatchString(v) {
+			return nil, fmt.Errorf("Invalid UUID value: %s", v)
+		}
+		return strings.ToLower(v), nil
+	}
+	return nil, fmt.Errorf("Unsupported type: %T", i)
+}
+
+func (t UUIDType) Encode(i interface{}) interface{} {
+	v := *(i.(*sql.NullString))
+	if !v.Valid {
+		return nil
+	}
+	return v.String
+}
+
+func (t UUIDType) APISchema() map[string]interface{} {
+	return map[string]interface{}{"type": "string", "format": "uuid", "nullable": true}
+}
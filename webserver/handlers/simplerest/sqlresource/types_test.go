@@ -0,0 +1,28 @@
+package sqlresource
+
+import (
+	"testing"
+)
+
+func TestInt64TypeDecode(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		ok    bool
+	}{
+		{int64(3), true},
+		{float64(3), true},
+		{float64(-3), true},
+		{"3", true},
+		{3.5, false},
+		{1e20, false},
+		{true, false},
+	}
+	for _, test := range tests {
+		value, err := Int64Type{}.Decode(test.value)
+		if test.ok && (err != nil || value.(int64)*value.(int64) != 9) {
+			t.Errorf("Decode(%#v) = %#v, %v", test.value, value, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("Decode(%#v) accepted", test.value)
+		}
+	}
+}
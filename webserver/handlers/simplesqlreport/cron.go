@@ -0,0 +1,121 @@
+package simplereport
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// A cronSchedule is a parsed cron expression of minute, hour, day of month, month and day of
+// week, each field a bit set of allowed values
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are true if the field is "*", since days match if either field matches
+	// when both are restricted
+	domAny, dowAny bool
+}
+
+var cronBounds = [5]struct{ min, max int }{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseCron parses a cron expression of 5 fields, supporting "*", lists, ranges, steps and the
+// macros @hourly, @daily, @weekly, @monthly and @yearly
+func parseCron(expression string) (*cronSchedule, error) {
+	if macro, found := cronMacros[strings.TrimSpace(expression)]; found {
+		expression = macro
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid cron expression: %s", expression)
+	}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronBounds[i].min, cronBounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cron expression %s: %s", expression, err.Error())
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSchedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step %s", item)
+			}
+			item = item[:i]
+		}
+		start, end := min, max
+		if item != "*" {
+			var err error
+			if i := strings.Index(item, "-"); i >= 0 {
+				if start, err = strconv.Atoi(item[:i]); err == nil {
+					end, err = strconv.Atoi(item[i+1:])
+				}
+			} else if start, err = strconv.Atoi(item); err == nil && step == 1 {
+				end = start
+			}
+			if err != nil || start < min || end > max || start > end {
+				return 0, fmt.Errorf("bad range %s", item)
+			}
+		}
+		for v := start; v <= end; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// next returns the first time matching the schedule after t, in the location of t
+func (schedule *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// any valid schedule matches within 4 years, for February 29th
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if schedule.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		} else if !schedule.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		} else if schedule.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		} else if schedule.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+		} else {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (schedule *cronSchedule) matchDay(t time.Time) bool {
+	dom := schedule.dom&(1<<uint(t.Day())) != 0
+	dow := schedule.dow&(1<<uint(t.Weekday())) != 0
+	if !schedule.domAny && !schedule.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
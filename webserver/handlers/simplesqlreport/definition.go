@@ -0,0 +1,152 @@
+package simplereport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"text/template"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/client/email"
+	"github.com/yangchenxing/cangshan/strings"
+)
+
+func init() {
+	application.RegisterModulePrototype("SimpleReportDefinition", new(ReportDefinition))
+}
+
+const defaultReportSubject = "%(name) %(date)"
+
+// A ReportDefinition renders several named Datasets, each the result of a SimpleReport run with
+// the same params, into a mail. Subject is formatted by stringutil.MapFormatter with the params,
+// "name" and "date", and TextTemplate and HTMLTemplate are Go templates of ReportData. Datasets
+// named in Attach, or all datasets if Attach is empty, are attached as CSV files.
+type ReportDefinition struct {
+	Name     string
+	Datasets []struct {
+		Name   string
+		Report *SimpleReport
+	}
+	Subject      string
+	TextTemplate string
+	HTMLTemplate string
+	Attach       []string
+	subject      *stringutil.MapFormatter
+	text         *template.Template
+	html         *htmltemplate.Template
+}
+
+// ReportData is the data of report templates
+type ReportData struct {
+	Name     string
+	Params   map[string]interface{}
+	Time     time.Time
+	Datasets map[string]*Dataset
+}
+
+// A Dataset is a result with its totals, if the report has Totals
+type Dataset struct {
+	Columns []string
+	Rows    []map[string]interface{}
+	Totals  map[string]interface{}
+}
+
+func (definition *ReportDefinition) Initialize() error {
+	if definition.Name == "" {
+		return errors.New("Missing Name")
+	} else if len(definition.Datasets) == 0 {
+		return errors.New("Missing Datasets")
+	}
+	names := make(map[string]bool)
+	for _, dataset := range definition.Datasets {
+		if dataset.Name == "" || dataset.Report == nil || names[dataset.Name] {
+			return fmt.Errorf("Invalid dataset: %s", dataset.Name)
+		}
+		names[dataset.Name] = true
+	}
+	for _, name := range definition.Attach {
+		if !names[name] {
+			return fmt.Errorf("Unknown attached dataset: %s", name)
+		}
+	}
+	if definition.Subject == "" {
+		definition.Subject = defaultReportSubject
+	}
+	definition.subject = stringutil.NewMapFormatter(definition.Subject)
+	var err error
+	if definition.TextTemplate != "" {
+		if definition.text, err = template.New(definition.Name).Parse(definition.TextTemplate); err != nil {
+			return fmt.Errorf("Parse TextTemplate fail: %s", err.Error())
+		}
+	}
+	if definition.HTMLTemplate != "" {
+		if definition.html, err = htmltemplate.New(definition.Name).Parse(definition.HTMLTemplate); err != nil {
+			return fmt.Errorf("Parse HTMLTemplate fail: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// Render runs the datasets with params and renders the mail of the run at now, which is the
+// scheduled time of scheduled runs
+func (definition *ReportDefinition) Render(params map[string]interface{}, now time.Time) (*email.Message, error) {
+	data := &ReportData{
+		Name:     definition.Name,
+		Params:   params,
+		Time:     now,
+		Datasets: make(map[string]*Dataset),
+	}
+	message := new(email.Message)
+	attached := make(map[string]bool)
+	for _, name := range definition.Attach {
+		attached[name] = true
+	}
+	for _, dataset := range definition.Datasets {
+		result, err := dataset.Report.Run(params)
+		if err != nil {
+			return nil, fmt.Errorf("Run dataset %s fail: %s", dataset.Name, err.Error())
+		}
+		data.Datasets[dataset.Name] = &Dataset{
+			Columns: result.Columns,
+			Rows:    result.Rows,
+			Totals:  computeTotals(result.Rows, dataset.Report.totalColumns(result)),
+		}
+		if len(attached) > 0 && !attached[dataset.Name] {
+			continue
+		}
+		var buffer bytes.Buffer
+		writer, _ := newTableWriter(CSVFormat, &buffer)
+		if err := dataset.Report.writeTable(writer, result); err != nil {
+			return nil, fmt.Errorf("Write dataset %s fail: %s", dataset.Name, err.Error())
+		} else if err := writer.Close(); err != nil {
+			return nil, fmt.Errorf("Write dataset %s fail: %s", dataset.Name, err.Error())
+		}
+		message.Attachments = append(message.Attachments, email.Attachment{
+			Name:        dataset.Name + ".csv",
+			ContentType: formatContentTypes[CSVFormat],
+			Content:     buffer.Bytes(),
+		})
+	}
+	values := map[string]interface{}{"name": definition.Name, "date": data.Time.Format("2006-01-02")}
+	for key, value := range params {
+		values[key] = value
+	}
+	message.Subject = definition.subject.Format(values)
+	if definition.text != nil {
+		var buffer bytes.Buffer
+		if err := definition.text.Execute(&buffer, data); err != nil {
+			return nil, fmt.Errorf("Render text fail: %s", err.Error())
+		}
+		message.Text = buffer.String()
+	}
+	if definition.html != nil {
+		var buffer bytes.Buffer
+		if err := definition.html.Execute(&buffer, data); err != nil {
+			return nil, fmt.Errorf("Render html fail: %s", err.Error())
+		}
+		message.HTML = buffer.String()
+	}
+	return message, nil
+}
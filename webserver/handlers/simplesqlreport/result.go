@@ -0,0 +1,148 @@
+package simplereport
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// A Result is the rows of a report, with the columns in order. Pivot columns follow the fields.
+type Result struct {
+	Columns []string
+	Rows    []map[string]interface{}
+}
+
+// A Pivot turns the distinct values of the Key field into columns holding the sum of the Value
+// field, with rows grouped by the other fields. Pivot columns are totaled if Totals is true.
+type Pivot struct {
+	Key    string
+	Value  string
+	Totals bool
+}
+
+// pivot returns the pivoted result, with pivot columns in the order of appearance
+func (pivot *Pivot) pivot(result *Result) *Result {
+	pivoted := &Result{}
+	for _, column := range result.Columns {
+		if column != pivot.Key && column != pivot.Value {
+			pivoted.Columns = append(pivoted.Columns, column)
+		}
+	}
+	base := len(pivoted.Columns)
+	seenColumns := make(map[string]bool)
+	index := make(map[string]map[string]interface{})
+	for _, row := range result.Rows {
+		column := fmt.Sprint(row[pivot.Key])
+		if !seenColumns[column] {
+			seenColumns[column] = true
+			pivoted.Columns = append(pivoted.Columns, column)
+		}
+		key := make([]interface{}, base)
+		for i, name := range pivoted.Columns[:base] {
+			key[i] = row[name]
+		}
+		rowKey := fmt.Sprintf("%#v", key)
+		target, found := index[rowKey]
+		if !found {
+			target = make(map[string]interface{}, len(row))
+			for _, name := range pivoted.Columns[:base] {
+				target[name] = row[name]
+			}
+			index[rowKey] = target
+			pivoted.Rows = append(pivoted.Rows, target)
+		}
+		target[column] = sum(target[column], row[pivot.Value])
+	}
+	return pivoted
+}
+
+// A group is the rows with the same value of a group key
+type group struct {
+	value  interface{}
+	rows   []map[string]interface{}
+	groups []*group
+	totals map[string]interface{}
+}
+
+// groupRows groups rows by keys from level, in the order of appearance
+func groupRows(rows []map[string]interface{}, keys []string, level int, totals []string) []*group {
+	var groups []*group
+	index := make(map[string]*group)
+	for _, row := range rows {
+		value := fmt.Sprintf("%#v", row[keys[level]])
+		g, found := index[value]
+		if !found {
+			g = &group{value: row[keys[level]]}
+			index[value] = g
+			groups = append(groups, g)
+		}
+		g.rows = append(g.rows, row)
+	}
+	for _, g := range groups {
+		g.totals = computeTotals(g.rows, totals)
+		if level+1 < len(keys) {
+			g.groups = groupRows(g.rows, keys, level+1, totals)
+		}
+	}
+	return groups
+}
+
+func computeTotals(rows []map[string]interface{}, columns []string) map[string]interface{} {
+	if len(columns) == 0 {
+		return nil
+	}
+	totals := make(map[string]interface{}, len(columns))
+	for _, column := range columns {
+		var total interface{}
+		for _, row := range rows {
+			total = sum(total, row[column])
+		}
+		totals[column] = total
+	}
+	return totals
+}
+
+// sum adds numbers, keeping integers while all values are integers. Nil and non-numeric values
+// are ignored, and decimal strings are added as floats.
+func sum(a, b interface{}) interface{} {
+	if a == nil {
+		return number(b)
+	}
+	b = number(b)
+	if b == nil {
+		return a
+	}
+	x, xInt := a.(int64)
+	y, yInt := b.(int64)
+	if xInt && yInt {
+		return x + y
+	}
+	return toFloat(a) + toFloat(b)
+}
+
+func number(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float32:
+		return float64(n)
+	case float64:
+		return n
+	case string:
+		if f, err := strconv.ParseFloat(n, 64); err == nil {
+			return f
+		}
+	}
+	return nil
+}
+
+func toFloat(v interface{}) float64 {
+	if n, ok := v.(int64); ok {
+		return float64(n)
+	}
+	f, _ := v.(float64)
+	return f
+}
@@ -0,0 +1,111 @@
+package simplereport
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/client/email"
+	"github.com/yangchenxing/cangshan/logging"
+	"github.com/yangchenxing/cangshan/strings"
+)
+
+func init() {
+	application.RegisterModulePrototype("SimpleReportScheduler", new(ReportScheduler))
+}
+
+// A ReportScheduler mails reports by cron expressions of Jobs in TimeZone, local if empty.
+// String params with verbs are formatted by stringutil.MapFormat with "now", "today", "yesterday",
+// "month" and "lastmonth" of the run time, e.g. "%(yesterday)".
+type ReportScheduler struct {
+	EMail    *email.EMail
+	TimeZone string
+	Jobs     []*struct {
+		Name      string
+		Cron      string
+		Report    *ReportDefinition
+		Params    map[string]interface{}
+		Receivers []string
+	}
+	location *time.Location
+}
+
+func (scheduler *ReportScheduler) Initialize() error {
+	if scheduler.EMail == nil {
+		return errors.New("Missing EMail")
+	}
+	scheduler.location = time.Local
+	if scheduler.TimeZone != "" {
+		location, err := time.LoadLocation(scheduler.TimeZone)
+		if err != nil {
+			return fmt.Errorf("Load TimeZone fail: %s", err.Error())
+		}
+		scheduler.location = location
+	}
+	schedules := make([]*cronSchedule, len(scheduler.Jobs))
+	for i, job := range scheduler.Jobs {
+		if job.Report == nil {
+			return fmt.Errorf("Missing Report of job %s", job.Name)
+		}
+		schedule, err := parseCron(job.Cron)
+		if err != nil {
+			return err
+		}
+		schedules[i] = schedule
+		if job.Name == "" {
+			job.Name = job.Report.Name
+		}
+	}
+	for i, job := range scheduler.Jobs {
+		job := job
+		go scheduler.run(job.Name, schedules[i], func(now time.Time) error {
+			return scheduler.send(job.Report, job.Params, job.Receivers, now)
+		})
+	}
+	return nil
+}
+
+func (scheduler *ReportScheduler) run(name string, schedule *cronSchedule, job func(time.Time) error) {
+	for {
+		next := schedule.next(time.Now().In(scheduler.location))
+		if next.IsZero() {
+			logging.Error("Report job %s will never run", name)
+			return
+		}
+		time.Sleep(next.Sub(time.Now()))
+		logging.Info("Run report job %s", name)
+		if err := job(next); err != nil {
+			logging.Error("Run report job %s fail: %s", name, err.Error())
+		}
+	}
+}
+
+func (scheduler *ReportScheduler) send(report *ReportDefinition, params map[string]interface{}, receivers []string, now time.Time) error {
+	message, err := report.Render(jobParams(params, now), now)
+	if err != nil {
+		return err
+	}
+	return scheduler.EMail.Send(message, receivers...)
+}
+
+// jobParams returns params with string values formatted by the run time. Formatters are not
+// cached, since the cache of stringutil is not safe for concurrent jobs.
+func jobParams(params map[string]interface{}, now time.Time) map[string]interface{} {
+	vars := map[string]interface{}{
+		"now":       now.Format("2006-01-02 15:04:05"),
+		"today":     now.Format("2006-01-02"),
+		"yesterday": now.AddDate(0, 0, -1).Format("2006-01-02"),
+		"month":     now.Format("2006-01"),
+		"lastmonth": time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, now.Location()).Format("2006-01"),
+	}
+	values := make(map[string]interface{}, len(params))
+	for key, value := range params {
+		if s, ok := value.(string); ok && strings.Contains(s, "%(") {
+			value = stringutil.MapFormatNoCache(s, vars)
+		}
+		values[key] = value
+	}
+	return values
+}
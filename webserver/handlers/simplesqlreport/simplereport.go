@@ -1,10 +1,18 @@
 package simplereport
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"net/http"
 
 	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/cache"
 	"github.com/yangchenxing/cangshan/client/sql"
+	"github.com/yangchenxing/cangshan/logging"
+	"github.com/yangchenxing/cangshan/tracing"
 	"github.com/yangchenxing/cangshan/webserver"
 	"github.com/yangchenxing/cangshan/webserver/handlers/simplerest/sqlresource"
 )
@@ -13,71 +21,362 @@ func init() {
 	application.RegisterModulePrototype("WebServerSimpleReport", new(SimpleReport))
 }
 
+// FormatParam selects the export format: json (default), csv, tsv or xlsx
+const FormatParam = "format"
+
+const defaultCacheKeyPrefix = "simplereport."
+
+// A SimpleReport responds the rows of SQL with Params in order. Params without Default are
+// required. Rows are pivoted by Pivot if set, and grouped by GroupKeys level by level, with sums
+// of Totals columns for each group and for all rows. GroupKey groups rows into an object by
+// the key like former versions.
+//
+// Exports of csv, tsv and xlsx are streamed as the attachment Name, with Title of fields as
+// headers, and rows of subtotals after groups and of totals at the end. Results are cached in
+// Cache by Name, SQL, Fields, Pivot and params if set, and the cached values are *Result.
 type SimpleReport struct {
 	DB     *sql.DB
+	Name   string
 	SQL    string
 	Params []struct {
-		Name string
-		Type sqlresource.Type
+		Name    string
+		Type    sqlresource.Type
+		Default interface{}
 	}
 	Fields []struct {
-		Name string
-		Type sqlresource.Type
+		Name  string
+		Type  sqlresource.Type
+		Title string
+	}
+	GroupKey       string
+	GroupKeys      []string
+	Totals         []string
+	Pivot          *Pivot
+	Cache          cache.Cache
+	CacheKeyPrefix string
+	cacheKey       string
+}
+
+func (report *SimpleReport) Initialize() error {
+	if report.DB == nil {
+		return errors.New("Missing DB")
+	} else if report.SQL == "" {
+		return errors.New("Missing SQL")
+	}
+	if report.Name == "" {
+		report.Name = "report"
+	}
+	if report.CacheKeyPrefix == "" {
+		report.CacheKeyPrefix = defaultCacheKeyPrefix
+	}
+	fields := make(map[string]bool)
+	for _, field := range report.Fields {
+		fields[field.Name] = true
+	}
+	if report.Pivot != nil && (!fields[report.Pivot.Key] || !fields[report.Pivot.Value] ||
+		report.Pivot.Key == report.Pivot.Value) {
+		return fmt.Errorf("Invalid Pivot fields: %s, %s", report.Pivot.Key, report.Pivot.Value)
+	}
+	keys := append(append([]string(nil), report.GroupKeys...), report.Totals...)
+	if report.GroupKey != "" {
+		keys = append(keys, report.GroupKey)
+	}
+	for _, key := range keys {
+		if !fields[key] || report.Pivot != nil && (key == report.Pivot.Key || key == report.Pivot.Value) {
+			return fmt.Errorf("Invalid group or total field: %s", key)
+		}
 	}
-	GroupKey string
+	// results depend on fields and pivot as well as SQL, so reports sharing Cache do not collide
+	shape := report.SQL
+	for _, field := range report.Fields {
+		shape += fmt.Sprintf("\n%s %T", field.Name, field.Type)
+	}
+	if report.Pivot != nil {
+		shape += fmt.Sprintf("\n%+v", *report.Pivot)
+	}
+	report.cacheKey = fmt.Sprintf("%s%s.%08x.", report.CacheKeyPrefix, report.Name,
+		crc32.ChecksumIEEE([]byte(shape)))
+	return nil
 }
 
 func (report *SimpleReport) Handle(request *webserver.Request) {
+	params, err := report.decodeParams(request.Param)
+	if err != nil {
+		webserver.WriteStandardJSONResultWithStatus(request, http.StatusBadRequest, false,
+			"message", err.Error())
+		return
+	}
+	format, _ := request.Param[FormatParam].(string)
+	if format == "" {
+		format = JSONFormat
+	} else if _, found := formatContentTypes[format]; !found && format != JSONFormat {
+		webserver.WriteStandardJSONResultWithStatus(request, http.StatusBadRequest, false,
+			"message", fmt.Sprintf("unknown format `%s`", format))
+		return
+	}
+	result, err := report.result(params, request.Span())
+	if err != nil {
+		request.Error("Search report fail: %s", err.Error())
+		webserver.WriteStandardJSONResultWithStatus(request, http.StatusInternalServerError, false,
+			"message", "Server internal error")
+		return
+	}
+	if format == JSONFormat {
+		report.writeJSON(result, request)
+	} else {
+		report.export(result, format, request)
+	}
+}
+
+// Run returns the result of the report with params, like the params of requests
+func (report *SimpleReport) Run(values map[string]interface{}) (*Result, error) {
+	params, err := report.decodeParams(values)
+	if err != nil {
+		return nil, err
+	}
+	return report.result(params, nil)
+}
+
+func (report *SimpleReport) decodeParams(values map[string]interface{}) ([]interface{}, error) {
 	params := make([]interface{}, len(report.Params))
 	for i, param := range report.Params {
-		if p := request.Param[param.Name]; p == nil {
-			webserver.WriteStandardJSONResult(request, false, "message", fmt.Sprintf("missing param `%s`", param.Name))
-			return
+		p := values[param.Name]
+		if p == nil {
+			p = param.Default
+		}
+		if p == nil {
+			return nil, fmt.Errorf("missing param `%s`", param.Name)
 		} else if v, err := param.Type.Decode(p); err != nil {
-			webserver.WriteStandardJSONResult(request, false, "message", fmt.Sprintf("bad param `%s`", param.Name))
-			return
+			return nil, fmt.Errorf("bad param `%s`", param.Name)
 		} else {
 			params[i] = v
 		}
 	}
-	rows, err := report.DB.Query(report.SQL, params...)
+	return params, nil
+}
+
+// result queries the result, or loads it from Cache
+func (report *SimpleReport) result(params []interface{}, span *tracing.Span) (*Result, error) {
+	var key string
+	if report.Cache != nil {
+		encoded, err := json.Marshal(params)
+		if err != nil {
+			return nil, fmt.Errorf("Encode cache key fail: %s", err.Error())
+		}
+		key = report.cacheKey + string(encoded)
+		if value, found, err := report.Cache.Get(key); err != nil {
+			logging.Warn("Get report cache fail: %s", err.Error())
+		} else if result, ok := value.(*Result); found && ok {
+			return result, nil
+		}
+	}
+	result, err := report.query(params, span)
 	if err != nil {
-		request.Error("Search report fail: %s", err.Error())
-		webserver.WriteStandardJSONResult(request, false, "message", "Server internal error")
-		return
+		return nil, err
+	}
+	if report.Pivot != nil {
+		result = report.Pivot.pivot(result)
+	}
+	if report.Cache != nil {
+		if err := report.Cache.Set(key, result); err != nil {
+			logging.Warn("Set report cache fail: %s", err.Error())
+		}
 	}
+	return result, nil
+}
+
+func (report *SimpleReport) query(params []interface{}, span *tracing.Span) (*Result, error) {
+	rows, err := report.DB.WithSpan(span).Query(report.SQL, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := &Result{Columns: make([]string, len(report.Fields))}
 	row := make([]interface{}, len(report.Fields))
 	for i, field := range report.Fields {
-		row[i] = field.Type.ValueHolder()
+		result.Columns[i] = field.Name
 	}
-	records := make([]map[string]interface{}, 0, 32)
+	result.Rows = make([]map[string]interface{}, 0, 32)
 	for rows.Next() {
+		for i, field := range report.Fields {
+			row[i] = field.Type.ValueHolder()
+		}
 		if err := rows.Scan(row...); err != nil {
-			request.Error("Search report fail: %s", err.Error())
-			webserver.WriteStandardJSONResult(request, false, "message", "Server internal error")
-			return
+			return nil, err
 		}
 		record := make(map[string]interface{})
 		for i, field := range report.Fields {
 			record[field.Name] = field.Type.Encode(row[i])
 		}
-		records = append(records, record)
+		result.Rows = append(result.Rows, record)
 	}
-	if report.GroupKey != "" {
+	return result, rows.Err()
+}
+
+// totalColumns returns the columns to sum, including pivot columns if configured
+func (report *SimpleReport) totalColumns(result *Result) []string {
+	columns := report.Totals
+	if report.Pivot != nil && report.Pivot.Totals {
+		columns = append(append([]string(nil), columns...), result.Columns[len(report.Fields)-2:]...)
+	}
+	return columns
+}
+
+func (report *SimpleReport) writeJSON(result *Result, request *webserver.Request) {
+	totals := report.totalColumns(result)
+	params := []interface{}{"columns", result.Columns}
+	if len(totals) > 0 {
+		params = append(params, "totals", computeTotals(result.Rows, totals))
+	}
+	switch {
+	case len(report.GroupKeys) > 0:
+		params = append(params, "groups", jsonGroups(groupRows(result.Rows, report.GroupKeys, 0, totals),
+			report.GroupKeys, 0))
+	case report.GroupKey != "":
 		groups := make(map[string][]map[string]interface{})
-		for _, record := range records {
-			key, ok := record[report.GroupKey].(string)
-			if !ok {
-				webserver.WriteStandardJSONResult(request, false, "message", "group key must be string")
+		for _, record := range result.Rows {
+			key := fmt.Sprint(record[report.GroupKey])
+			groups[key] = append(groups[key], record)
+		}
+		params = append(params, "entities", groups)
+	default:
+		params = append(params, "entities", result.Rows)
+	}
+	webserver.WriteStandardJSONResult(request, true, params...)
+}
+
+func jsonGroups(groups []*group, keys []string, level int) []map[string]interface{} {
+	items := make([]map[string]interface{}, len(groups))
+	for i, g := range groups {
+		item := map[string]interface{}{"key": keys[level], "value": g.value}
+		if g.totals != nil {
+			item["totals"] = g.totals
+		}
+		if g.groups != nil {
+			item["groups"] = jsonGroups(g.groups, keys, level+1)
+		} else {
+			item["entities"] = g.rows
+		}
+		items[i] = item
+	}
+	return items
+}
+
+// export streams the result as a table, falling back to a buffered response if the response
+// writer cannot stream
+func (report *SimpleReport) export(result *Result, format string, request *webserver.Request) {
+	contentType := formatContentTypes[format]
+	request.ResponseHeader().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"%s.%s\"", report.Name, format))
+	var buffer *bytes.Buffer
+	stream, err := request.Stream(http.StatusOK, contentType)
+	if err != nil {
+		buffer = new(bytes.Buffer)
+		stream = buffer
+	}
+	writer, err := newTableWriter(format, stream)
+	if err == nil {
+		err = report.writeTable(writer, result)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		request.Error("Export report fail: %s", err.Error())
+		if buffer != nil {
+			request.Write(http.StatusInternalServerError, nil, "")
+		}
+		return
+	}
+	if buffer != nil {
+		request.Write(http.StatusOK, buffer.Bytes(), contentType)
+	}
+}
+
+func (report *SimpleReport) writeTable(writer tableWriter, result *Result) error {
+	titles := make(map[string]string)
+	for _, field := range report.Fields {
+		if field.Title != "" {
+			titles[field.Name] = field.Title
+		}
+	}
+	header := make([]interface{}, len(result.Columns))
+	for i, column := range result.Columns {
+		if title, found := titles[column]; found {
+			header[i] = title
+		} else {
+			header[i] = column
+		}
+	}
+	if err := writer.WriteRow(header); err != nil {
+		return err
+	}
+	totals := report.totalColumns(result)
+	if len(report.GroupKeys) > 0 {
+		if err := report.writeGroups(writer, result.Columns,
+			groupRows(result.Rows, report.GroupKeys, 0, totals), 0, nil); err != nil {
+			return err
+		}
+	} else {
+		for _, row := range result.Rows {
+			if err := writer.WriteRow(cells(result.Columns, row)); err != nil {
+				return err
 			}
-			group, found := groups[key]
-			if !found {
-				group = make([]map[string]interface{}, 0, 32)
+		}
+	}
+	if len(totals) > 0 {
+		return writer.WriteRow(report.totalRow(result.Columns, computeTotals(result.Rows, totals), nil, "Total"))
+	}
+	return nil
+}
+
+func (report *SimpleReport) writeGroups(writer tableWriter, columns []string, groups []*group, level int, values map[string]interface{}) error {
+	for _, g := range groups {
+		groupValues := map[string]interface{}{report.GroupKeys[level]: g.value}
+		for key, value := range values {
+			groupValues[key] = value
+		}
+		if g.groups != nil {
+			if err := report.writeGroups(writer, columns, g.groups, level+1, groupValues); err != nil {
+				return err
+			}
+		} else {
+			for _, row := range g.rows {
+				if err := writer.WriteRow(cells(columns, row)); err != nil {
+					return err
+				}
 			}
-			groups[key] = append(group, record)
 		}
-		webserver.WriteStandardJSONResult(request, true, "entities", groups)
-	} else {
-		webserver.WriteStandardJSONResult(request, true, "entities", records)
+		if g.totals != nil {
+			if err := writer.WriteRow(report.totalRow(columns, g.totals, groupValues, "Subtotal")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// totalRow returns a row of totals and group values, with the label in the first empty column
+func (report *SimpleReport) totalRow(columns []string, totals, values map[string]interface{}, label string) []interface{} {
+	row := make([]interface{}, len(columns))
+	labeled := false
+	for i, column := range columns {
+		if total, found := totals[column]; found {
+			row[i] = total
+		} else if value, found := values[column]; found {
+			row[i] = value
+		} else if !labeled {
+			row[i] = label
+			labeled = true
+		}
+	}
+	return row
+}
+
+func cells(columns []string, row map[string]interface{}) []interface{} {
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		values[i] = row[column]
 	}
+	return values
 }
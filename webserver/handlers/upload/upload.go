@@ -0,0 +1,215 @@
+package upload
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/filestore"
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerUpload", new(UploadHandler))
+}
+
+const (
+	defaultMaxMemory   = 10 << 20
+	defaultMaxFileSize = 32 << 20
+	sniffLength        = 512
+)
+
+// A File describes an uploaded file. It is stored in request.Param by form field name, as *File
+// or []*File if the field has multiple files. StoredName is set if the file was saved to Store.
+type File struct {
+	Field       string `json:"field"`
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+	StoredName  string `json:"storedName,omitempty"`
+	header      *multipart.FileHeader
+}
+
+// Open opens the uploaded content, which may be in memory or in a temporary file
+func (file *File) Open() (multipart.File, error) {
+	return file.header.Open()
+}
+
+// An UploadHandler exposes files of multipart/form-data requests in request.Param. Requests
+// with files violating the limits are stopped with 413 or 415. If Store is set, files are saved
+// under a random name prefixed with Prefix, keeping the extension of the original file name.
+// AllowedTypes accepts exact mime types or wildcards like "image/*", the type is sniffed from
+// the content rather than trusting the client.
+type UploadHandler struct {
+	MaxMemory    int64
+	MaxFileSize  int64
+	MaxTotalSize int64
+	MaxFiles     int
+	AllowedTypes []string
+	Fields       []string
+	Store        filestore.FileStore
+	Prefix       string
+	fields       map[string]bool
+}
+
+// Initialize the UploadHandler module for application
+func (handler *UploadHandler) Initialize() error {
+	if handler.MaxMemory == 0 {
+		handler.MaxMemory = defaultMaxMemory
+	}
+	if handler.MaxFileSize == 0 {
+		handler.MaxFileSize = defaultMaxFileSize
+	}
+	if len(handler.Fields) > 0 {
+		handler.fields = make(map[string]bool)
+		for _, field := range handler.Fields {
+			handler.fields[field] = true
+		}
+	}
+	return nil
+}
+
+func (handler *UploadHandler) Handle(request *webserver.Request) {
+	contentType := strings.ToLower(strings.Split(request.Header.Get("Content-Type"), ";")[0])
+	if strings.TrimSpace(contentType) != "multipart/form-data" {
+		return
+	}
+	if request.MultipartForm == nil {
+		if handler.MaxTotalSize > 0 {
+			request.Body = http.MaxBytesReader(request.GetHttpResponseWriter(), request.Body, handler.MaxTotalSize)
+		}
+		if err := request.ParseMultipartForm(handler.MaxMemory); err != nil {
+			request.Warn("Parse multipart/form-data fail: %s", err.Error())
+			handler.reject(request, http.StatusBadRequest, "bad multipart form")
+			return
+		}
+		for key, values := range request.MultipartForm.Value {
+			if len(values) > 0 {
+				request.Param[key] = values[0]
+			}
+		}
+	}
+	count := 0
+	var total int64
+	files := make(map[string][]*File)
+	for field, headers := range request.MultipartForm.File {
+		if handler.fields != nil && !handler.fields[field] {
+			continue
+		}
+		for _, header := range headers {
+			count++
+			total += header.Size
+			if handler.MaxFiles > 0 && count > handler.MaxFiles {
+				handler.reject(request, http.StatusRequestEntityTooLarge, "too many files")
+				return
+			} else if header.Size > handler.MaxFileSize {
+				handler.reject(request, http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("file %s exceeds %d bytes", header.Filename, handler.MaxFileSize))
+				return
+			} else if handler.MaxTotalSize > 0 && total > handler.MaxTotalSize {
+				handler.reject(request, http.StatusRequestEntityTooLarge, "files too large")
+				return
+			}
+			file := &File{
+				Field:    field,
+				Filename: filepath.Base(header.Filename),
+				Size:     header.Size,
+				header:   header,
+			}
+			var err error
+			if file.ContentType, err = sniffContentType(header); err != nil {
+				request.Error("Read uploaded file %s fail: %s", header.Filename, err.Error())
+				handler.reject(request, http.StatusBadRequest, "bad file")
+				return
+			} else if !handler.allowType(file.ContentType) {
+				handler.reject(request, http.StatusUnsupportedMediaType,
+					fmt.Sprintf("file type %s is not allowed", file.ContentType))
+				return
+			}
+			files[field] = append(files[field], file)
+		}
+	}
+	for field, fieldFiles := range files {
+		if handler.Store != nil {
+			for _, file := range fieldFiles {
+				if err := handler.store(file); err != nil {
+					request.Error("Save uploaded file %s fail: %s", file.Filename, err.Error())
+					webserver.WriteStandardJSONResultWithStatus(request, http.StatusInternalServerError,
+						false, "message", "save file fail")
+					request.Stop()
+					return
+				}
+				request.Debug("Save uploaded file %s as %s", file.Filename, file.StoredName)
+			}
+		}
+		if len(fieldFiles) == 1 {
+			request.Param[field] = fieldFiles[0]
+		} else {
+			request.Param[field] = fieldFiles
+		}
+	}
+}
+
+func (handler *UploadHandler) reject(request *webserver.Request, status int, message string) {
+	request.Info("Reject upload: %s", message)
+	webserver.WriteStandardJSONResultWithStatus(request, status, false, "message", message)
+	request.Stop()
+}
+
+func (handler *UploadHandler) allowType(contentType string) bool {
+	if len(handler.AllowedTypes) == 0 {
+		return true
+	}
+	for _, allowed := range handler.AllowedTypes {
+		if allowed == contentType {
+			return true
+		} else if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, allowed[:len(allowed)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (handler *UploadHandler) store(file *File) error {
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return err
+	}
+	name := time.Now().Format("20060102") + "/" + hex.EncodeToString(random[:]) +
+		strings.ToLower(filepath.Ext(file.Filename))
+	if handler.Prefix != "" {
+		name = path.Join(handler.Prefix, name)
+	}
+	content, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	if err := handler.Store.Save(name, content); err != nil {
+		return err
+	}
+	file.StoredName = name
+	return nil
+}
+
+func sniffContentType(header *multipart.FileHeader) (string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	buffer := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, buffer)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return strings.Split(http.DetectContentType(buffer[:n]), ";")[0], nil
+}
@@ -0,0 +1,315 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+type MessageType int
+
+const (
+	continuationFrame MessageType = 0x0
+	TextMessage       MessageType = 0x1
+	BinaryMessage     MessageType = 0x2
+	CloseMessage      MessageType = 0x8
+	PingMessage       MessageType = 0x9
+	PongMessage       MessageType = 0xA
+)
+
+// Close codes defined by RFC 6455
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+const (
+	finBit         = 0x80
+	rsvBits        = 0x70
+	opcodeBits     = 0x0F
+	maskBit        = 0x80
+	maxControlSize = 125
+	closeWriteWait = time.Second
+)
+
+var (
+	ErrClosed          = errors.New("websocket connection closed")
+	errMessageTooBig   = errors.New("websocket message too big")
+	errUnmaskedFrame   = errors.New("websocket client frame is not masked")
+	errBadControlFrame = errors.New("bad websocket control frame")
+	errBadContinuation = errors.New("unexpected websocket continuation frame")
+	errBadOpcode       = errors.New("unknown websocket opcode")
+	errInvalidUTF8     = errors.New("websocket text message is not valid utf-8")
+)
+
+// A CloseError is returned by ReadMessage when the peer closed the connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (err *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: code=%d, reason=%q", err.Code, err.Reason)
+}
+
+// A Conn is a server side websocket connection. ReadMessage must be called from one goroutine,
+// while write methods are safe for concurrent use.
+type Conn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	request        *webserver.Request
+	maxMessageSize int64
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	writeMutex     sync.Mutex
+	closeOnce      sync.Once
+	closed         chan struct{}
+	closeSent      bool
+	bytesRead      int64
+	bytesWritten   int64
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, request *webserver.Request, handler *WebSocket) *Conn {
+	return &Conn{
+		conn:           conn,
+		reader:         reader,
+		request:        request,
+		maxMessageSize: handler.MaxMessageSize,
+		readTimeout:    handler.PingInterval + handler.PongTimeout,
+		writeTimeout:   handler.WriteTimeout,
+		closed:         make(chan struct{}),
+	}
+}
+
+// Request returns the web server request that was upgraded to this connection
+func (conn *Conn) Request() *webserver.Request {
+	return conn.request
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.conn.RemoteAddr()
+}
+
+// Closed returns a channel closed when the underlying connection is closed
+func (conn *Conn) Closed() <-chan struct{} {
+	return conn.closed
+}
+
+// ReadMessage reads next text or binary message. Control frames are handled internally: pings
+// are answered, and a close frame is echoed then returned as *CloseError.
+func (conn *Conn) ReadMessage() (MessageType, []byte, error) {
+	var messageType MessageType
+	var message []byte
+	for {
+		fin, opcode, payload, err := conn.readFrame()
+		if err != nil {
+			conn.closeWithError(err)
+			return 0, nil, err
+		}
+		switch opcode {
+		case PingMessage:
+			if err := conn.writeFrame(PongMessage, payload, conn.writeTimeout); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			closeErr := &CloseError{Code: CloseNoStatus}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+			}
+			conn.Close(CloseNormal, "")
+			return 0, nil, closeErr
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				conn.closeWithError(errBadContinuation)
+				return 0, nil, errBadContinuation
+			}
+			messageType = opcode
+		case continuationFrame:
+			if messageType == 0 {
+				conn.closeWithError(errBadContinuation)
+				return 0, nil, errBadContinuation
+			}
+		default:
+			conn.closeWithError(errBadOpcode)
+			return 0, nil, errBadOpcode
+		}
+		if conn.maxMessageSize > 0 && int64(len(message)+len(payload)) > conn.maxMessageSize {
+			conn.closeWithError(errMessageTooBig)
+			return 0, nil, errMessageTooBig
+		}
+		message = append(message, payload...)
+		if fin {
+			if messageType == TextMessage && !utf8.Valid(message) {
+				conn.closeWithError(errInvalidUTF8)
+				return 0, nil, errInvalidUTF8
+			}
+			return messageType, message, nil
+		}
+	}
+}
+
+func (conn *Conn) readFrame() (bool, MessageType, []byte, error) {
+	if conn.readTimeout > 0 {
+		conn.conn.SetReadDeadline(time.Now().Add(conn.readTimeout))
+	}
+	var header [2]byte
+	if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&finBit != 0
+	opcode := MessageType(header[0] & opcodeBits)
+	if header[0]&rsvBits != 0 {
+		return false, 0, nil, errBadOpcode
+	}
+	if header[1]&maskBit == 0 {
+		return false, 0, nil, errUnmaskedFrame
+	}
+	length := int64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(conn.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(conn.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+		if length < 0 {
+			return false, 0, nil, errMessageTooBig
+		}
+	}
+	if opcode >= CloseMessage && (!fin || length > maxControlSize) {
+		return false, 0, nil, errBadControlFrame
+	}
+	if conn.maxMessageSize > 0 && length > conn.maxMessageSize {
+		return false, 0, nil, errMessageTooBig
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(conn.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	conn.bytesRead += 2 + length
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage writes a single frame message
+func (conn *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	switch messageType {
+	case TextMessage, BinaryMessage, PingMessage, PongMessage:
+	default:
+		return errBadOpcode
+	}
+	return conn.writeFrame(messageType, data, conn.writeTimeout)
+}
+
+func (conn *Conn) WriteText(text string) error {
+	return conn.writeFrame(TextMessage, []byte(text), conn.writeTimeout)
+}
+
+func (conn *Conn) WriteBinary(data []byte) error {
+	return conn.writeFrame(BinaryMessage, data, conn.writeTimeout)
+}
+
+// Ping sends a ping frame, the read deadline is extended when any frame is received
+func (conn *Conn) Ping() error {
+	return conn.writeFrame(PingMessage, nil, conn.writeTimeout)
+}
+
+// writeFrame writes a frame with the write deadline of timeout if positive
+func (conn *Conn) writeFrame(opcode MessageType, payload []byte, timeout time.Duration) error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	if conn.closeSent {
+		return ErrClosed
+	}
+	if opcode >= CloseMessage && len(payload) > maxControlSize {
+		return errBadControlFrame
+	}
+	header := make([]byte, 2, 10)
+	header[0] = finBit | byte(opcode)
+	switch length := len(payload); {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if timeout > 0 {
+		conn.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	if _, err := conn.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	conn.bytesWritten += int64(len(header) + len(payload))
+	if opcode == CloseMessage {
+		conn.closeSent = true
+	}
+	return nil
+}
+
+// Close sends a close frame with code and reason, then closes the underlying connection
+func (conn *Conn) Close(code int, reason string) error {
+	var err error
+	conn.closeOnce.Do(func() {
+		// truncate the reason on a rune boundary to keep it valid UTF-8
+		for len(reason) > maxControlSize-2 {
+			_, size := utf8.DecodeLastRuneInString(reason)
+			reason = reason[:len(reason)-size]
+		}
+		payload := make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+		conn.writeFrame(CloseMessage, payload, closeWriteWait)
+		err = conn.conn.Close()
+		close(conn.closed)
+	})
+	return err
+}
+
+func (conn *Conn) closeWithError(err error) {
+	switch err {
+	case errInvalidUTF8:
+		conn.Close(CloseInvalidPayload, "")
+	case errMessageTooBig:
+		conn.Close(CloseMessageTooBig, "")
+	case errUnmaskedFrame, errBadControlFrame, errBadContinuation, errBadOpcode:
+		conn.Close(CloseProtocolError, err.Error())
+	default:
+		conn.Close(CloseGoingAway, "")
+	}
+}
@@ -0,0 +1,147 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/client/messagequeue"
+	"github.com/yangchenxing/cangshan/logging"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerWebSocketHub", new(Hub))
+}
+
+const (
+	defaultHubSendBuffer = 64
+	// BinaryHeaderKey marks a message to be sent as binary frame if its header value is true
+	BinaryHeaderKey = "websocket.binary"
+)
+
+// A Hub is a websocket Module broadcasting messages of a message queue category to all
+// connected clients. If Publish is set, messages received from clients are published to the
+// same category. Clients that can not keep up with SendBuffer pending messages are dropped.
+type Hub struct {
+	sync.Mutex
+	MessageQueue msgq.MessageQueue
+	Category     string
+	Publish      bool
+	SendBuffer   int
+	conns        map[*Conn]chan *msgq.Message
+}
+
+// Initialize the Hub module for application
+func (hub *Hub) Initialize() error {
+	if hub.MessageQueue == nil {
+		return errors.New("Missing MessageQueue")
+	} else if hub.Category == "" {
+		return errors.New("Missing Category")
+	}
+	if hub.SendBuffer == 0 {
+		hub.SendBuffer = defaultHubSendBuffer
+	}
+	hub.conns = make(map[*Conn]chan *msgq.Message)
+	msgChan, errChan := hub.MessageQueue.Subscribe(hub.Category)
+	go hub.dispatch(msgChan, errChan)
+	return nil
+}
+
+// Broadcast sends the message to all connected clients
+func (hub *Hub) Broadcast(message *msgq.Message) {
+	hub.Lock()
+	defer hub.Unlock()
+	for conn, sendChan := range hub.conns {
+		select {
+		case sendChan <- message:
+		default:
+			logging.Warn("Drop slow websocket client %s of hub %s", conn.RemoteAddr(), hub.Category)
+			delete(hub.conns, conn)
+			close(sendChan)
+			go conn.Close(ClosePolicyViolation, "too slow")
+		}
+	}
+}
+
+// Count returns the number of connected clients
+func (hub *Hub) Count() int {
+	hub.Lock()
+	defer hub.Unlock()
+	return len(hub.conns)
+}
+
+func (hub *Hub) ServeWebSocket(conn *Conn) error {
+	sendChan := make(chan *msgq.Message, hub.SendBuffer)
+	hub.Lock()
+	hub.conns[conn] = sendChan
+	hub.Unlock()
+	defer hub.unregister(conn)
+	go hub.send(conn, sendChan)
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			if _, ok := err.(*CloseError); !ok {
+				conn.Request().Debug("Read websocket message fail: %s", err.Error())
+			}
+			return nil
+		}
+		if !hub.Publish {
+			continue
+		}
+		message := &msgq.Message{
+			Type: hub.Category,
+			Header: map[string]interface{}{
+				"remote_addr":   conn.RemoteAddr().String(),
+				BinaryHeaderKey: messageType == BinaryMessage,
+			},
+			Body: data,
+		}
+		if err := hub.MessageQueue.Publish(message); err != nil {
+			conn.Request().Error("Publish websocket message to %s fail: %s", hub.Category, err.Error())
+		}
+	}
+}
+
+func (hub *Hub) send(conn *Conn, sendChan <-chan *msgq.Message) {
+	for message := range sendChan {
+		var err error
+		if binary, _ := message.Header[BinaryHeaderKey].(bool); binary {
+			err = conn.WriteBinary(message.Body)
+		} else {
+			err = conn.WriteMessage(TextMessage, message.Body)
+		}
+		if err != nil {
+			conn.Request().Debug("Write websocket message fail: %s", err.Error())
+			conn.Close(CloseGoingAway, "")
+			return
+		}
+	}
+}
+
+func (hub *Hub) unregister(conn *Conn) {
+	hub.Lock()
+	defer hub.Unlock()
+	if sendChan, found := hub.conns[conn]; found {
+		delete(hub.conns, conn)
+		close(sendChan)
+	}
+}
+
+func (hub *Hub) dispatch(msgChan <-chan *msgq.Message, errChan <-chan error) {
+	for {
+		select {
+		case message, ok := <-msgChan:
+			if !ok {
+				return
+			} else if message != nil {
+				hub.Broadcast(message)
+			}
+		case err, ok := <-errChan:
+			if !ok {
+				return
+			} else if err != nil {
+				logging.Error("Websocket hub %s receive message fail: %s", hub.Category, err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yangchenxing/cangshan/application"
+	"github.com/yangchenxing/cangshan/webserver"
+)
+
+func init() {
+	application.RegisterModulePrototype("WebServerWebSocket", new(WebSocket))
+}
+
+const (
+	acceptGUID            = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	defaultPingInterval   = time.Second * 30
+	defaultPongTimeout    = time.Second * 10
+	defaultWriteTimeout   = time.Second * 10
+	defaultMaxMessageSize = 1 << 20
+)
+
+// A Module serves upgraded websocket connections. ServeWebSocket should return when the
+// connection is no longer used, the connection is closed after it returns.
+type Module interface {
+	ServeWebSocket(conn *Conn) error
+}
+
+// A WebSocket handler upgrades matched requests to websocket connections and serves them with
+// Module. Ping frames are sent every PingInterval, and the connection is dropped if nothing is
+// received within PingInterval+PongTimeout.
+type WebSocket struct {
+	Module         Module
+	Origins        []string
+	PingInterval   time.Duration
+	PongTimeout    time.Duration
+	WriteTimeout   time.Duration
+	MaxMessageSize int64
+	origins        map[string]bool
+}
+
+// Initialize the WebSocket module for application
+func (handler *WebSocket) Initialize() error {
+	if handler.Module == nil {
+		return errors.New("Missing Module")
+	}
+	if handler.PingInterval == 0 {
+		handler.PingInterval = defaultPingInterval
+	}
+	if handler.PongTimeout == 0 {
+		handler.PongTimeout = defaultPongTimeout
+	}
+	if handler.WriteTimeout == 0 {
+		handler.WriteTimeout = defaultWriteTimeout
+	}
+	if handler.MaxMessageSize == 0 {
+		handler.MaxMessageSize = defaultMaxMessageSize
+	}
+	handler.origins = make(map[string]bool)
+	for _, origin := range handler.Origins {
+		handler.origins[strings.ToLower(origin)] = true
+	}
+	return nil
+}
+
+func (handler *WebSocket) Handle(request *webserver.Request) {
+	key, err := handler.checkHandshake(request)
+	if err != nil {
+		request.Warn("Reject websocket handshake: %s", err.Error())
+		request.ResponseHeader().Set("Sec-WebSocket-Version", "13")
+		request.WriteAndStop(http.StatusBadRequest, []byte(err.Error()), "text/plain")
+		return
+	}
+	if len(handler.origins) > 0 && !handler.origins[strings.ToLower(request.Header.Get("Origin"))] {
+		request.Warn("Reject websocket origin: %s", request.Header.Get("Origin"))
+		request.WriteAndStop(http.StatusForbidden, nil, "")
+		return
+	}
+	netConn, rw, err := request.Hijack(http.StatusSwitchingProtocols)
+	if err != nil {
+		request.Error("Hijack websocket connection fail: %s", err.Error())
+		request.WriteAndStop(http.StatusInternalServerError, nil, "")
+		return
+	}
+	defer request.Stop()
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n")
+	fmt.Fprintf(rw, "Upgrade: websocket\r\n")
+	fmt.Fprintf(rw, "Connection: Upgrade\r\n")
+	fmt.Fprintf(rw, "Sec-WebSocket-Accept: %s\r\n", acceptKey(key))
+	for name, values := range request.ResponseHeader() {
+		for _, value := range values {
+			fmt.Fprintf(rw, "%s: %s\r\n", name, value)
+		}
+	}
+	fmt.Fprintf(rw, "\r\n")
+	if err := rw.Flush(); err != nil {
+		request.Error("Write websocket handshake fail: %s", err.Error())
+		netConn.Close()
+		return
+	}
+	netConn.SetDeadline(time.Time{})
+	conn := newConn(netConn, rw.Reader, request, handler)
+	go handler.keepalive(conn)
+	request.Debug("Websocket connection established")
+	if err := handler.Module.ServeWebSocket(conn); err != nil {
+		request.Warn("Serve websocket fail: %s", err.Error())
+		conn.Close(CloseInternalError, "")
+	} else {
+		conn.Close(CloseNormal, "")
+	}
+	request.Attr["websocket.bytes_in"] = conn.bytesRead
+	request.Attr["websocket.bytes_out"] = conn.bytesWritten
+}
+
+func (handler *WebSocket) checkHandshake(request *webserver.Request) (string, error) {
+	if request.Method != "GET" {
+		return "", errors.New("websocket handshake must be GET")
+	}
+	if !headerContainsToken(request.Header, "Connection", "upgrade") {
+		return "", errors.New("missing Connection: Upgrade")
+	}
+	if !headerContainsToken(request.Header, "Upgrade", "websocket") {
+		return "", errors.New("missing Upgrade: websocket")
+	}
+	if request.Header.Get("Sec-WebSocket-Version") != "13" {
+		return "", errors.New("unsupported websocket version")
+	}
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return "", errors.New("bad Sec-WebSocket-Key")
+	}
+	return key, nil
+}
+
+func (handler *WebSocket) keepalive(conn *Conn) {
+	ticker := time.NewTicker(handler.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.Ping(); err != nil {
+				conn.request.Debug("Send websocket ping fail: %s", err.Error())
+				conn.Close(CloseGoingAway, "")
+				return
+			}
+		case <-conn.Closed():
+			return
+		}
+	}
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func acceptKey(key string) string {
+	digest := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
@@ -6,6 +6,11 @@ import (
 )
 
 func WriteStandardJSONResult(request *Request, success bool, params ...interface{}) {
+	WriteStandardJSONResultWithStatus(request, 200, success, params...)
+}
+
+// WriteStandardJSONResultWithStatus writes the standard json result with specified http status
+func WriteStandardJSONResultWithStatus(request *Request, status int, success bool, params ...interface{}) {
 	result := map[string]interface{}{
 		"success": success,
 	}
@@ -19,6 +24,6 @@ func WriteStandardJSONResult(request *Request, success bool, params ...interface
 		logging.Error("Marshal standard json success entity fail: %s", err.Error())
 		request.Write(500, nil, "")
 	} else {
-		request.Write(200, content, "application/json")
+		request.Write(status, content, "application/json")
 	}
 }
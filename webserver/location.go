@@ -11,12 +11,19 @@ func init() {
 	application.RegisterModulePrototype("WebServerLocation", new(Location))
 }
 
+// PathParamsAttrKey is the request attribute of parameters captured by the location path, as a
+// map[string]string. The captured parameters are also set in Param.
+const PathParamsAttrKey = "location.params"
+
 type Location struct {
 	Path        string
 	Methods     []string
 	PreProcess  []Handler
 	Handler     Handler
 	PostProcess []Handler
+	Summary     string
+	Description string
+	Tags        []string
 	path        *regexp.Regexp
 	handlers    []Handler
 	methods     map[string]bool
@@ -48,22 +55,37 @@ func (loc *Location) Initialize() error {
 	return nil
 }
 
-func (loc *Location) Handle(request *Request) (match bool) {
+// Matches reports whether the request method and path match the location
+func (loc *Location) Matches(request *Request) bool {
+	_, match := loc.match(request)
+	return match
+}
+
+func (loc *Location) match(request *Request) ([]string, bool) {
 	if len(loc.methods) > 0 && !loc.methods[request.Method] {
-		return false
+		return nil, false
 	}
 	if loc.path == nil {
-		if request.URL.Path != loc.Path {
-			return false
-		}
-	} else if subexps := loc.path.FindStringSubmatch(request.URL.Path); subexps == nil {
+		return nil, request.URL.Path == loc.Path
+	}
+	subexps := loc.path.FindStringSubmatch(request.URL.Path)
+	return subexps, subexps != nil
+}
+
+func (loc *Location) Handle(request *Request) (match bool) {
+	subexps, match := loc.match(request)
+	if !match {
 		return false
-	} else {
+	}
+	if subexps != nil {
+		params := make(map[string]string)
 		for i, name := range loc.path.SubexpNames() {
 			if name != "" && subexps[i] != "" {
 				request.Param[name] = subexps[i]
+				params[name] = subexps[i]
 			}
 		}
+		request.Attr[PathParamsAttrKey] = params
 	}
 	for _, handler := range loc.handlers {
 		handler.Handle(request)
@@ -0,0 +1,319 @@
+package webserver
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/yangchenxing/cangshan/application"
+)
+
+func init() {
+	application.RegisterBuiltinModule("WebServerOpenAPI", SimpleHandler(serveOpenAPI))
+	application.RegisterBuiltinModule("WebServerOpenAPIDocs", &OpenAPIDocs{
+		URL:       defaultOpenAPIDocsURL,
+		AssetsURL: defaultSwaggerUIAssetsURL,
+	})
+	application.RegisterModulePrototype("WebServerOpenAPIDocs", new(OpenAPIDocs))
+}
+
+const (
+	openAPIVersion        = "3.0.3"
+	defaultAPITitle       = "cangshan web server"
+	defaultAPIVersion     = "1.0.0"
+	defaultOpenAPIDocsURL = "openapi.json"
+	// defaultSwaggerUIAssetsURL is the CDN of swagger-ui-dist
+	defaultSwaggerUIAssetsURL = "https://unpkg.com/swagger-ui-dist@5"
+)
+
+var (
+	namedGroupPattern = regexp.MustCompile(`\(\?P<([a-zA-Z_][a-zA-Z0-9_]*)>(?:[^()]|\([^()]*\))*\)`)
+	regexMetaPattern  = regexp.MustCompile(`[\\.+*?()|\[\]{}^$]`)
+	openAPIDocsPage   = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="{{.AssetsURL}}/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="{{.AssetsURL}}/swagger-ui-bundle.js"></script>
+<script>
+window.onload = function() {
+	SwaggerUIBundle({url: {{.URL}}, dom_id: "#swagger-ui"});
+};
+</script>
+</body>
+</html>
+`))
+)
+
+// An APIOperation is the OpenAPI operation of a Location method being described
+type APIOperation struct {
+	Method      string
+	Path        string
+	Summary     string
+	Description string
+	Tags        []string
+	Parameters  []map[string]interface{}
+	RequestBody map[string]interface{}
+	Responses   map[string]interface{}
+	// Schemas are added to components/schemas of the document
+	Schemas map[string]interface{}
+}
+
+// AddParameter adds a parameter object, replacing the one with the same name and location
+func (op *APIOperation) AddParameter(name, in string, required bool, schema map[string]interface{}, description string) {
+	param := map[string]interface{}{
+		"name":     name,
+		"in":       in,
+		"required": required || in == "path",
+		"schema":   schema,
+	}
+	if description != "" {
+		param["description"] = description
+	}
+	for i, p := range op.Parameters {
+		if p["name"] == name && p["in"] == in {
+			op.Parameters[i] = param
+			return
+		}
+	}
+	op.Parameters = append(op.Parameters, param)
+}
+
+// HasPathParameter reports whether the location path captures the named parameter
+func (op *APIOperation) HasPathParameter(name string) bool {
+	return strings.Contains(op.Path, "{"+name+"}")
+}
+
+// SetJSONResponse sets the schema of a standard json result response
+func (op *APIOperation) SetJSONResponse(status, description string, entities map[string]interface{}) {
+	properties := map[string]interface{}{
+		"success": map[string]interface{}{"type": "boolean"},
+		"message": map[string]interface{}{"type": "string"},
+	}
+	if entities != nil {
+		properties["entities"] = entities
+	}
+	op.Responses[status] = map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"type": "object", "properties": properties},
+			},
+		},
+	}
+}
+
+// An APIDescriber is a Location handler that contributes to the OpenAPI document
+type APIDescriber interface {
+	DescribeAPI(op *APIOperation)
+}
+
+// An APIMethodsDescriber tells the methods served by a handler in a Location without Methods
+type APIMethodsDescriber interface {
+	APIMethods() []string
+}
+
+// OpenAPI returns the OpenAPI document describing all locations of the web server
+func (server *WebServer) OpenAPI() map[string]interface{} {
+	paths := make(map[string]interface{})
+	schemas := make(map[string]interface{})
+	for _, loc := range collectLocations(server.Handlers) {
+		path, pattern := openAPIPath(loc.Path)
+		item, found := paths[path].(map[string]interface{})
+		if !found {
+			item = make(map[string]interface{})
+			if pattern != "" {
+				item["x-path-pattern"] = pattern
+			}
+			paths[path] = item
+		}
+		for _, method := range loc.apiMethods() {
+			op := &APIOperation{
+				Method:      method,
+				Path:        path,
+				Summary:     loc.Summary,
+				Description: loc.Description,
+				Tags:        loc.Tags,
+				Responses:   make(map[string]interface{}),
+				Schemas:     make(map[string]interface{}),
+			}
+			for _, name := range loc.pathParams() {
+				op.AddParameter(name, "path", true, map[string]interface{}{"type": "string"}, "")
+			}
+			for _, handler := range loc.handlers {
+				if describer, ok := handler.(APIDescriber); ok {
+					describer.DescribeAPI(op)
+				}
+			}
+			if len(op.Responses) == 0 {
+				op.Responses["default"] = map[string]interface{}{"description": "response"}
+			}
+			for name, schema := range op.Schemas {
+				schemas[name] = schema
+			}
+			item[strings.ToLower(method)] = op.object()
+		}
+	}
+	info := map[string]interface{}{
+		"title":   server.OpenAPIInfo.Title,
+		"version": server.OpenAPIInfo.Version,
+	}
+	if info["title"] == "" {
+		info["title"] = defaultAPITitle
+	}
+	if info["version"] == "" {
+		info["version"] = defaultAPIVersion
+	}
+	if server.OpenAPIInfo.Description != "" {
+		info["description"] = server.OpenAPIInfo.Description
+	}
+	doc := map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info":    info,
+		"paths":   paths,
+	}
+	if len(schemas) > 0 {
+		doc["components"] = map[string]interface{}{"schemas": schemas}
+	}
+	return doc
+}
+
+func (op *APIOperation) object() map[string]interface{} {
+	object := map[string]interface{}{
+		"operationId": op.Method + " " + op.Path,
+		"responses":   op.Responses,
+	}
+	if op.Summary != "" {
+		object["summary"] = op.Summary
+	}
+	if op.Description != "" {
+		object["description"] = op.Description
+	}
+	if len(op.Tags) > 0 {
+		object["tags"] = op.Tags
+	}
+	if len(op.Parameters) > 0 {
+		object["parameters"] = op.Parameters
+	}
+	// request bodies of these methods have no defined semantics
+	if op.RequestBody != nil && op.Method != "GET" && op.Method != "HEAD" && op.Method != "DELETE" {
+		object["requestBody"] = op.RequestBody
+	}
+	return object
+}
+
+func collectLocations(handlers []MatchHandler) []*Location {
+	locations := make([]*Location, 0, len(handlers))
+	for _, handler := range handlers {
+		switch h := handler.(type) {
+		case *Location:
+			locations = append(locations, h)
+		case *HandlerGroup:
+			locations = append(locations, collectLocations(h.Handlers)...)
+		}
+	}
+	return locations
+}
+
+func (loc *Location) apiMethods() []string {
+	if len(loc.Methods) > 0 {
+		return loc.Methods
+	}
+	for _, handler := range loc.handlers {
+		if describer, ok := handler.(APIMethodsDescriber); ok {
+			return describer.APIMethods()
+		}
+	}
+	return []string{"GET"}
+}
+
+func (loc *Location) pathParams() []string {
+	if loc.path == nil {
+		return nil
+	}
+	names := make([]string, 0)
+	for _, name := range loc.path.SubexpNames() {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// openAPIPath converts a location path to an OpenAPI path template. Named groups become path
+// parameters, and if other regular expression syntax remains the original pattern is returned
+// as well.
+func openAPIPath(path string) (string, string) {
+	if path == "" || (path[0] != '^' && path[len(path)-1] != '$') {
+		return path, ""
+	}
+	result := strings.TrimSuffix(strings.TrimPrefix(path, "^"), "$")
+	result = namedGroupPattern.ReplaceAllString(result, "{$1}")
+	if regexMetaPattern.MatchString(strings.NewReplacer("{", "", "}", "").Replace(result)) {
+		return result, path
+	}
+	return result, ""
+}
+
+func serveOpenAPI(request *Request) {
+	if request.server == nil {
+		request.Write(http.StatusNotFound, nil, "")
+		return
+	}
+	content, err := json.Marshal(request.server.OpenAPI())
+	if err != nil {
+		request.Error("Marshal openapi document fail: %s", err.Error())
+		request.Write(http.StatusInternalServerError, nil, "")
+		return
+	}
+	request.Write(http.StatusOK, content, "application/json")
+}
+
+// An OpenAPIDocs serves a swagger-ui page of the OpenAPI document at URL, "openapi.json" relative
+// to the page by default. The swagger-ui-dist assets are loaded from AssetsURL, unpkg.com by
+// default, which should be set to a self-hosted copy where the CDN is not reachable or trusted.
+type OpenAPIDocs struct {
+	Title     string
+	URL       string
+	AssetsURL string
+}
+
+func (docs *OpenAPIDocs) Initialize() error {
+	if docs.URL == "" {
+		docs.URL = defaultOpenAPIDocsURL
+	}
+	if docs.AssetsURL == "" {
+		docs.AssetsURL = defaultSwaggerUIAssetsURL
+	}
+	docs.AssetsURL = strings.TrimRight(docs.AssetsURL, "/")
+	return nil
+}
+
+func (docs *OpenAPIDocs) Handle(request *Request) {
+	var page strings.Builder
+	data := map[string]string{
+		"Title":     docs.Title,
+		"URL":       docs.URL,
+		"AssetsURL": docs.AssetsURL,
+	}
+	if data["Title"] == "" && request.server != nil {
+		data["Title"] = request.server.OpenAPIInfo.Title
+	}
+	if data["Title"] == "" {
+		data["Title"] = defaultAPITitle
+	}
+	if err := openAPIDocsPage.Execute(&page, data); err != nil {
+		request.Error("Render openapi docs page fail: %s", err.Error())
+		request.Write(http.StatusInternalServerError, nil, "")
+		return
+	}
+	request.Write(http.StatusOK, []byte(page.String()), "text/html; charset=utf-8")
+}
@@ -1,17 +1,23 @@
 package webserver
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"time"
 
 	"github.com/yangchenxing/cangshan/logging"
+	"github.com/yangchenxing/cangshan/tracing"
 )
 
 var (
 	RemoteAddrHeaders = []string{"RemoteAddr"}
+	errNotHijackable  = errors.New("response writer does not support hijacking")
+	errNotFlushable   = errors.New("response writer does not support flushing")
 )
 
 // A Request present a webserver request
@@ -27,8 +33,13 @@ type Request struct {
 	receiveTime  time.Time
 	logFormatter *logging.Formatter
 	done         bool
+	detached     bool
+	streamed     int
 	stopped      bool
 	clientIP     net.IP
+	server       *WebServer
+	span         *tracing.Span
+	finishing    []func()
 }
 
 func newRequest(request *http.Request, response http.ResponseWriter, formatter *logging.Formatter) *Request {
@@ -60,6 +71,8 @@ func newRequest(request *http.Request, response http.ResponseWriter, formatter *
 		"request.auth":        "-",
 		"request.clientip":    clientIP,
 	}
+	attr[tracing.TraceIDAttrKey] = "-"
+	attr[tracing.SpanIDAttrKey] = "-"
 	req := &Request{
 		Request:      request,
 		Attr:         attr,
@@ -94,6 +107,53 @@ func (request *Request) GetClientIP() net.IP {
 	return request.clientIP
 }
 
+// Server returns the web server serving the request
+func (request *Request) Server() *WebServer {
+	return request.server
+}
+
+// Status returns the response status written so far
+func (request *Request) Status() int {
+	return request.status
+}
+
+// Content returns the buffered response content written so far
+func (request *Request) Content() []byte {
+	return request.content.Bytes()
+}
+
+// Span returns the server span of the request, or nil if the web server has no Tracer
+func (request *Request) Span() *tracing.Span {
+	return request.span
+}
+
+// OnFinish registers a callback invoked after the response is sent, even if the response was
+// written by the handler itself with Done. Callbacks are invoked in reverse order.
+func (request *Request) OnFinish(callback func()) {
+	request.finishing = append(request.finishing, callback)
+}
+
+func (request *Request) startSpan(tracer *tracing.Tracer) {
+	span := tracer.StartRequestSpan(request.Request)
+	span.SetAttribute("http.client_ip", request.clientIP.String())
+	request.span = span
+	request.Attr[tracing.TraceIDAttrKey] = span.Context.TraceIDString()
+	request.Attr[tracing.SpanIDAttrKey] = span.Context.SpanIDString()
+	if parentID := span.ParentIDString(); parentID != "" {
+		request.Attr[tracing.ParentSpanIDAttrKey] = parentID
+	}
+	span.Inject(request.ResponseHeader())
+	request.OnFinish(func() {
+		if request.status != 0 {
+			span.SetAttribute("http.status_code", request.status)
+		}
+		if request.status >= 500 {
+			span.SetError(fmt.Errorf("response status %d", request.status))
+		}
+		span.Finish()
+	})
+}
+
 // Write set or overwrite response status, content and content type that will be sent.
 func (request *Request) Write(status int, content []byte, contentType string) error {
 	request.status = status
@@ -126,7 +186,62 @@ func (request *Request) Done() {
 	request.done = true
 }
 
+// Hijack takes over the underlying connection, e.g. for protocol upgrades. The request is marked
+// done, and its access log is written with status after the handlers return.
+func (request *Request) Hijack(status int) (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := request.response.(http.Hijacker)
+	if !ok {
+		return nil, nil, errNotHijackable
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	request.status = status
+	request.content.Reset()
+	request.detached = true
+	request.done = true
+	return conn, rw, nil
+}
+
+// Stream writes status and headers immediately, and returns a writer flushing every write to the
+// client, for responses like server-sent events. The request is marked done, and its access log
+// is written after the handlers return.
+func (request *Request) Stream(status int, contentType string) (io.Writer, error) {
+	flusher, ok := request.response.(http.Flusher)
+	if !ok {
+		return nil, errNotFlushable
+	}
+	if contentType != "" {
+		request.ResponseHeader().Set("Content-Type", contentType)
+	}
+	request.status = status
+	request.content.Reset()
+	request.response.WriteHeader(status)
+	flusher.Flush()
+	request.detached = true
+	request.done = true
+	return &streamWriter{request, flusher}, nil
+}
+
+type streamWriter struct {
+	request *Request
+	flusher http.Flusher
+}
+
+func (writer *streamWriter) Write(p []byte) (int, error) {
+	n, err := writer.request.response.Write(p)
+	writer.request.streamed += n
+	writer.flusher.Flush()
+	return n, err
+}
+
 func (request *Request) buildResponse() error {
+	defer request.finish()
+	if request.detached {
+		request.logAccess()
+		return nil
+	}
 	if !request.done {
 		request.response.WriteHeader(request.status)
 		if _, err := request.response.Write(request.content.Bytes()); err != nil {
@@ -138,10 +253,17 @@ func (request *Request) buildResponse() error {
 	return nil
 }
 
+func (request *Request) finish() {
+	for i := len(request.finishing) - 1; i >= 0; i-- {
+		request.finishing[i]()
+	}
+	request.finishing = nil
+}
+
 func (request *Request) logAccess() {
 	request.Attr["request.timecost"] = time.Now().Sub(request.receiveTime)
 	request.Attr["request.status"] = request.status
-	request.Attr["request.bodylen"] = request.content.Len()
+	request.Attr["request.bodylen"] = request.content.Len() + request.streamed
 	logging.LogEx(2, "access", nil, request.Attr, "")
 }
 
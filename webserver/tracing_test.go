@@ -0,0 +1,53 @@
+package webserver
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yangchenxing/cangshan/tracing"
+)
+
+type statusHandler int
+
+func (handler statusHandler) Handle(request *Request) bool {
+	request.Write(int(handler), nil, "text/plain")
+	return true
+}
+
+func TestServerSpanStatus(t *testing.T) {
+	exporter := new(tracing.MemoryExporter)
+	tracer := &tracing.Tracer{Exporter: exporter}
+	tracer.Initialize()
+	tests := []struct {
+		status int
+		failed bool
+	}{
+		{200, false},
+		{404, false},
+		{500, true},
+		{503, true},
+	}
+	for _, test := range tests {
+		exporter.Reset()
+		server := &WebServer{Handlers: []MatchHandler{statusHandler(test.status)}, Tracer: tracer}
+		request := httptest.NewRequest("GET", "/path", nil)
+		request.Header.Set(tracing.TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		spans := exporter.Spans()
+		if len(spans) != 1 {
+			t.Fatalf("status %d: %d spans exported", test.status, len(spans))
+		}
+		span := spans[0]
+		if span.Attributes["http.status_code"] != test.status || span.Failed != test.failed {
+			t.Errorf("status %d: unexpected span %v, failed %v", test.status, span.Attributes, span.Failed)
+		}
+		if span.Context.TraceIDString() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("status %d: trace not continued", test.status)
+		}
+		if response.Header().Get(tracing.TraceParentHeader) != span.Context.TraceParent() {
+			t.Errorf("status %d: unexpected traceparent response header %q", test.status,
+				response.Header().Get(tracing.TraceParentHeader))
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/yangchenxing/cangshan/application"
 	"github.com/yangchenxing/cangshan/logging"
+	"github.com/yangchenxing/cangshan/tracing"
 )
 
 func init() {
@@ -17,6 +18,12 @@ type WebServer struct {
 	Name         string
 	Handlers     []MatchHandler
 	LogFormatter *logging.Formatter
+	Tracer       *tracing.Tracer
+	OpenAPIInfo  struct {
+		Title       string
+		Version     string
+		Description string
+	}
 }
 
 func (server *WebServer) Initialize() error {
@@ -32,7 +39,12 @@ func (server *WebServer) Run() error {
 }
 
 func (server *WebServer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
-	server.serveHTTP(newRequest(request, response, server.LogFormatter))
+	req := newRequest(request, response, server.LogFormatter)
+	req.server = server
+	if server.Tracer != nil {
+		req.startSpan(server.Tracer)
+	}
+	server.serveHTTP(req)
 }
 
 func (server *WebServer) serveHTTP(request *Request) {